@@ -0,0 +1,337 @@
+// Package archive stores snapshot streams as files described by a JSON manifest, so they can be kept in cold
+// storage or carried to air-gapped systems, and restored later with zfs receive.
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+const (
+	// ManifestFile is the name of the manifest in an archive directory
+	ManifestFile = "manifest.json"
+
+	manifestVersion     = 1
+	streamFileExtension = ".zstream"
+	tempFileExtension   = ".tmp"
+)
+
+var (
+	// ErrManifestExists is returned when creating an archive in a directory that already holds one
+	ErrManifestExists = errors.New("archive manifest already exists")
+
+	// ErrUnsupportedVersion is returned when a manifest was written by an incompatible version
+	ErrUnsupportedVersion = errors.New("unsupported archive manifest version")
+
+	// ErrChecksumMismatch is returned when a stream file does not match the checksum in the manifest
+	ErrChecksumMismatch = errors.New("archive stream checksum mismatch")
+
+	// ErrBrokenChain is returned when the streams in an archive cannot be applied to the restore target
+	ErrBrokenChain = errors.New("archive stream chain is broken")
+
+	// ErrNoStreams is returned when incrementally writing to or restoring from an empty archive
+	ErrNoStreams = errors.New("archive contains no streams")
+)
+
+// Manifest describes the snapshot streams stored in an archive
+type Manifest struct {
+	Version int       `json:"Version"`
+	Dataset string    `json:"Dataset"`
+	Created time.Time `json:"Created"`
+	Streams []Stream  `json:"Streams"`
+}
+
+// Stream describes a single snapshot stream file in an archive
+type Stream struct {
+	// File is the name of the stream file, relative to the archive directory
+	File string `json:"File"`
+	// Snapshot is the full name of the snapshot in the stream
+	Snapshot string `json:"Snapshot"`
+	// GUID is the guid of the snapshot
+	GUID uint64 `json:"GUID,string"`
+	// BaseSnapshot is the full name of the incremental base snapshot, empty for a full stream
+	BaseSnapshot string `json:"BaseSnapshot,omitempty"`
+	// BaseGUID is the guid of the incremental base snapshot, zero for a full stream
+	BaseGUID uint64 `json:"BaseGUID,string,omitempty"`
+	// Size is the size of the stream file in bytes
+	Size int64 `json:"Size"`
+	// Checksum is the hex encoded sha256 checksum of the stream file
+	Checksum string `json:"Checksum"`
+	// Codec is the compression codec of the stream file
+	Codec zfs.Codec `json:"Codec"`
+	// Raw is set for streams that were sent raw
+	Raw bool `json:"Raw"`
+	// KeyID is the hex encoded id of the stream key the file was encrypted with, empty when not encrypted
+	KeyID string `json:"KeyID,omitempty"`
+	// Created is the time the stream was archived
+	Created time.Time `json:"Created"`
+}
+
+// Incremental returns whether the stream is an incremental stream
+func (s Stream) Incremental() bool {
+	return s.BaseGUID != 0
+}
+
+// Archive is a directory with snapshot stream files of a single dataset and their manifest.
+// An Archive is not safe for concurrent use.
+type Archive struct {
+	dir      string
+	manifest Manifest
+}
+
+// Create creates a new archive for the given dataset in the directory, creating the directory if needed
+func Create(dir, dataset string) (*Archive, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %w", err)
+	}
+	_, err = os.Stat(filepath.Join(dir, ManifestFile))
+	switch {
+	case err == nil:
+		return nil, fmt.Errorf("%w in %s", ErrManifestExists, dir)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("error checking manifest: %w", err)
+	}
+
+	a := &Archive{
+		dir: dir,
+		manifest: Manifest{
+			Version: manifestVersion,
+			Dataset: dataset,
+			Created: time.Now(),
+			Streams: []Stream{},
+		},
+	}
+	return a, a.saveManifest()
+}
+
+// Open opens an existing archive in the directory
+func Open(dir string) (*Archive, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	a := &Archive{dir: dir}
+	err = json.Unmarshal(data, &a.manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if a.manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, a.manifest.Version)
+	}
+	return a, nil
+}
+
+// Dir returns the directory of the archive
+func (a *Archive) Dir() string {
+	return a.dir
+}
+
+// Manifest returns a copy of the manifest of the archive
+func (a *Archive) Manifest() Manifest {
+	manifest := a.manifest
+	manifest.Streams = append([]Stream{}, a.manifest.Streams...)
+	return manifest
+}
+
+func (a *Archive) saveManifest() error {
+	data, err := json.MarshalIndent(&a.manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	path := filepath.Join(a.dir, ManifestFile)
+	err = os.WriteFile(path+tempFileExtension, data, 0o640)
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return os.Rename(path+tempFileExtension, path)
+}
+
+// WriteOptions are options you can specify to customize writing a snapshot stream to an archive
+type WriteOptions struct {
+	// Incremental sends the snapshot incrementally from the last snapshot in the archive
+	Incremental bool
+	// Raw sends the data exactly as it exists on disk, see zfs.SendOptions
+	Raw bool
+	// IncludeProperties includes the properties of the dataset in the stream
+	IncludeProperties bool
+	// BytesPerSecond limits the rate at which the stream is written, zero for no limit
+	BytesPerSecond int64
+	// Compression configures the compression codec of the stream file
+	Compression zfs.CompressionOptions
+	// EncryptionKey encrypts the stream file, see zfs.NewEncryptWriter
+	EncryptionKey zfs.StreamKey
+}
+
+// Write sends the snapshot to a new stream file and adds it to the manifest
+func (a *Archive) Write(ctx context.Context, snapshot *zfs.Dataset, options WriteOptions) (Stream, error) {
+	if snapshot.Type != zfs.DatasetSnapshot {
+		return Stream{}, zfs.ErrOnlySnapshotsSupported
+	}
+	dataset, snapName, _ := strings.Cut(snapshot.Name, "@")
+	if dataset != a.manifest.Dataset {
+		return Stream{}, fmt.Errorf("snapshot %s is not of archived dataset %s", snapshot.Name, a.manifest.Dataset)
+	}
+
+	stream := Stream{
+		File:     fmt.Sprintf("%04d-%s%s", len(a.manifest.Streams), snapName, streamFileExtension),
+		Snapshot: snapshot.Name,
+		Codec:    options.Compression.Codec,
+		Raw:      options.Raw,
+	}
+	if !options.Compression.Enabled() {
+		stream.Codec = zfs.CodecNone
+	}
+	if options.EncryptionKey != nil {
+		stream.KeyID = hex.EncodeToString(options.EncryptionKey.ID())
+	}
+
+	guid, err := snapshotGUID(ctx, snapshot.Name)
+	if err != nil {
+		return Stream{}, err
+	}
+	stream.GUID = guid
+
+	var base *zfs.Dataset
+	if options.Incremental {
+		if len(a.manifest.Streams) == 0 {
+			return Stream{}, ErrNoStreams
+		}
+		last := a.manifest.Streams[len(a.manifest.Streams)-1]
+		base, err = zfs.GetDataset(ctx, last.Snapshot, zfs.PropertyGUID)
+		if err != nil {
+			return Stream{}, fmt.Errorf("error getting base snapshot %s: %w", last.Snapshot, err)
+		}
+		if base.ExtraProps[zfs.PropertyGUID] != strconv.FormatUint(last.GUID, 10) {
+			return Stream{}, fmt.Errorf("%w: base snapshot %s does not match the archived guid", ErrBrokenChain, last.Snapshot)
+		}
+		stream.BaseSnapshot = last.Snapshot
+		stream.BaseGUID = last.GUID
+	}
+
+	path := filepath.Join(a.dir, stream.File)
+	stream.Size, stream.Checksum, err = writeStream(path, func(w io.Writer) error {
+		return snapshot.SendSnapshot(ctx, w, zfs.SendOptions{
+			Raw:               options.Raw,
+			IncludeProperties: options.IncludeProperties,
+			IncrementalBase:   base,
+			BytesPerSecond:    options.BytesPerSecond,
+			Compression:       options.Compression,
+			EncryptionKey:     options.EncryptionKey,
+		})
+	})
+	if err != nil {
+		return Stream{}, err
+	}
+	stream.Created = time.Now()
+
+	a.manifest.Streams = append(a.manifest.Streams, stream)
+	err = a.saveManifest()
+	if err != nil {
+		a.manifest.Streams = a.manifest.Streams[:len(a.manifest.Streams)-1]
+		return Stream{}, err
+	}
+	return stream, nil
+}
+
+func snapshotGUID(ctx context.Context, name string) (uint64, error) {
+	ds, err := zfs.GetDataset(ctx, name, zfs.PropertyGUID)
+	if err != nil {
+		return 0, fmt.Errorf("error getting guid of %s: %w", name, err)
+	}
+	guid, err := strconv.ParseUint(ds.ExtraProps[zfs.PropertyGUID], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing guid of %s: %w", name, err)
+	}
+	return guid, nil
+}
+
+// writeStream writes a stream to a temporary file, which is moved into place once the write succeeded
+func writeStream(path string, send func(w io.Writer) error) (size int64, checksum string, err error) {
+	f, err := os.OpenFile(path+tempFileExtension, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return 0, "", fmt.Errorf("error creating stream file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(path + tempFileExtension)
+		}
+	}()
+
+	hash := sha256.New()
+	counter := &countWriter{}
+	err = send(io.MultiWriter(f, hash, counter))
+	if err != nil {
+		return 0, "", fmt.Errorf("error sending stream: %w", err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return 0, "", fmt.Errorf("error syncing stream file: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return 0, "", fmt.Errorf("error closing stream file: %w", err)
+	}
+	err = os.Rename(path+tempFileExtension, path)
+	if err != nil {
+		return 0, "", fmt.Errorf("error moving stream file: %w", err)
+	}
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// VerifyStream checks the size and checksum of a stream file against the manifest
+func (a *Archive) VerifyStream(stream Stream) error {
+	f, err := os.Open(filepath.Join(a.dir, stream.File))
+	if err != nil {
+		return fmt.Errorf("error opening stream file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return fmt.Errorf("error reading stream file: %w", err)
+	}
+	if size != stream.Size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrChecksumMismatch, stream.File, size, stream.Size)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != stream.Checksum {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, stream.File)
+	}
+	return nil
+}
+
+// Verify checks the size and checksum of all stream files in the archive
+func (a *Archive) Verify() error {
+	for _, stream := range a.manifest.Streams {
+		err := a.VerifyStream(stream)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
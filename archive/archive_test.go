@@ -0,0 +1,144 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+const testZPool = "go-test-zpool-archive"
+
+func TestArchive_CreateOpen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	a, err := Create(dir, "pool/fs")
+	require.NoError(t, err)
+	require.Equal(t, dir, a.Dir())
+
+	_, err = Create(dir, "pool/fs")
+	require.ErrorIs(t, err, ErrManifestExists)
+
+	opened, err := Open(dir)
+	require.NoError(t, err)
+	require.Equal(t, "pool/fs", opened.Manifest().Dataset)
+	require.Empty(t, opened.Manifest().Streams)
+}
+
+func TestArchive_Verify(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Create(dir, "pool/fs")
+	require.NoError(t, err)
+
+	size, checksum, err := writeStream(filepath.Join(dir, "0000-snap.zstream"), func(w io.Writer) error {
+		_, err := w.Write([]byte("stream data"))
+		return err
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 11, size)
+
+	stream := Stream{File: "0000-snap.zstream", Size: size, Checksum: checksum}
+	require.NoError(t, a.VerifyStream(stream))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, stream.File), []byte("stream dat4"), 0o600))
+	require.ErrorIs(t, a.VerifyStream(stream), ErrChecksumMismatch)
+}
+
+func TestArchive_restoreStart(t *testing.T) {
+	chain := []Stream{
+		{File: "0", GUID: 1},
+		{File: "1", GUID: 2, BaseGUID: 1},
+		{File: "2", GUID: 3},
+		{File: "3", GUID: 4, BaseGUID: 3},
+		{File: "4", GUID: 5, BaseGUID: 4},
+	}
+
+	start, err := restoreStart(chain, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, start, "should start at the last full stream")
+
+	start, err = restoreStart(chain, map[uint64]bool{3: true, 99: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, start)
+
+	start, err = restoreStart(chain, map[uint64]bool{5: true})
+	require.NoError(t, err)
+	require.Equal(t, 5, start, "nothing to restore")
+
+	_, err = restoreStart(chain, map[uint64]bool{2: true})
+	require.ErrorIs(t, err, ErrBrokenChain, "a full stream cannot be applied to an existing target")
+
+	_, err = restoreStart(chain, map[uint64]bool{99: true})
+	require.ErrorIs(t, err, ErrBrokenChain)
+
+	_, err = restoreStart(chain[3:], nil)
+	require.ErrorIs(t, err, ErrBrokenChain)
+
+	_, err = restoreStart(nil, nil)
+	require.ErrorIs(t, err, ErrNoStreams)
+}
+
+func TestArchive_WriteRestore(t *testing.T) {
+	zfs.TestZPool(testZPool, func() {
+		ctx := context.Background()
+		const fsName = testZPool + "/source"
+		fs, err := zfs.CreateFilesystem(ctx, fsName, zfs.CreateFilesystemOptions{
+			Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+
+		snap1, err := fs.Snapshot(ctx, "snap1", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+		snap2, err := fs.Snapshot(ctx, "snap2", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		key, err := zfs.GenerateStreamKey()
+		require.NoError(t, err)
+
+		a, err := Create(t.TempDir(), fsName)
+		require.NoError(t, err)
+
+		_, err = a.Write(ctx, snap1, WriteOptions{Incremental: true})
+		require.ErrorIs(t, err, ErrNoStreams)
+
+		stream1, err := a.Write(ctx, snap1, WriteOptions{
+			Raw:           true,
+			Compression:   zfs.CompressionOptions{Codec: zfs.CodecZstd},
+			EncryptionKey: key,
+		})
+		require.NoError(t, err)
+		require.False(t, stream1.Incremental())
+		require.NotEmpty(t, stream1.KeyID)
+
+		stream2, err := a.Write(ctx, snap2, WriteOptions{
+			Incremental: true,
+			Raw:         true,
+			Compression: zfs.CompressionOptions{Codec: zfs.CodecLZ4},
+		})
+		require.NoError(t, err)
+		require.Equal(t, stream1.GUID, stream2.BaseGUID)
+
+		a, err = Open(a.Dir())
+		require.NoError(t, err)
+		require.NoError(t, a.Verify())
+		require.Len(t, a.Manifest().Streams, 2)
+
+		const restoreName = testZPool + "/restored"
+		snaps, err := a.Restore(ctx, restoreName, RestoreOptions{
+			DecryptionKeys: []zfs.StreamKey{key},
+			Properties:     map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+		require.Len(t, snaps, 2)
+		require.Equal(t, restoreName+"@snap1", snaps[0].Name)
+		require.Equal(t, restoreName+"@snap2", snaps[1].Name)
+
+		snaps, err = a.Restore(ctx, restoreName, RestoreOptions{})
+		require.NoError(t, err)
+		require.Empty(t, snaps, "target is up to date")
+	})
+}
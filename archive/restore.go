@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+// RestoreOptions are options you can specify to customize restoring an archive
+type RestoreOptions struct {
+	// DecryptionKeys are the keys to decrypt encrypted stream files with
+	DecryptionKeys []zfs.StreamKey
+	// Properties are applied to the restored dataset
+	Properties map[string]string
+	// ForceRollback rolls the target back to its most recent snapshot before every receive
+	ForceRollback bool
+	// StreamFn, when set, is called after every restored stream
+	StreamFn func(stream Stream, snapshot *zfs.Dataset)
+}
+
+// Restore receives the streams of the archive into the target filesystem. When the target does not exist, the
+// restore starts at the last full stream. Otherwise it continues after the latest archived snapshot that the
+// target already has. Every stream file is verified before it is received. The received snapshots are returned.
+func (a *Archive) Restore(ctx context.Context, target string, options RestoreOptions) ([]*zfs.Dataset, error) {
+	targetGUIDs, err := snapshotGUIDs(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	start, err := restoreStart(a.manifest.Streams, targetGUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*zfs.Dataset, 0, len(a.manifest.Streams)-start)
+	for i := start; i < len(a.manifest.Streams); i++ {
+		stream := a.manifest.Streams[i]
+		snapshot, err := a.restoreStream(ctx, target, stream, options, i == start && !stream.Incremental())
+		if err != nil {
+			return snapshots, fmt.Errorf("error restoring %s: %w", stream.File, err)
+		}
+		snapshots = append(snapshots, snapshot)
+		if options.StreamFn != nil {
+			options.StreamFn(stream, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+func (a *Archive) restoreStream(ctx context.Context, target string, stream Stream, options RestoreOptions,
+	full bool) (*zfs.Dataset, error) {
+	err := a.VerifyStream(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(a.dir, stream.File))
+	if err != nil {
+		return nil, fmt.Errorf("error opening stream file: %w", err)
+	}
+	defer f.Close()
+
+	receiveOptions := zfs.ReceiveOptions{
+		Decompression: zfs.CompressionOptions{Codec: stream.Codec},
+		ForceRollback: options.ForceRollback,
+	}
+	if full {
+		receiveOptions.Properties = options.Properties
+	}
+	if stream.KeyID != "" {
+		receiveOptions.DecryptionKeys = options.DecryptionKeys
+		if len(options.DecryptionKeys) == 0 {
+			return nil, fmt.Errorf("%w: stream is encrypted with key id %s", zfs.ErrUnknownStreamKey, stream.KeyID)
+		}
+	}
+
+	_, snapName, _ := strings.Cut(stream.Snapshot, "@")
+	return zfs.ReceiveSnapshot(ctx, f, target+"@"+snapName, receiveOptions)
+}
+
+// snapshotGUIDs returns the guids of the snapshots of the target, or nil when the target does not exist
+func snapshotGUIDs(ctx context.Context, target string) (map[uint64]bool, error) {
+	snaps, err := zfs.ListSnapshots(ctx, zfs.ListOptions{
+		ParentDataset:   target,
+		ExtraProperties: []string{zfs.PropertyGUID},
+		Depth:           1,
+	})
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("error listing target snapshots: %w", err)
+	}
+
+	guids := make(map[uint64]bool, len(snaps))
+	for _, snap := range snaps {
+		guid, err := strconv.ParseUint(snap.ExtraProps[zfs.PropertyGUID], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing guid of %s: %w", snap.Name, err)
+		}
+		guids[guid] = true
+	}
+	return guids, nil
+}
+
+// restoreStart determines the index of the first stream to restore, given the snapshot guids of the target.
+// A nil guid map means the target does not exist yet.
+func restoreStart(streams []Stream, targetGUIDs map[uint64]bool) (int, error) {
+	if len(streams) == 0 {
+		return 0, ErrNoStreams
+	}
+
+	start := -1
+	for i := len(streams) - 1; i >= 0; i-- {
+		if targetGUIDs == nil && !streams[i].Incremental() {
+			start = i
+			break
+		}
+		if targetGUIDs != nil && targetGUIDs[streams[i].GUID] {
+			// Continue after the snapshot the target already has, the next stream must be based on it
+			start = i + 1
+			if start < len(streams) && streams[start].BaseGUID != streams[i].GUID {
+				return 0, fmt.Errorf("%w: %s is not based on the snapshot of the target", ErrBrokenChain, streams[start].File)
+			}
+			break
+		}
+	}
+	switch {
+	case start < 0 && targetGUIDs == nil:
+		return 0, fmt.Errorf("%w: no full stream to start from", ErrBrokenChain)
+	case start < 0:
+		return 0, fmt.Errorf("%w: target has none of the archived snapshots", ErrBrokenChain)
+	}
+
+	for i := start + 1; i < len(streams); i++ {
+		if streams[i].BaseGUID != streams[i-1].GUID {
+			return 0, fmt.Errorf("%w: %s is not based on %s", ErrBrokenChain, streams[i].File, streams[i-1].File)
+		}
+	}
+	return start, nil
+}
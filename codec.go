@@ -0,0 +1,183 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec is a compression codec for send streams
+type Codec string
+
+const (
+	// CodecNone disables compression
+	CodecNone Codec = "none"
+	// CodecZstd compresses using zstd, it has the best compression ratio
+	CodecZstd Codec = "zstd"
+	// CodecLZ4 compresses using lz4, it uses the least cpu and is best suited for fast networks
+	CodecLZ4 Codec = "lz4"
+	// CodecGzip compresses using gzip, for compatibility with other tooling
+	CodecGzip Codec = "gzip"
+	// CodecAuto lets the http client negotiate the best codec the server supports.
+	// It cannot be used directly for sending or receiving.
+	CodecAuto Codec = "auto"
+)
+
+// SupportedCodecs lists the compression codecs that can be used, in order of preference
+var SupportedCodecs = []Codec{CodecZstd, CodecLZ4, CodecGzip}
+
+// ErrUnsupportedCodec is returned when an unknown compression codec is used
+var ErrUnsupportedCodec = errors.New("unsupported compression codec")
+
+// ParseCodec parses the name of a codec, an empty name is parsed as CodecNone
+func ParseCodec(name string) (Codec, error) {
+	codec := Codec(strings.ToLower(strings.TrimSpace(name)))
+	switch codec {
+	case "", CodecNone:
+		return CodecNone, nil
+	case CodecZstd, CodecLZ4, CodecGzip:
+		return codec, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedCodec, name)
+}
+
+// CompressionOptions configures the compression codec of a stream
+type CompressionOptions struct {
+	// Codec is the compression codec to use, empty or CodecNone for no compression
+	Codec Codec
+	// Level is the codec specific compression level, zero uses the codec default.
+	// For zstd this is the zstd command line level (1-22), for gzip and lz4 it ranges from 1 to 9.
+	Level int
+	// ZstdDictionary is a zstd dictionary to compress or decompress with, both sides need the same dictionary
+	ZstdDictionary []byte
+	// ZstdWindowSize is the zstd window size in bytes, it must be a power of two. Zero uses the default.
+	// When decompressing it is the maximum window size that is accepted.
+	ZstdWindowSize int
+}
+
+// Enabled returns whether compression is configured
+func (o CompressionOptions) Enabled() bool {
+	return o.Codec != "" && o.Codec != CodecNone
+}
+
+// legacyCompression converts the zstd encoder level used by older options into CompressionOptions.
+// The options take precedence when their codec is set.
+func legacyCompression(level zstd.EncoderLevel, options CompressionOptions) CompressionOptions {
+	if options.Codec != "" || level <= 0 {
+		return options
+	}
+	options.Codec = CodecZstd
+	switch level {
+	case zstd.SpeedFastest:
+		options.Level = 1
+	case zstd.SpeedBetterCompression:
+		options.Level = 7
+	case zstd.SpeedBestCompression:
+		options.Level = 11
+	default:
+		options.Level = 3
+	}
+	return options
+}
+
+// compressWriter wraps the writer with the configured compression. The returned close function flushes
+// the compressor and returns its error, it does not close the underlying writer.
+func compressWriter(writer io.Writer, options CompressionOptions) (io.Writer, func() error, error) {
+	var (
+		encoder io.WriteCloser
+		err     error
+	)
+	switch options.Codec {
+	case "", CodecNone:
+		return writer, func() error { return nil }, nil
+	case CodecZstd:
+		encoder, err = zstdEncoder(writer, options)
+	case CodecLZ4:
+		encoder, err = lz4Encoder(writer, options)
+	case CodecGzip:
+		level := gzip.DefaultCompression
+		if options.Level > 0 {
+			level = options.Level
+		}
+		encoder, err = gzip.NewWriterLevel(writer, level)
+	default:
+		return writer, func() error { return nil }, fmt.Errorf("%w: %s", ErrUnsupportedCodec, options.Codec)
+	}
+	if err != nil {
+		return writer, func() error { return nil }, fmt.Errorf("error creating %s encoder: %w", options.Codec, err)
+	}
+
+	return encoder, func() error {
+		err := encoder.Close()
+		if err != nil {
+			return fmt.Errorf("error closing %s encoder: %w", options.Codec, err)
+		}
+		return nil
+	}, nil
+}
+
+func zstdEncoder(writer io.Writer, options CompressionOptions) (io.WriteCloser, error) {
+	opts := make([]zstd.EOption, 0, 3)
+	if options.Level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.Level)))
+	}
+	if len(options.ZstdDictionary) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(options.ZstdDictionary))
+	}
+	if options.ZstdWindowSize > 0 {
+		opts = append(opts, zstd.WithWindowSize(options.ZstdWindowSize))
+	}
+	return zstd.NewWriter(writer, opts...)
+}
+
+func lz4Encoder(writer io.Writer, options CompressionOptions) (io.WriteCloser, error) {
+	encoder := lz4.NewWriter(writer)
+	if options.Level <= 0 {
+		return encoder, nil
+	}
+
+	levels := []lz4.CompressionLevel{
+		lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+	}
+	err := encoder.Apply(lz4.CompressionLevelOption(levels[min(options.Level, len(levels))-1]))
+	if err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
+
+// decompressReader wraps the reader with the configured decompression.
+// The returned close function releases the resources of the decompressor.
+func decompressReader(reader io.Reader, options CompressionOptions) (io.Reader, func(), error) {
+	switch options.Codec {
+	case "", CodecNone:
+		return reader, func() {}, nil
+	case CodecZstd:
+		opts := make([]zstd.DOption, 0, 2)
+		if len(options.ZstdDictionary) > 0 {
+			opts = append(opts, zstd.WithDecoderDicts(options.ZstdDictionary))
+		}
+		if options.ZstdWindowSize > 0 {
+			opts = append(opts, zstd.WithDecoderMaxWindow(uint64(options.ZstdWindowSize)))
+		}
+		decoder, err := zstd.NewReader(reader, opts...)
+		if err != nil {
+			return reader, func() {}, fmt.Errorf("error creating zstd reader: %w", err)
+		}
+		return decoder, decoder.Close, nil
+	case CodecLZ4:
+		return lz4.NewReader(reader), func() {}, nil
+	case CodecGzip:
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			return reader, func() {}, fmt.Errorf("error creating gzip reader: %w", err)
+		}
+		return decoder, func() { _ = decoder.Close() }, nil
+	}
+	return reader, func() {}, fmt.Errorf("%w: %s", ErrUnsupportedCodec, options.Codec)
+}
@@ -0,0 +1,95 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("zfs send stream data "), 50000)
+
+	for _, options := range []CompressionOptions{
+		{},
+		{Codec: CodecNone},
+		{Codec: CodecZstd},
+		{Codec: CodecZstd, Level: 19, ZstdWindowSize: 1 << 20},
+		{Codec: CodecLZ4},
+		{Codec: CodecLZ4, Level: 9},
+		{Codec: CodecGzip},
+		{Codec: CodecGzip, Level: 1},
+	} {
+		buf := &bytes.Buffer{}
+		w, closer, err := compressWriter(buf, options)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, closer())
+
+		if options.Enabled() {
+			require.Less(t, buf.Len(), len(data), "codec %s", options.Codec)
+		}
+
+		r, release, err := decompressReader(buf, options)
+		require.NoError(t, err)
+		out, err := io.ReadAll(r)
+		release()
+		require.NoError(t, err)
+		require.Equal(t, data, out, "codec %s", options.Codec)
+	}
+}
+
+func TestCodec_Unsupported(t *testing.T) {
+	_, err := ParseCodec("brotli")
+	require.ErrorIs(t, err, ErrUnsupportedCodec)
+
+	_, _, err = compressWriter(io.Discard, CompressionOptions{Codec: CodecAuto})
+	require.ErrorIs(t, err, ErrUnsupportedCodec)
+
+	_, _, err = decompressReader(bytes.NewReader(nil), CompressionOptions{Codec: "brotli"})
+	require.ErrorIs(t, err, ErrUnsupportedCodec)
+}
+
+func TestCodec_ParseCodec(t *testing.T) {
+	codec, err := ParseCodec(" LZ4 ")
+	require.NoError(t, err)
+	require.Equal(t, CodecLZ4, codec)
+
+	codec, err = ParseCodec("")
+	require.NoError(t, err)
+	require.Equal(t, CodecNone, codec)
+}
+
+func TestCodec_LegacyCompression(t *testing.T) {
+	require.Equal(t, CompressionOptions{}, legacyCompression(0, CompressionOptions{}))
+	require.Equal(t, CompressionOptions{Codec: CodecZstd, Level: 7}, legacyCompression(zstd.SpeedBetterCompression, CompressionOptions{}))
+	require.Equal(t, CompressionOptions{Codec: CodecLZ4}, legacyCompression(zstd.SpeedFastest, CompressionOptions{Codec: CodecLZ4}))
+	require.Equal(t, CompressionOptions{Codec: CodecNone}, legacyCompression(zstd.SpeedFastest, CompressionOptions{Codec: CodecNone}))
+}
+
+// failingWriter fails all writes after the first one
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestSendWriter_CompressorError(t *testing.T) {
+	// The compressor writes the buffered data when it is closed, its error fails the send
+	w, finish, err := sendWriter(context.Background(), &failingWriter{}, 0, false, nil, CompressionOptions{Codec: CodecLZ4})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("stream"))
+	require.NoError(t, err)
+	require.ErrorContains(t, finish(nil), "disk full")
+}
@@ -33,6 +33,7 @@ type Dataset struct {
 	Compression   string            `json:"Compression"`
 	Written       uint64            `json:"Written"`
 	Volsize       uint64            `json:"Volsize"`
+	Volblocksize  uint64            `json:"Volblocksize"`
 	Logicalused   uint64            `json:"Logicalused"`
 	Usedbydataset uint64            `json:"Usedbydataset"`
 	Quota         uint64            `json:"Quota"`
@@ -99,6 +100,8 @@ func readDatasets(output [][]string, extraProps []string) ([]Dataset, error) {
 			ds.Written, setError = setUint(val)
 		case PropertyVolSize:
 			ds.Volsize, setError = setUint(val)
+		case PropertyVolBlockSize:
+			ds.Volblocksize, setError = setUint(val)
 		case PropertyLogicalUsed:
 			ds.Logicalused, setError = setUint(val)
 		case PropertyUsedByDataset:
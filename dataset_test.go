@@ -32,6 +32,21 @@ func Test_readDatasets(t *testing.T) {
 	}
 }
 
+func Test_readDatasetsVolume(t *testing.T) {
+	in := splitOutput(testVolumeInput)
+
+	ds, err := readDatasets(in, []string{"nl.test:hiephoi"})
+	require.NoError(t, err)
+	require.Len(t, ds, 1)
+	require.Equal(t, "testpool/vol0", ds[0].Name)
+	require.Equal(t, DatasetVolume, ds[0].Type)
+	require.EqualValues(t, 1073741824, ds[0].Volsize)
+	require.EqualValues(t, 16384, ds[0].Volblocksize)
+	require.Empty(t, ds[0].Mountpoint)
+	require.False(t, ds[0].Mounted)
+	require.Equal(t, "42", ds[0].ExtraProps["nl.test:hiephoi"])
+}
+
 const testInput = `testpool/ds0	name	testpool/ds0
 testpool/ds0	type	filesystem
 testpool/ds0	origin	-
@@ -41,6 +56,7 @@ testpool/ds0	mounted	yes
 testpool/ds0	mountpoint	none
 testpool/ds0	compression	off
 testpool/ds0	volsize	-
+testpool/ds0	volblocksize	-
 testpool/ds0	quota	0
 testpool/ds0	refquota	0
 testpool/ds0	referenced	196416
@@ -58,6 +74,7 @@ testpool/ds1	mounted	yes
 testpool/ds1	mountpoint	none
 testpool/ds1	compression	off
 testpool/ds1	volsize	-
+testpool/ds1	volblocksize	-
 testpool/ds1	quota	0
 testpool/ds1	refquota	0
 testpool/ds1	referenced	196416
@@ -75,6 +92,7 @@ testpool/ds10	mounted	no
 testpool/ds10	mountpoint	none
 testpool/ds10	compression	off
 testpool/ds10	volsize	-
+testpool/ds10	volblocksize	-
 testpool/ds10	quota	0
 testpool/ds10	refquota	0
 testpool/ds10	referenced	196416
@@ -84,3 +102,22 @@ testpool/ds10	usedbydataset	196416
 testpool/ds10	nl.test:hiephoi	42
 testpool/ds10	nl.test:eigenschap	ja
 `
+
+const testVolumeInput = `testpool/vol0	name	testpool/vol0
+testpool/vol0	type	volume
+testpool/vol0	origin	-
+testpool/vol0	used	1094713344
+testpool/vol0	available	186368146928528
+testpool/vol0	mounted	-
+testpool/vol0	mountpoint	-
+testpool/vol0	compression	off
+testpool/vol0	volsize	1073741824
+testpool/vol0	volblocksize	16384
+testpool/vol0	quota	-
+testpool/vol0	refquota	-
+testpool/vol0	referenced	57344
+testpool/vol0	written	57344
+testpool/vol0	logicalused	28672
+testpool/vol0	usedbydataset	57344
+testpool/vol0	nl.test:hiephoi	42
+`
@@ -0,0 +1,338 @@
+package zfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The stream encryption format encrypts a stream with AES-256-GCM in chunks, so it can pass through or be stored
+// by hops that cannot read it. The format is:
+//
+//	magic    [4]byte  "ZEC1"
+//	key id   [8]byte  see StreamKey.ID
+//	nonce    [7]byte  random prefix for the chunk nonces
+//	chunks   length uint32 (big endian), sealed chunk [length]byte
+//
+// Every chunk holds up to EncryptionChunkSize bytes of data. The nonce of a chunk consists of the random prefix,
+// the chunk index (uint32 big endian) and a byte that is one for the last chunk only. This way reordered, dropped or
+// truncated chunks fail to decrypt. The header is authenticated as additional data of every chunk.
+const (
+	// EncryptionChunkSize is the maximum amount of data in a single encrypted chunk
+	EncryptionChunkSize = 64 * 1024
+	// StreamKeySize is the size of a StreamKey in bytes
+	StreamKeySize = 32
+
+	encryptMagic       = "ZEC1"
+	encryptKeyIDSize   = 8
+	encryptPrefixSize  = 7
+	encryptHeaderSize  = len(encryptMagic) + encryptKeyIDSize + encryptPrefixSize
+	encryptLengthSize  = 4
+	encryptMaxSealSize = EncryptionChunkSize + 16
+)
+
+var (
+	// ErrInvalidStreamKey is returned when a stream key does not have the right size
+	ErrInvalidStreamKey = errors.New("invalid stream key")
+
+	// ErrUnknownStreamKey is returned when an encrypted stream uses a key that is not available
+	ErrUnknownStreamKey = errors.New("unknown stream key")
+
+	// ErrStreamDecryption is returned when an encrypted stream cannot be decrypted or fails authentication
+	ErrStreamDecryption = errors.New("stream decryption failed")
+)
+
+// StreamKey is an AES-256 key for stream encryption. In configuration files it is written as hex.
+type StreamKey []byte
+
+// GenerateStreamKey creates a new random stream key
+func GenerateStreamKey() (StreamKey, error) {
+	key := make(StreamKey, StreamKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ID identifies the key without revealing it, it is the start of the sha256 hash of the key
+func (k StreamKey) ID() []byte {
+	sum := sha256.Sum256(k)
+	return sum[:encryptKeyIDSize]
+}
+
+// Validate returns an error when the key does not have the right size
+func (k StreamKey) Validate() error {
+	if len(k) != StreamKeySize {
+		return fmt.Errorf("%w: key is %d bytes, expected %d", ErrInvalidStreamKey, len(k), StreamKeySize)
+	}
+	return nil
+}
+
+// MarshalText encodes the key as hex
+func (k StreamKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(k)), nil
+}
+
+// UnmarshalText decodes a hex encoded key
+func (k *StreamKey) UnmarshalText(text []byte) error {
+	key, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidStreamKey, err)
+	}
+	if len(key) == 0 {
+		*k = nil
+		return nil
+	}
+	err = StreamKey(key).Validate()
+	if err != nil {
+		return err
+	}
+	*k = key
+	return nil
+}
+
+func (k StreamKey) aead() (cipher.AEAD, error) {
+	err := k.Validate()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, encryptPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], index)
+	if last {
+		nonce[encryptPrefixSize+4] = 1
+	}
+	return nonce
+}
+
+// NewEncryptWriter creates a new EncryptWriter writing to the given writer
+func NewEncryptWriter(w io.Writer, key StreamKey) (*EncryptWriter, error) {
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptHeaderSize)
+	header = append(header, encryptMagic...)
+	header = append(header, key.ID()...)
+	header = header[:encryptHeaderSize]
+	_, err = rand.Read(header[len(encryptMagic)+encryptKeyIDSize:])
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	return &EncryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, EncryptionChunkSize),
+	}, nil
+}
+
+// EncryptWriter writes data in the stream encryption format.
+// Close must be called to write the last chunk, it does not close the underlying writer.
+type EncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	index   uint32
+	started bool
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, as the last chunk is sealed differently
+		if len(e.buf) == EncryptionChunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):EncryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *EncryptWriter) seal(last bool) error {
+	if !e.started {
+		e.started = true
+		_, err := e.w.Write(e.header)
+		if err != nil {
+			return err
+		}
+	}
+	if e.index == ^uint32(0) {
+		return fmt.Errorf("stream exceeds maximum of %d chunks", e.index)
+	}
+
+	prefix := e.header[len(encryptMagic)+encryptKeyIDSize:]
+	chunk := make([]byte, encryptLengthSize, encryptLengthSize+len(e.buf)+e.aead.Overhead())
+	chunk = e.aead.Seal(chunk, encryptNonce(prefix, e.index, last), e.buf, e.header)
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk)-encryptLengthSize))
+
+	_, err := e.w.Write(chunk)
+	if err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Close seals and writes the last chunk
+func (e *EncryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// NewDecryptReader creates a new DecryptReader reading from the given reader.
+// The key the stream was encrypted with is picked from the given keys.
+func NewDecryptReader(r io.Reader, keys ...StreamKey) *DecryptReader {
+	return &DecryptReader{
+		r:    r,
+		keys: keys,
+	}
+}
+
+// DecryptReader reads and decrypts data in the stream encryption format.
+// Data of a chunk is only returned after it has been authenticated.
+type DecryptReader struct {
+	r      io.Reader
+	keys   []StreamKey
+	aead   cipher.AEAD
+	header []byte
+	sealed []byte
+	plain  []byte
+	buf    []byte
+	index  uint32
+	last   bool
+	err    error
+}
+
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Err returns the decryption error encountered, if any
+func (d *DecryptReader) Err() error {
+	if errors.Is(d.err, io.EOF) {
+		return nil
+	}
+	return d.err
+}
+
+func (d *DecryptReader) readFull(p []byte) error {
+	_, err := io.ReadFull(d.r, p)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: %w after %d chunks", ErrStreamDecryption, ErrStreamTruncated, d.index)
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+func (d *DecryptReader) readHeader() error {
+	d.header = make([]byte, encryptHeaderSize)
+	err := d.readFull(d.header)
+	if err != nil {
+		return err
+	}
+	if string(d.header[:len(encryptMagic)]) != encryptMagic {
+		return fmt.Errorf("%w: invalid magic %q", ErrStreamDecryption, d.header[:len(encryptMagic)])
+	}
+
+	keyID := d.header[len(encryptMagic) : len(encryptMagic)+encryptKeyIDSize]
+	for _, key := range d.keys {
+		if string(key.ID()) != string(keyID) {
+			continue
+		}
+		d.aead, err = key.aead()
+		return err
+	}
+	return fmt.Errorf("%w: key id %x", ErrUnknownStreamKey, keyID)
+}
+
+func (d *DecryptReader) next() error {
+	if d.aead == nil {
+		err := d.readHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.last {
+		// Nothing may follow the last chunk
+		n, err := d.r.Read(make([]byte, 1))
+		if n > 0 || (err != nil && !errors.Is(err, io.EOF)) {
+			return fmt.Errorf("%w: data after last chunk", ErrStreamDecryption)
+		}
+		if err == nil {
+			return nil
+		}
+		return io.EOF
+	}
+
+	hdr := make([]byte, encryptLengthSize)
+	err := d.readFull(hdr)
+	if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(hdr)
+	if length > encryptMaxSealSize {
+		return fmt.Errorf("%w: chunk length %d exceeds maximum", ErrStreamDecryption, length)
+	}
+
+	if d.sealed == nil {
+		d.sealed = make([]byte, encryptMaxSealSize)
+		d.plain = make([]byte, EncryptionChunkSize)
+	}
+	sealed := d.sealed[:length]
+	err = d.readFull(sealed)
+	if err != nil {
+		return err
+	}
+
+	prefix := d.header[len(encryptMagic)+encryptKeyIDSize:]
+	data, err := d.aead.Open(d.plain[:0], encryptNonce(prefix, d.index, false), sealed, d.header)
+	if err != nil {
+		// The last chunk is sealed with a different nonce
+		data, err = d.aead.Open(d.plain[:0], encryptNonce(prefix, d.index, true), sealed, d.header)
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d failed authentication", ErrStreamDecryption, d.index)
+		}
+		d.last = true
+	}
+	d.index++
+	d.buf = data
+	return nil
+}
@@ -0,0 +1,130 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encryptTestData(t *testing.T, key StreamKey, size int) (data, encrypted []byte) {
+	t.Helper()
+
+	data = make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w, err := NewEncryptWriter(buf, key)
+	require.NoError(t, err)
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 10000)
+		_, err = w.Write(rest[:n])
+		require.NoError(t, err)
+		rest = rest[n:]
+	}
+	require.NoError(t, w.Close())
+	return data, buf.Bytes()
+}
+
+func testStreamKey(t *testing.T) StreamKey {
+	t.Helper()
+	key, err := GenerateStreamKey()
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncrypt_RoundTrip(t *testing.T) {
+	key := testStreamKey(t)
+	for _, size := range []int{0, 1, EncryptionChunkSize, 3*EncryptionChunkSize + 5} {
+		data, encrypted := encryptTestData(t, key, size)
+		if size >= 64 {
+			require.False(t, bytes.Contains(encrypted, data[:64]))
+		}
+
+		r := NewDecryptReader(bytes.NewReader(encrypted), testStreamKey(t), key)
+		out, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+		require.NoError(t, r.Err())
+	}
+}
+
+func TestEncrypt_UnknownKey(t *testing.T) {
+	_, encrypted := encryptTestData(t, testStreamKey(t), 100)
+
+	_, err := io.ReadAll(NewDecryptReader(bytes.NewReader(encrypted), testStreamKey(t)))
+	require.ErrorIs(t, err, ErrUnknownStreamKey)
+}
+
+func TestEncrypt_Tampered(t *testing.T) {
+	key := testStreamKey(t)
+	_, encrypted := encryptTestData(t, key, 2*EncryptionChunkSize)
+
+	encrypted[len(encrypted)-100] ^= 0x01
+
+	r := NewDecryptReader(bytes.NewReader(encrypted), key)
+	out, err := io.ReadAll(r)
+	require.ErrorIs(t, err, ErrStreamDecryption)
+	require.Len(t, out, EncryptionChunkSize, "only the authenticated first chunk should be returned")
+}
+
+func TestEncrypt_Truncated(t *testing.T) {
+	key := testStreamKey(t)
+	_, encrypted := encryptTestData(t, key, 2*EncryptionChunkSize+5)
+
+	// Drop the last chunk entirely, leaving a stream that ends on a chunk boundary
+	lastChunk := encryptLengthSize + 5 + 16
+	_, err := io.ReadAll(NewDecryptReader(bytes.NewReader(encrypted[:len(encrypted)-lastChunk]), key))
+	require.ErrorIs(t, err, ErrStreamTruncated)
+
+	_, err = io.ReadAll(NewDecryptReader(bytes.NewReader(encrypted[:len(encrypted)-1]), key))
+	require.ErrorIs(t, err, ErrStreamTruncated)
+}
+
+func TestEncrypt_TrailingData(t *testing.T) {
+	key := testStreamKey(t)
+	_, encrypted := encryptTestData(t, key, 100)
+
+	_, err := io.ReadAll(NewDecryptReader(bytes.NewReader(append(encrypted, 0)), key))
+	require.ErrorIs(t, err, ErrStreamDecryption)
+}
+
+func TestEncrypt_StreamKeyJSON(t *testing.T) {
+	key := testStreamKey(t)
+	data, err := json.Marshal(struct{ Key StreamKey }{key})
+	require.NoError(t, err)
+
+	var decoded struct{ Key StreamKey }
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, key, decoded.Key)
+
+	err = json.Unmarshal([]byte(`{"Key":"abcd"}`), &decoded)
+	require.ErrorIs(t, err, ErrInvalidStreamKey)
+}
+
+func TestSendWriter_Chain(t *testing.T) {
+	key := testStreamKey(t)
+	data := bytes.Repeat([]byte("stream "), 100000)
+
+	buf := &bytes.Buffer{}
+	w, finish, err := sendWriter(context.Background(), buf, 0, true, key, CompressionOptions{Codec: CodecLZ4})
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, finish(nil))
+
+	var r io.Reader = NewFrameReader(buf)
+	r = NewDecryptReader(r, key)
+	r, closer, err := decompressReader(r, CompressionOptions{Codec: CodecLZ4})
+	require.NoError(t, err)
+	defer closer()
+
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+}
@@ -20,6 +20,7 @@ const (
 	datasetExistsMessage         = "dataset already exists"
 	destinationExistsMessage1    = "destination '"
 	destinationExistsMessage2    = "' exists"
+	moreRecentSnapshotsMessage   = "more recent snapshots or bookmarks exist"
 )
 
 var (
@@ -52,6 +53,9 @@ var (
 
 	// ErrFilesystemAlreadyMounted is returned when mounting an already mounted filesystem
 	ErrFilesystemAlreadyMounted = errors.New("filesystem already mounted")
+
+	// ErrMoreRecentSnapshotsExist is returned when rolling back to a snapshot that is not the most recent one
+	ErrMoreRecentSnapshotsExist = errors.New("more recent snapshots exist")
 )
 
 // CommandError is an error which is returned when the `zfs` or `zpool` shell
@@ -95,6 +99,8 @@ func createError(cmd *exec.Cmd, stderr string, err error) error {
 		return fmt.Errorf("%s: %w", stderr, ErrKeyAlreadyUnloaded)
 	case strings.Contains(stderr, filesystemAlreadyMounted):
 		return fmt.Errorf("%s: %w", stderr, ErrFilesystemAlreadyMounted)
+	case strings.Contains(stderr, moreRecentSnapshotsMessage):
+		return fmt.Errorf("%s: %w", stderr, ErrMoreRecentSnapshotsExist)
 	case strings.Contains(stderr, resumableErrorMessage):
 		return &ResumableStreamError{
 			CommandError: CommandError{
@@ -49,3 +49,16 @@ func Test_createError(t *testing.T) {
 		t.Fatalf("unexpected error type: %v", err)
 	}
 }
+
+func Test_createErrorMoreRecentSnapshots(t *testing.T) {
+	err := createError(
+		&exec.Cmd{},
+		"cannot rollback to 'pool/fs@snap1': more recent snapshots or bookmarks exist\n"+
+			"use '-r' to force deletion of the following snapshots and bookmarks:\npool/fs@snap2",
+		errors.New("test"),
+	)
+
+	if !errors.Is(err, ErrMoreRecentSnapshotsExist) {
+		t.Fatalf("unexpected error type: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package zfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The framed transport format wraps a stream in checksummed blocks, so corruption and truncation
+// can be detected by the receiving side before the data reaches zfs receive. The format is:
+//
+//	magic    [4]byte  "ZFR1"
+//	blocks   length uint32 (big endian, 1..FrameSize), sha256 [32]byte, data [length]byte
+//	trailer  length uint32 (zero), total bytes uint64 (big endian)
+const (
+	// FrameSize is the maximum amount of data in a single frame
+	FrameSize = 1024 * 1024
+
+	frameMagic         = "ZFR1"
+	frameChecksumSize  = sha256.Size
+	frameLengthSize    = 4
+	frameTrailerLength = 8
+)
+
+var (
+	// ErrStreamCorrupted is returned when a framed stream fails checksum verification
+	ErrStreamCorrupted = errors.New("stream corrupted")
+
+	// ErrStreamTruncated is returned when a framed stream ends before its trailer
+	ErrStreamTruncated = errors.New("stream truncated")
+)
+
+// FrameError is returned when a framed stream fails verification.
+// It contains the offset of the unframed data at which the problem was detected.
+type FrameError struct {
+	Err    error
+	Offset int64
+}
+
+// Error returns the string representation of a FrameError
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Err, e.Offset)
+}
+
+// Unwrap returns the underlying error
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// NewFrameWriter creates a new FrameWriter writing to the given writer
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		w:   w,
+		buf: make([]byte, 0, FrameSize),
+	}
+}
+
+// FrameWriter writes data in the framed transport format.
+// Close must be called to write the trailer, it does not close the underlying writer.
+type FrameWriter struct {
+	w       io.Writer
+	buf     []byte
+	total   int64
+	started bool
+}
+
+func (f *FrameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(f.buf[len(f.buf):FrameSize], p)
+		f.buf = f.buf[:len(f.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(f.buf) == FrameSize {
+			err := f.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *FrameWriter) writeMagic() error {
+	if f.started {
+		return nil
+	}
+	f.started = true
+	_, err := io.WriteString(f.w, frameMagic)
+	return err
+}
+
+func (f *FrameWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	err := f.writeMagic()
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, frameLengthSize, frameLengthSize+frameChecksumSize)
+	binary.BigEndian.PutUint32(hdr, uint32(len(f.buf)))
+	sum := sha256.Sum256(f.buf)
+	hdr = append(hdr, sum[:]...)
+
+	_, err = f.w.Write(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = f.w.Write(f.buf)
+	if err != nil {
+		return err
+	}
+	f.total += int64(len(f.buf))
+	f.buf = f.buf[:0]
+	return nil
+}
+
+// Close flushes the last frame and writes the trailer
+func (f *FrameWriter) Close() error {
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	err = f.writeMagic()
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, frameLengthSize+frameTrailerLength)
+	binary.BigEndian.PutUint64(trailer[frameLengthSize:], uint64(f.total))
+	_, err = f.w.Write(trailer)
+	return err
+}
+
+// NewFrameReader creates a new FrameReader reading from the given reader
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r: r,
+	}
+}
+
+// FrameReader reads and verifies data in the framed transport format.
+// Data of a frame is only returned after its checksum has been verified.
+type FrameReader struct {
+	r       io.Reader
+	frame   []byte
+	buf     []byte
+	offset  int64
+	started bool
+	err     error
+}
+
+func (f *FrameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.err = f.next()
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// Err returns the verification error encountered, if any
+func (f *FrameReader) Err() error {
+	if errors.Is(f.err, io.EOF) {
+		return nil
+	}
+	return f.err
+}
+
+// Offset returns the amount of verified data read so far
+func (f *FrameReader) Offset() int64 {
+	return f.offset
+}
+
+func (f *FrameReader) fail(err error) error {
+	return &FrameError{Err: err, Offset: f.offset}
+}
+
+func (f *FrameReader) readFull(p []byte) error {
+	_, err := io.ReadFull(f.r, p)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return f.fail(ErrStreamTruncated)
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+func (f *FrameReader) next() error {
+	if !f.started {
+		magic := make([]byte, len(frameMagic))
+		err := f.readFull(magic)
+		if err != nil {
+			return err
+		}
+		if string(magic) != frameMagic {
+			return f.fail(fmt.Errorf("%w: invalid frame magic %q", ErrStreamCorrupted, magic))
+		}
+		f.started = true
+	}
+
+	hdr := make([]byte, frameLengthSize)
+	err := f.readFull(hdr)
+	if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(hdr)
+
+	if length == 0 {
+		trailer := make([]byte, frameTrailerLength)
+		err = f.readFull(trailer)
+		if err != nil {
+			return err
+		}
+		total := int64(binary.BigEndian.Uint64(trailer))
+		if total != f.offset {
+			return f.fail(fmt.Errorf("%w: trailer announces %d bytes", ErrStreamCorrupted, total))
+		}
+		// Nothing may follow the trailer
+		_, err = io.ReadFull(f.r, make([]byte, 1))
+		switch {
+		case err == nil:
+			return f.fail(fmt.Errorf("%w: data after trailer", ErrStreamCorrupted))
+		case !errors.Is(err, io.EOF):
+			return err
+		}
+		return io.EOF
+	}
+	if length > FrameSize {
+		return f.fail(fmt.Errorf("%w: frame length %d exceeds maximum", ErrStreamCorrupted, length))
+	}
+
+	if f.frame == nil {
+		f.frame = make([]byte, frameChecksumSize+FrameSize)
+	}
+	frame := f.frame[:frameChecksumSize+int(length)]
+	err = f.readFull(frame)
+	if err != nil {
+		return err
+	}
+
+	data := frame[frameChecksumSize:]
+	sum := sha256.Sum256(data)
+	if string(sum[:]) != string(frame[:frameChecksumSize]) {
+		return f.fail(fmt.Errorf("%w: checksum mismatch in frame of %d bytes", ErrStreamCorrupted, length))
+	}
+
+	f.offset += int64(length)
+	f.buf = data
+	return nil
+}
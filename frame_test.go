@@ -0,0 +1,97 @@
+package zfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func frameTestData(t *testing.T, size int) (data, framed []byte) {
+	t.Helper()
+
+	data = make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := NewFrameWriter(buf)
+	// Write in uneven chunks to cross frame boundaries
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 12345)
+		_, err = w.Write(rest[:n])
+		require.NoError(t, err)
+		rest = rest[n:]
+	}
+	require.NoError(t, w.Close())
+	return data, buf.Bytes()
+}
+
+func TestFrame_RoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, FrameSize, 2*FrameSize + 17} {
+		data, framed := frameTestData(t, size)
+
+		r := NewFrameReader(bytes.NewReader(framed))
+		out, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+		require.NoError(t, r.Err())
+		require.EqualValues(t, size, r.Offset())
+	}
+}
+
+func TestFrame_Corrupted(t *testing.T) {
+	_, framed := frameTestData(t, 2*FrameSize+17)
+
+	// Flip a byte in the second frame
+	framed[len(frameMagic)+2*(frameLengthSize+frameChecksumSize)+FrameSize+100] ^= 0xff
+
+	r := NewFrameReader(bytes.NewReader(framed))
+	out, err := io.ReadAll(r)
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+	require.Len(t, out, FrameSize, "only the verified first frame should be returned")
+
+	var frameErr *FrameError
+	require.True(t, errors.As(err, &frameErr))
+	require.EqualValues(t, FrameSize, frameErr.Offset)
+	require.Equal(t, err, r.Err())
+}
+
+func TestFrame_Truncated(t *testing.T) {
+	_, framed := frameTestData(t, FrameSize+17)
+
+	for _, cut := range []int{1, 8, 20, len(framed) - FrameSize} {
+		r := NewFrameReader(bytes.NewReader(framed[:len(framed)-cut]))
+		_, err := io.ReadAll(r)
+		require.ErrorIs(t, err, ErrStreamTruncated, "cut %d", cut)
+	}
+}
+
+func TestFrame_TrailerMismatch(t *testing.T) {
+	_, framed := frameTestData(t, 100)
+	framed[len(framed)-1]++
+
+	_, err := io.ReadAll(NewFrameReader(bytes.NewReader(framed)))
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+}
+
+func TestFrame_TrailingData(t *testing.T) {
+	data, framed := frameTestData(t, 100)
+
+	r := NewFrameReader(bytes.NewReader(append(framed, 0)))
+	out, err := io.ReadAll(r)
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+	require.Equal(t, data, out)
+
+	var frameErr *FrameError
+	require.True(t, errors.As(err, &frameErr))
+	require.EqualValues(t, 100, frameErr.Offset)
+}
+
+func TestFrame_InvalidMagic(t *testing.T) {
+	_, err := io.ReadAll(NewFrameReader(bytes.NewReader([]byte("not a framed stream"))))
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+}
@@ -3,8 +3,8 @@ module github.com/vansante/go-zfsutils
 go 1.22
 
 require (
-	github.com/juju/ratelimit v1.0.2
 	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.31
 	github.com/stretchr/testify v1.9.0
 	github.com/vansante/go-event-emitter v1.0.2
 )
@@ -0,0 +1,88 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+// ErrInsufficientSpace is returned when a receive does not fit in the space available to its target
+var ErrInsufficientSpace = errors.New("insufficient space")
+
+// expectedSize returns the expected size of the stream of a receive, zero when the client did not send it
+func expectedSize(req *http.Request) (uint64, error) {
+	value := req.Header.Get(HeaderExpectedSize)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s header: %w", ErrInvalidRequest, HeaderExpectedSize, err)
+	}
+	return size, nil
+}
+
+// admitReceive reserves the receive quota of the principal and the space of the target for a receive. A receive
+// of an expected size is refused up front when it exceeds the remaining receive quota, the quota of the target
+// filesystem or the space available to it, less what is reserved for the receives in progress. It returns the
+// status to refuse the receive with. The reservation has to be released when the receive is done.
+func (h *HTTP) admitReceive(req *http.Request, filesystem string, size uint64) (*receiveReservation, int, error) {
+	parent, quota, used, err := h.receiveQuota(req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	admission := receiveAdmission{parent: parent, quota: quota, used: used, size: size}
+
+	if size > 0 {
+		name := h.getFilesystem(req, filesystem)
+		target, err := nearestDataset(req.Context(), name)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if target.Name == name {
+			if target.Quota > 0 && target.Used+size > target.Quota {
+				return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: expected %d bytes, %d of quota %d bytes used",
+					ErrQuotaExceeded, size, target.Used, target.Quota,
+				)
+			}
+			if target.Refquota > 0 && target.Referenced+size > target.Refquota {
+				return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: expected %d bytes, %d of refquota %d bytes used",
+					ErrQuotaExceeded, size, target.Referenced, target.Refquota,
+				)
+			}
+		}
+		admission.pool = zfs.PoolName(target.Name)
+		admission.available = target.Available
+	}
+
+	reservation, err := h.reservations.reserve(admission)
+	switch {
+	case errors.Is(err, ErrQuotaExceeded) && size > 0:
+		return nil, http.StatusRequestEntityTooLarge, err
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrInsufficientSpace):
+		return nil, http.StatusInsufficientStorage, err
+	case err != nil:
+		return nil, http.StatusInternalServerError, err
+	}
+	return reservation, 0, nil
+}
+
+// nearestDataset returns the dataset, or its nearest ancestor that exists when the dataset does not exist yet
+func nearestDataset(ctx context.Context, name string) (*zfs.Dataset, error) {
+	for {
+		ds, err := zfs.GetDataset(ctx, name)
+		if !errors.Is(err, zfs.ErrDatasetNotFound) {
+			return ds, err
+		}
+		idx := strings.LastIndex(name, "/")
+		if idx < 0 {
+			return nil, err
+		}
+		name = name[:idx]
+	}
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_expectedSize(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    uint64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"1048576", 1048576, false},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPut, "/filesystems/fs/snapshots/snap", nil)
+			require.NoError(t, err)
+			if tt.header != "" {
+				req.Header.Set(HeaderExpectedSize, tt.header)
+			}
+
+			size, err := expectedSize(req)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrInvalidRequest)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, size)
+		})
+	}
+}
+
+func TestHTTP_handleReceiveSnapshotExpectedSize(t *testing.T) {
+	httpHandlerTest(t, func(url string) {
+		receive := func(expectedSize string) *http.Response {
+			req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/filesystems/bla/snapshots/recv", url),
+				strings.NewReader("not a stream"),
+			)
+			require.NoError(t, err)
+			req.Header.Set(HeaderExpectedSize, expectedSize)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			return resp
+		}
+
+		resp := receive("lots")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.ErrorIs(t, responseError(resp), ErrInvalidRequest)
+
+		resp = receive("1152921504606846976") // 1 EiB
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+		require.ErrorIs(t, responseError(resp), ErrInsufficientSpace)
+	})
+}
+
+func TestReceiveReservations_admitted(t *testing.T) {
+	reservations := newReceiveReservations()
+
+	// The expected size is reserved in the space of the pool, a second receive does not fit in what is left
+	first, err := reservations.reserve(receiveAdmission{pool: "tank", available: 100, size: 60})
+	require.NoError(t, err)
+	_, err = reservations.reserve(receiveAdmission{pool: "tank", available: 100, size: 60})
+	require.ErrorIs(t, err, ErrInsufficientSpace)
+	other, err := reservations.reserve(receiveAdmission{pool: "other", available: 100, size: 60})
+	require.NoError(t, err)
+	other.release()
+
+	// Received bytes are no longer reserved, they are part of the used space of the pool
+	require.EqualValues(t, 40, first.take(40))
+	require.EqualValues(t, 20, reservations.space["tank"])
+	first.release()
+	require.Empty(t, reservations.space)
+
+	// The expected size is reserved in the quota budget as well
+	admission := receiveAdmission{parent: "tenant", quota: 100, used: 20, pool: "tank", available: 1000, size: 50}
+	first, err = reservations.reserve(admission)
+	require.NoError(t, err)
+	_, err = reservations.reserve(admission)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// A receive without expected size only gets the part that is not reserved
+	unknown, err := reservations.reserve(receiveAdmission{parent: "tenant", quota: 100, used: 20})
+	require.NoError(t, err)
+	require.EqualValues(t, 30, unknown.take(100))
+	require.EqualValues(t, 50, first.take(100), "the admitted receive keeps its reservation")
+	unknown.release()
+	first.release()
+	require.Empty(t, reservations.budgets)
+	require.Empty(t, reservations.space)
+}
@@ -0,0 +1,236 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditOperation names a state changing operation of the server in the audit log
+type AuditOperation string
+
+const (
+	AuditSetProperties         AuditOperation = "set_properties"
+	AuditSetSnapshotProperties AuditOperation = "set_snapshot_properties"
+	AuditDestroyDataset        AuditOperation = "destroy_dataset"
+	AuditDestroySnapshot       AuditOperation = "destroy_snapshot"
+	AuditRenameDataset         AuditOperation = "rename_dataset"
+	AuditMakeSnapshot          AuditOperation = "make_snapshot"
+	AuditReceiveSnapshot       AuditOperation = "receive_snapshot"
+	AuditRollbackSnapshot      AuditOperation = "rollback_snapshot"
+	AuditCloneSnapshot         AuditOperation = "clone_snapshot"
+	AuditAbortResumableReceive AuditOperation = "abort_resumable_receive"
+	AuditCancelReceive         AuditOperation = "cancel_receive"
+)
+
+// AuditResult is the outcome of an audited operation
+type AuditResult string
+
+const (
+	AuditResultSuccess AuditResult = "success"
+	AuditResultFailure AuditResult = "failure"
+)
+
+// AuditRecord is a single entry of the audit log
+type AuditRecord struct {
+	Time       time.Time      `json:"Time"`
+	Operation  AuditOperation `json:"Operation"`
+	Principal  string         `json:"Principal,omitempty"`
+	AuthMethod string         `json:"AuthMethod,omitempty"`
+	RemoteAddr string         `json:"RemoteAddr"`
+	// Dataset is the full name of the dataset the operation applies to
+	Dataset string `json:"Dataset,omitempty"`
+	// Target is the full name of the new dataset of a rename or clone
+	Target string `json:"Target,omitempty"`
+	// Properties are the properties set by the operation, UnsetProperties are the ones inherited again
+	Properties      map[string]string `json:"Properties,omitempty"`
+	UnsetProperties []string          `json:"UnsetProperties,omitempty"`
+	BytesReceived   int64             `json:"BytesReceived"`
+	Status          int               `json:"Status"`
+	Result          AuditResult       `json:"Result"`
+	Error           string            `json:"Error,omitempty"`
+}
+
+// AuditSink stores the audit log. WriteAudit is called before the response of the operation is sent.
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record AuditRecord) error
+}
+
+// JSONAuditSink writes the audit log as JSON lines
+type JSONAuditSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONAuditSink creates an audit sink writing a JSON line per record to the writer
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// OpenJSONAuditLog opens a JSON lines audit log file, records are appended to it. Close the sink to close the file.
+func OpenJSONAuditLog(path string) (*JSONAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONAuditSink(file), nil
+}
+
+// WriteAudit writes the record as a single line
+func (s *JSONAuditSink) WriteAudit(_ context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.w.Write(data)
+	return err
+}
+
+// Close closes the underlying writer, when it can be closed
+func (s *JSONAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	closer, ok := s.w.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// SetAuditSink sets the sink the audit log of state changing operations is written to, nil disables the audit log
+func (h *HTTP) SetAuditSink(sink AuditSink) {
+	h.auditMutex.Lock()
+	defer h.auditMutex.Unlock()
+	h.auditSink = sink
+}
+
+func (h *HTTP) getAuditSink() AuditSink {
+	h.auditMutex.RLock()
+	defer h.auditMutex.RUnlock()
+	return h.auditSink
+}
+
+type auditContextKey struct{}
+
+// auditProperties adds the properties changed by an operation to its audit record
+func auditProperties(req *http.Request, set map[string]string, unset []string) {
+	record, ok := req.Context().Value(auditContextKey{}).(*AuditRecord)
+	if !ok {
+		return
+	}
+	record.Properties = set
+	record.UnsetProperties = unset
+}
+
+// auditDataset overrides the dataset of the audit record of an operation
+func auditDataset(req *http.Request, dataset string) {
+	record, ok := req.Context().Value(auditContextKey{}).(*AuditRecord)
+	if !ok {
+		return
+	}
+	record.Dataset = dataset
+}
+
+// auditBytesReceived sets the size of the stream received by an operation in its audit record
+func auditBytesReceived(req *http.Request, n int64) {
+	record, ok := req.Context().Value(auditContextKey{}).(*AuditRecord)
+	if !ok {
+		return
+	}
+	record.BytesReceived = n
+}
+
+// audited records an operation in the audit log. The record is written as soon as the handler starts the
+// response, so it is stored before the client learns the result.
+func (h *HTTP) audited(operation AuditOperation, handler handle) handle {
+	return func(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+		sink := h.getAuditSink()
+		if sink == nil {
+			handler(w, req, logger)
+			return
+		}
+
+		record := &AuditRecord{
+			Operation:  operation,
+			RemoteAddr: req.RemoteAddr,
+			Dataset:    h.auditDatasetName(req),
+		}
+		if identity := IdentityFromContext(req.Context()); identity != nil {
+			record.Principal = identity.Principal
+			record.AuthMethod = identity.Method
+		}
+		if target := req.PathValue("target"); target != "" {
+			record.Target = h.getFilesystem(req, target)
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), auditContextKey{}, record))
+		aw := &auditResponseWriter{ResponseWriter: w, write: func(status int) {
+			record.Time = time.Now()
+			record.Status = status
+			record.Result = AuditResultSuccess
+			if status >= http.StatusBadRequest {
+				record.Result = AuditResultFailure
+				record.Error = w.Header().Get(HeaderError)
+			}
+			err := sink.WriteAudit(req.Context(), *record)
+			if err != nil {
+				logger.Error("zfs.http.audited: Error writing audit record", "error", err, "operation", operation)
+			}
+		}}
+
+		handler(aw, req, logger)
+
+		aw.flushAudit(http.StatusOK)
+	}
+}
+
+// auditDatasetName returns the full name of the dataset in the path of a request
+func (h *HTTP) auditDatasetName(req *http.Request) string {
+	filesystem, _ := pathDataset(req)
+	if filesystem == "" {
+		return ""
+	}
+	snapshot := req.PathValue("snapshot")
+	if snapshot == "" {
+		return h.getFilesystem(req, filesystem)
+	}
+	return h.getSnapshot(req, filesystem, snapshot)
+}
+
+// auditResponseWriter writes the audit record before the response starts
+type auditResponseWriter struct {
+	http.ResponseWriter
+	write   func(status int)
+	written bool
+}
+
+func (w *auditResponseWriter) flushAudit(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	w.write(status)
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.flushAudit(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	w.flushAudit(http.StatusOK)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recorderAuditSink struct {
+	rec     *httptest.ResponseRecorder
+	records []AuditRecord
+	// late is set when a record was written after the response was sent
+	late bool
+}
+
+func (s *recorderAuditSink) WriteAudit(_ context.Context, record AuditRecord) error {
+	if s.rec.Body.Len() > 0 {
+		s.late = true
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	conf := Config{ParentDataset: "tank"}
+	conf.Authentication.BearerTokens = map[string]string{"token": "backup"}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	rec := httptest.NewRecorder()
+	sink := &recorderAuditSink{rec: rec}
+	h.SetAuditSink(sink)
+
+	req := httptest.NewRequest(http.MethodDelete, "/filesystems/backups", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	require.Len(t, sink.records, 1)
+	require.False(t, sink.late, "the response was sent before the audit record")
+	record := sink.records[0]
+	require.WithinDuration(t, time.Now(), record.Time, time.Minute)
+	record.Time = time.Time{}
+	require.Equal(t, AuditRecord{
+		Operation:  AuditDestroyDataset,
+		Principal:  "backup",
+		AuthMethod: AuthMethodBearerToken,
+		RemoteAddr: req.RemoteAddr,
+		Dataset:    "tank/backups",
+		Status:     http.StatusForbidden,
+		Result:     AuditResultFailure,
+		Error:      ErrForbidden.Error(),
+	}, record)
+
+	// Reads are not audited
+	rec = httptest.NewRecorder()
+	sink.rec = rec
+	req = httptest.NewRequest(http.MethodGet, "/codecs", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, sink.records, 1)
+}
+
+func TestAudit_JSONSink(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	var buf bytes.Buffer
+	h.SetAuditSink(NewJSONAuditSink(&buf))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/volumes/..%2Fescape/snapshots/snap", strings.NewReader("stream")))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/filesystems/fs/rename/..%2Fescape", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	scanner := bufio.NewScanner(&buf)
+	var records []AuditRecord
+	for scanner.Scan() {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, records, 2)
+
+	require.Equal(t, AuditReceiveSnapshot, records[0].Operation)
+	require.Equal(t, "../escape@snap", records[0].Dataset)
+	require.Equal(t, http.StatusBadRequest, records[0].Status)
+	require.Equal(t, ErrInvalidIdentifier.Error(), records[0].Error)
+
+	require.Equal(t, AuditRenameDataset, records[1].Operation)
+	require.Equal(t, "fs", records[1].Dataset)
+	require.Equal(t, "../escape", records[1].Target)
+	require.Equal(t, AuditResultFailure, records[1].Result)
+
+	h.SetAuditSink(nil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/filesystems/fs", nil))
+	require.Zero(t, buf.Len())
+}
@@ -0,0 +1,387 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthMethodBearerToken is the method of identities authenticated with a static bearer token
+	AuthMethodBearerToken = "token"
+	// AuthMethodHMAC is the method of identities authenticated with a HMAC signed request
+	AuthMethodHMAC = "hmac"
+	// AuthMethodClientCertificate is the method of identities authenticated with a TLS client certificate
+	AuthMethodClientCertificate = "mtls"
+
+	authSchemeBearer = "Bearer"
+	authSchemeHMAC   = "HMAC-SHA256"
+
+	defaultHMACMaxClockSkewSeconds = 300
+
+	// HeaderSignatureNonce is a random value of a HMAC signed request, a nonce is accepted only once
+	HeaderSignatureNonce = "X-Signature-Nonce"
+	// HeaderContentSHA256 is the hex encoded SHA-256 hash of the body of a HMAC signed request,
+	// or UNSIGNED-PAYLOAD for a stream
+	HeaderContentSHA256 = "X-Content-Sha256"
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// maxSignedBodySize is the size of the largest body that is hashed, larger bodies have to be streams
+	maxSignedBodySize = 1024 * 1024
+)
+
+var (
+	// ErrUnauthenticated is returned by authenticators when a request has invalid credentials
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+// Identity is the authenticated principal of a request
+type Identity struct {
+	// Principal is the name of the authenticated client
+	Principal string
+	// Method is the way the client was authenticated
+	Method string
+}
+
+type identityContextKey struct{}
+
+// IdentityFromContext returns the identity of an authenticated request, or nil when authentication is disabled
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return identity
+}
+
+// ContextWithIdentity returns a context carrying the identity
+func ContextWithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// Authenticator authenticates requests to the HTTP server
+type Authenticator interface {
+	// Authenticate returns the identity of the request. When the request carries no credentials of the kind
+	// the authenticator handles it returns nil without error, so the next authenticator can be tried.
+	// Invalid credentials return an error wrapping ErrUnauthenticated.
+	Authenticate(req *http.Request) (*Identity, error)
+}
+
+// AuthenticationConfig configures the authenticators of the HTTP server.
+// When no authenticator is configured, requests are not authenticated.
+type AuthenticationConfig struct {
+	// BearerTokens maps static bearer tokens to the principal they authenticate
+	BearerTokens map[string]string `json:"BearerTokens" yaml:"BearerTokens"`
+
+	// HMACKeys maps key ids to the principal and secret of HMAC signed requests, see Client.SetHMACKey.
+	// The signature covers the host, a nonce and the hash of the body, except for snapshot streams, which are
+	// not hashed so they do not have to be buffered. Send streams over TLS.
+	HMACKeys map[string]HMACKey `json:"HMACKeys" yaml:"HMACKeys"`
+	// HMACMaxClockSkewSeconds is the maximum age of a signed request, and how far its timestamp may be in the future
+	HMACMaxClockSkewSeconds int64 `json:"HMACMaxClockSkewSeconds" yaml:"HMACMaxClockSkewSeconds"`
+
+	// ClientCertificates enables authentication with verified TLS client certificates. The TLS configuration
+	// of the server has to request and verify client certificates for this to work.
+	ClientCertificates bool `json:"ClientCertificates" yaml:"ClientCertificates"`
+	// ClientCertificatePrincipals maps certificate common names to principals. When empty the common name is the
+	// principal, otherwise certificates with an unlisted common name are rejected.
+	ClientCertificatePrincipals map[string]string `json:"ClientCertificatePrincipals" yaml:"ClientCertificatePrincipals"`
+}
+
+// HMACKey is a key for HMAC signed requests
+type HMACKey struct {
+	Principal string `json:"Principal" yaml:"Principal"`
+	Secret    string `json:"Secret" yaml:"Secret"`
+}
+
+// ApplyDefaults sets all config values to their defaults (if they have one)
+func (c *AuthenticationConfig) ApplyDefaults() {
+	c.HMACMaxClockSkewSeconds = defaultHMACMaxClockSkewSeconds
+}
+
+// authenticators creates the authenticators that are configured
+func (c *AuthenticationConfig) authenticators() []Authenticator {
+	var authenticators []Authenticator
+	if len(c.BearerTokens) > 0 {
+		authenticators = append(authenticators, NewBearerTokenAuthenticator(c.BearerTokens))
+	}
+	if len(c.HMACKeys) > 0 {
+		skew := time.Duration(c.HMACMaxClockSkewSeconds) * time.Second
+		if skew <= 0 {
+			skew = defaultHMACMaxClockSkewSeconds * time.Second
+		}
+		authenticators = append(authenticators, NewHMACAuthenticator(c.HMACKeys, skew))
+	}
+	if c.ClientCertificates {
+		authenticators = append(authenticators, NewClientCertificateAuthenticator(c.ClientCertificatePrincipals))
+	}
+	return authenticators
+}
+
+// NewBearerTokenAuthenticator creates an authenticator for static bearer tokens, mapped to their principal
+func NewBearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	hashed := make(map[[sha256.Size]byte]string, len(tokens))
+	for token, principal := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = principal
+	}
+	return &bearerTokenAuthenticator{tokens: hashed}
+}
+
+type bearerTokenAuthenticator struct {
+	// tokens are stored hashed, so they are compared in constant time regardless of their length
+	tokens map[[sha256.Size]byte]string
+}
+
+func (a *bearerTokenAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, authSchemeBearer) {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	for hash, principal := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+			return &Identity{Principal: principal, Method: AuthMethodBearerToken}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: invalid bearer token", ErrUnauthenticated)
+}
+
+// NewHMACAuthenticator creates an authenticator for HMAC signed requests. Requests with a timestamp that differs
+// more than maxSkew from the current time are rejected, as are nonces that were seen within that time.
+func NewHMACAuthenticator(keys map[string]HMACKey, maxSkew time.Duration) Authenticator {
+	return &hmacAuthenticator{
+		keys:    keys,
+		maxSkew: maxSkew,
+		now:     time.Now,
+		nonces:  newNonceCache(),
+	}
+}
+
+type hmacAuthenticator struct {
+	keys    map[string]HMACKey
+	maxSkew time.Duration
+	now     func() time.Time
+	nonces  *nonceCache
+}
+
+// signRequest returns the signature of a request. It covers the method, host, request URI, timestamp, nonce and
+// the hash of the body.
+func signRequest(secret, method, host, requestURI string, timestamp int64, nonce, contentHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n%s", method, host, requestURI, timestamp, nonce, contentHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signHMAC sets the nonce, content hash and Authorization headers of a HMAC signed request. A body that can be
+// read again is hashed, other bodies are streams that are left unsigned.
+func signHMAC(req *http.Request, keyID, secret string, now time.Time) error {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	contentHash, err := requestContentHash(req)
+	if err != nil {
+		return fmt.Errorf("error hashing body: %w", err)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	timestamp := now.Unix()
+	req.Header.Set(HeaderSignatureNonce, hex.EncodeToString(nonce))
+	req.Header.Set(HeaderContentSHA256, contentHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s:%d:%s",
+		authSchemeHMAC, keyID, timestamp,
+		signRequest(secret, req.Method, host, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), contentHash),
+	))
+	return nil
+}
+
+// requestContentHash returns the hash of the body of a request that is sent
+func requestContentHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if req.GetBody == nil {
+		return unsignedPayload, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, body)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyContentHash checks the body of a received request against its signed hash. The body is read up front and
+// replaced, so the handler can still read it.
+func verifyContentHash(req *http.Request, contentHash string) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+	if err != nil {
+		return fmt.Errorf("%w: error reading body: %w", ErrUnauthenticated, err)
+	}
+	if len(body) > maxSignedBodySize {
+		return fmt.Errorf("%w: signed body larger than %d bytes", ErrUnauthenticated, maxSignedBodySize)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(contentHash)) {
+		return fmt.Errorf("%w: body does not match the signed hash", ErrUnauthenticated)
+	}
+	return nil
+}
+
+func (a *hmacAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, authSchemeHMAC) {
+		return nil, nil
+	}
+
+	parts := strings.Split(strings.TrimSpace(credentials), ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthenticated)
+	}
+	key, ok := a.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %s", ErrUnauthenticated, parts[0])
+	}
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed timestamp", ErrUnauthenticated)
+	}
+	now := a.now()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, fmt.Errorf("%w: timestamp outside allowed clock skew", ErrUnauthenticated)
+	}
+	nonce := req.Header.Get(HeaderSignatureNonce)
+	contentHash := req.Header.Get(HeaderContentSHA256)
+	if nonce == "" || contentHash == "" {
+		return nil, fmt.Errorf("%w: missing %s or %s header", ErrUnauthenticated, HeaderSignatureNonce, HeaderContentSHA256)
+	}
+
+	expected := signRequest(key.Secret, req.Method, req.Host, req.URL.RequestURI(), timestamp, nonce, contentHash)
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+	if contentHash != unsignedPayload {
+		err = verifyContentHash(req, contentHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The signature stays valid until the timestamp is outside the clock skew, so the nonce is remembered that long
+	if !a.nonces.add(parts[0]+":"+nonce, time.Unix(timestamp, 0).Add(a.maxSkew), now) {
+		return nil, fmt.Errorf("%w: nonce already used", ErrUnauthenticated)
+	}
+	return &Identity{Principal: key.Principal, Method: AuthMethodHMAC}, nil
+}
+
+// nonceCache remembers the nonces of signed requests until their signature expires
+type nonceCache struct {
+	mutex     sync.Mutex
+	expires   map[string]time.Time
+	nextPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{expires: make(map[string]time.Time)}
+}
+
+// add remembers the nonce until it expires, it returns false when the nonce was already seen
+func (c *nonceCache) add(nonce string, expires, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.After(c.nextPrune) {
+		for seen, seenExpires := range c.expires {
+			if now.After(seenExpires) {
+				delete(c.expires, seen)
+			}
+		}
+		c.nextPrune = now.Add(time.Minute)
+	}
+
+	seenExpires, ok := c.expires[nonce]
+	if ok && !now.After(seenExpires) {
+		return false
+	}
+	c.expires[nonce] = expires
+	return true
+}
+
+// NewClientCertificateAuthenticator creates an authenticator for verified TLS client certificates.
+// When principals is empty, the common name of the certificate is the principal, otherwise the
+// common name is mapped to a principal and unlisted common names are rejected.
+func NewClientCertificateAuthenticator(principals map[string]string) Authenticator {
+	return &clientCertificateAuthenticator{principals: principals}
+}
+
+type clientCertificateAuthenticator struct {
+	principals map[string]string
+}
+
+func (a *clientCertificateAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.principals) == 0 {
+		return &Identity{Principal: commonName, Method: AuthMethodClientCertificate}, nil
+	}
+	principal, ok := a.principals[commonName]
+	if !ok {
+		return nil, fmt.Errorf("%w: client certificate %s not allowed", ErrUnauthenticated, commonName)
+	}
+	return &Identity{Principal: principal, Method: AuthMethodClientCertificate}, nil
+}
+
+// authenticate runs the authenticators in order, the first identity found is used.
+// It returns a nil identity without error when authentication is disabled.
+func (h *HTTP) authenticate(req *http.Request) (*Identity, error) {
+	h.authenticatorsMutex.RLock()
+	authenticators := h.authenticators
+	h.authenticatorsMutex.RUnlock()
+
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+		if identity != nil {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no credentials given", ErrUnauthenticated)
+}
+
+// AddAuthenticator adds a custom authenticator, it is tried after the configured authenticators
+func (h *HTTP) AddAuthenticator(authenticator Authenticator) {
+	h.authenticatorsMutex.Lock()
+	defer h.authenticatorsMutex.Unlock()
+	// Copy the slice, so authentications in progress keep the list they started with
+	h.authenticators = append(h.authenticators[:len(h.authenticators):len(h.authenticators)], authenticator)
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth_BearerToken(t *testing.T) {
+	auth := NewBearerTokenAuthenticator(map[string]string{"s3cret": "backup1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/filesystems", nil)
+	identity, err := auth.Authenticate(req)
+	require.NoError(t, err)
+	require.Nil(t, identity, "no credentials should be skipped")
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	identity, err = auth.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Principal: "backup1", Method: AuthMethodBearerToken}, identity)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestAuth_HMAC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	auth := NewHMACAuthenticator(map[string]HMACKey{"key1": {Principal: "backup2", Secret: "hmacsecret"}}, time.Minute)
+	auth.(*hmacAuthenticator).now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodPut, "/filesystems/fs/snapshots?resumable=true", nil)
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now.Add(-30*time.Second)))
+	identity, err := auth.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Principal: "backup2", Method: AuthMethodHMAC}, identity)
+
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated, "a replayed nonce should be rejected")
+
+	// The signature covers the request URI and host
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now))
+	req.URL.RawQuery = "resumable=false"
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now))
+	req.Host = "other.example"
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now.Add(-2*time.Minute)))
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated, "timestamp outside skew should be rejected")
+
+	require.NoError(t, signHMAC(req, "key2", "hmacsecret", now))
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	require.NoError(t, signHMAC(req, "key1", "othersecret", now))
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestAuth_HMACBody(t *testing.T) {
+	now := time.Now()
+	auth := NewHMACAuthenticator(map[string]HMACKey{"key1": {Principal: "backup2", Secret: "hmacsecret"}}, time.Minute)
+
+	// A body that can be read again is hashed, the handler can still read it after verification
+	req, err := http.NewRequest(http.MethodPatch, "http://example.com/filesystems/fs", strings.NewReader(`{"set":{}}`))
+	require.NoError(t, err)
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now))
+	require.NotEqual(t, unsignedPayload, req.Header.Get(HeaderContentSHA256))
+	_, err = auth.Authenticate(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"set":{}}`, string(body))
+
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now))
+	req.Body = io.NopCloser(strings.NewReader(`{"unset":["quota"]}`))
+	_, err = auth.Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated, "a changed body should be rejected")
+
+	// Streams are not hashed
+	req, err = http.NewRequest(http.MethodPut, "http://example.com/filesystems/fs/snapshots", io.MultiReader(strings.NewReader("stream")))
+	require.NoError(t, err)
+	require.NoError(t, signHMAC(req, "key1", "hmacsecret", now))
+	require.Equal(t, unsignedPayload, req.Header.Get(HeaderContentSHA256))
+	_, err = auth.Authenticate(req)
+	require.NoError(t, err)
+}
+
+func Test_nonceCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newNonceCache()
+	require.True(t, cache.add("a", now.Add(time.Minute), now))
+	require.False(t, cache.add("a", now.Add(time.Minute), now))
+	require.True(t, cache.add("b", now.Add(time.Minute), now))
+
+	// Expired nonces are pruned
+	later := now.Add(2 * time.Minute)
+	require.True(t, cache.add("c", later.Add(time.Minute), later))
+	require.Len(t, cache.expires, 1)
+}
+
+func TestAuth_ClientCertificate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/filesystems", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "host1.example"}}}},
+	}
+
+	identity, err := NewClientCertificateAuthenticator(nil).Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, &Identity{Principal: "host1.example", Method: AuthMethodClientCertificate}, identity)
+
+	identity, err = NewClientCertificateAuthenticator(map[string]string{"host1.example": "tenant1"}).Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "tenant1", identity.Principal)
+
+	_, err = NewClientCertificateAuthenticator(map[string]string{"host2.example": "tenant2"}).Authenticate(req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestAuth_Middleware(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.Authentication.BearerTokens = map[string]string{"token1": "backup1"}
+	conf.Authentication.HMACKeys = map[string]HMACKey{"key1": {Principal: "backup2", Secret: "hmacsecret"}}
+
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	var identity *Identity
+	h.registerRoute(http.MethodGet, "/whoami", func(w http.ResponseWriter, req *http.Request, _ *slog.Logger) {
+		identity = IdentityFromContext(req.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := NewClient(server.URL, slog.Default())
+	_, err := client.ServerCodecs(context.Background())
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	for name, setup := range map[string]func(c *Client){
+		"backup1": func(c *Client) { c.SetBearerToken("token1") },
+		"backup2": func(c *Client) { c.SetHMACKey("key1", "hmacsecret") },
+	} {
+		client := NewClient(server.URL, slog.Default())
+		setup(client)
+		_, err = client.ServerCodecs(context.Background())
+		require.NoError(t, err, name)
+
+		req, err := client.request(context.Background(), http.MethodGet, "whoami", nil)
+		require.NoError(t, err)
+		resp, err := client.client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.Equal(t, name, identity.Principal)
+	}
+}
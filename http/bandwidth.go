@@ -0,0 +1,274 @@
+package http
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+// bandwidthPool divides the bandwidth budgets of a server over its streams. The rate of a stream depends on all
+// streams it shares a budget with, and on the streams those share a budget with, so the pool recalculates the rates
+// of all its streams when a stream joins or leaves, or a budget changes. Streams pace on their last calculated rate.
+type bandwidthPool struct {
+	mutex   sync.Mutex
+	streams map[*bandwidthStream]struct{}
+	// expires is the unix time in nanoseconds at which a schedule may change the rates, zero when none applies
+	expires atomic.Int64
+}
+
+func newBandwidthPool() *bandwidthPool {
+	return &bandwidthPool{streams: make(map[*bandwidthStream]struct{})}
+}
+
+// budget creates a bandwidth budget of which the pool divides the changes over its streams
+func (p *bandwidthPool) budget(bytesPerSecond int64, schedule zfs.BandwidthSchedule) *bandwidth {
+	return &bandwidth{
+		pool:     p,
+		limit:    max(bytesPerSecond, 0),
+		schedule: schedule,
+		streams:  make(map[*bandwidthStream]struct{}),
+	}
+}
+
+// join adds a stream to the budgets, the stream stops waiting when the context is done
+func (p *bandwidthPool) join(ctx context.Context, budgets ...*bandwidth) *bandwidthStream {
+	s := &bandwidthStream{pool: p, budgets: budgets}
+	s.pacer = zfs.NewPacer(ctx, s.rate)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.streams[s] = struct{}{}
+	for _, budget := range budgets {
+		budget.streams[s] = struct{}{}
+	}
+	p.divide()
+	return s
+}
+
+// leave removes the stream from its budgets, handing its share to the other streams
+func (p *bandwidthPool) leave(s *bandwidthStream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.streams, s)
+	for _, budget := range s.budgets {
+		delete(budget.streams, s)
+	}
+	p.divide()
+}
+
+// recalculate divides the budgets over the streams again
+func (p *bandwidthPool) recalculate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.divide()
+}
+
+// divide sets the rates of all streams, the pool must be locked
+func (p *bandwidthPool) divide() {
+	now := time.Now()
+	scheduled := false
+	for s := range p.streams {
+		for _, budget := range s.budgets {
+			scheduled = scheduled || budget.scheduled()
+		}
+	}
+
+	rates := fairRates(p.streams, now)
+	for s := range p.streams {
+		s.cached.Store(math.Float64bits(rates[s]))
+	}
+
+	// Schedules change their rate at the start of a minute at most
+	expires := int64(0)
+	if scheduled {
+		expires = now.Truncate(time.Minute).Add(time.Minute).UnixNano()
+	}
+	p.expires.Store(expires)
+}
+
+// bandwidth is a bandwidth budget shared by streams. The budget is divided max-min fair: every active stream gets
+// an equal share, except streams held back by another budget, which leave their unused share to the others. So the
+// streams together never exceed it. The budget can be changed while streams are active.
+type bandwidth struct {
+	pool     *bandwidthPool
+	mutex    sync.Mutex
+	limit    int64 // Bytes per second, zero is unlimited
+	schedule zfs.BandwidthSchedule
+	streams  map[*bandwidthStream]struct{} // Guarded by the mutex of the pool
+}
+
+// setLimit sets a fixed budget, replacing the schedule
+func (b *bandwidth) setLimit(bytesPerSecond int64) {
+	b.mutex.Lock()
+	b.limit = max(bytesPerSecond, 0)
+	b.schedule = zfs.BandwidthSchedule{}
+	b.mutex.Unlock()
+
+	b.pool.recalculate()
+}
+
+// setSchedule sets a budget that follows the schedule, replacing the fixed budget
+func (b *bandwidth) setSchedule(schedule zfs.BandwidthSchedule) {
+	b.mutex.Lock()
+	b.limit = 0
+	b.schedule = schedule
+	b.mutex.Unlock()
+
+	b.pool.recalculate()
+}
+
+// bytesPerSecond returns the budget at the time, zero is unlimited
+func (b *bandwidth) bytesPerSecond(now time.Time) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.schedule.IsZero() {
+		return max(b.schedule.BytesPerSecond(now), 0)
+	}
+	return b.limit
+}
+
+// scheduled returns whether the budget follows a schedule
+func (b *bandwidth) scheduled() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.schedule.IsZero()
+}
+
+// bandwidthStream is a stream that has joined one or more bandwidth budgets. It paces on the rate its pool last
+// calculated for it, so budget changes apply right away without recalculating on every read or write.
+type bandwidthStream struct {
+	pool    *bandwidthPool
+	budgets []*bandwidth
+	pacer   *zfs.Pacer
+	cached  atomic.Uint64 // The rate as float64 bits
+}
+
+// leave removes the stream from its budgets, handing its share to the other streams
+func (s *bandwidthStream) leave() {
+	s.pool.leave(s)
+}
+
+// rate returns the bytes per second of the stream, or zero when none of its budgets is limited
+func (s *bandwidthStream) rate() float64 {
+	expires := s.pool.expires.Load()
+	if expires != 0 && time.Now().UnixNano() >= expires {
+		s.pool.recalculate()
+	}
+	return math.Float64frombits(s.cached.Load())
+}
+
+// fairRates divides the limited budgets of the streams over them by progressive filling: the budget with the
+// smallest equal share fixes the rate of its streams, which is then subtracted from the other budgets of those
+// streams, until all budgets are divided. Streams without a limited budget are left out.
+// The pool of the streams must be locked.
+func fairRates(streams map[*bandwidthStream]struct{}, now time.Time) map[*bandwidthStream]float64 {
+	remaining := make(map[*bandwidth]float64)
+	for stream := range streams {
+		for _, budget := range stream.budgets {
+			if _, ok := remaining[budget]; ok {
+				continue
+			}
+			limit := budget.bytesPerSecond(now)
+			if limit <= 0 {
+				continue // Unlimited budgets do not hold back their streams
+			}
+			remaining[budget] = float64(limit)
+		}
+	}
+
+	rates := make(map[*bandwidthStream]float64, len(streams))
+	for len(remaining) > 0 {
+		var tightest *bandwidth
+		level := 0.0
+		for budget, capacity := range remaining {
+			unfixed := 0
+			for stream := range budget.streams {
+				if _, ok := rates[stream]; !ok {
+					unfixed++
+				}
+			}
+			if unfixed == 0 {
+				delete(remaining, budget)
+				continue
+			}
+			// Rounding may leave a budget just below zero, a zero rate would be unlimited
+			share := max(capacity, 1) / float64(unfixed)
+			if tightest == nil || share < level {
+				tightest, level = budget, share
+			}
+		}
+		if tightest == nil {
+			break
+		}
+
+		for stream := range tightest.streams {
+			if _, ok := rates[stream]; ok {
+				continue
+			}
+			rates[stream] = level
+			for _, budget := range stream.budgets {
+				if _, ok := remaining[budget]; ok {
+					remaining[budget] -= level
+				}
+			}
+		}
+		delete(remaining, tightest)
+	}
+	return rates
+}
+
+func (s *bandwidthStream) writer(w io.Writer) io.Writer {
+	return s.pacer.Writer(w)
+}
+
+func (s *bandwidthStream) reader(r io.Reader) io.Reader {
+	return s.pacer.Reader(r)
+}
+
+// joinBandwidth adds a stream of the request to the bandwidth budget of the server, and to that of its
+// principal when it has one. The stream stops waiting when the context is done, and has to leave when it is done.
+func (h *HTTP) joinBandwidth(ctx context.Context, req *http.Request) *bandwidthStream {
+	budgets := []*bandwidth{h.bandwidth}
+	name := principal(req)
+	if name != "" {
+		budgets = append(budgets, h.principalBandwidth(name))
+	}
+	return h.bandwidthPool.join(ctx, budgets...)
+}
+
+// principalBandwidth returns the bandwidth budget of the principal, its policy sets the initial limit
+func (h *HTTP) principalBandwidth(name string) *bandwidth {
+	h.bandwidthMutex.Lock()
+	defer h.bandwidthMutex.Unlock()
+
+	budget, ok := h.principalBandwidths[name]
+	if !ok {
+		budget = h.bandwidthPool.budget(h.config.Policies[name].BandwidthBytesPerSecond, zfs.BandwidthSchedule{})
+		h.principalBandwidths[name] = budget
+	}
+	return budget
+}
+
+// SetBandwidthLimit changes the bandwidth budget shared by all sends and receives of the server while it runs,
+// set to zero to disable it. It replaces the bandwidth schedule.
+func (h *HTTP) SetBandwidthLimit(bytesPerSecond int64) {
+	h.bandwidth.setLimit(bytesPerSecond)
+}
+
+// SetBandwidthSchedule changes the bandwidth budget shared by all sends and receives of the server to follow
+// the schedule while it runs. It replaces the fixed bandwidth limit.
+func (h *HTTP) SetBandwidthSchedule(schedule zfs.BandwidthSchedule) {
+	h.bandwidth.setSchedule(schedule)
+}
+
+// SetPrincipalBandwidthLimit changes the bandwidth budget shared by the sends and receives of the principal
+// while the server runs, overriding the budget of its policy. Set to zero to disable it.
+func (h *HTTP) SetPrincipalBandwidthLimit(principal string, bytesPerSecond int64) {
+	h.principalBandwidth(principal).setLimit(bytesPerSecond)
+}
@@ -0,0 +1,147 @@
+package http
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+func TestBandwidth_share(t *testing.T) {
+	pool := newBandwidthPool()
+	budget := pool.budget(300, zfs.BandwidthSchedule{})
+	require.EqualValues(t, 300, budget.bytesPerSecond(time.Now()))
+
+	first := pool.join(context.Background(), budget)
+	second := pool.join(context.Background(), budget)
+	third := pool.join(context.Background(), budget)
+	require.Equal(t, 100.0, first.rate())
+
+	third.leave()
+	require.Equal(t, 150.0, second.rate())
+
+	// A stream held back by another budget leaves the rest of its share to the others
+	principal := pool.budget(50, zfs.BandwidthSchedule{})
+	limited := pool.join(context.Background(), budget, principal)
+	require.Equal(t, 50.0, limited.rate())
+	require.Equal(t, 125.0, first.rate())
+	require.Equal(t, 125.0, second.rate())
+
+	budget.setLimit(0)
+	require.Zero(t, first.rate())
+	require.Equal(t, 50.0, limited.rate())
+
+	// A schedule replaces the fixed budget
+	budget.setSchedule(zfs.BandwidthSchedule{Default: 600})
+	require.Equal(t, 275.0, first.rate())
+	require.NotZero(t, pool.expires.Load(), "the rates follow the schedule")
+	budget.setLimit(900)
+	require.True(t, budget.schedule.IsZero())
+	require.Zero(t, pool.expires.Load())
+	require.Equal(t, 425.0, first.rate())
+
+	// Without held back streams the budget is divided equally
+	principal.setLimit(600)
+	require.Equal(t, 300.0, first.rate())
+	require.Equal(t, 300.0, limited.rate())
+}
+
+func TestBandwidth_scheduleExpires(t *testing.T) {
+	pool := newBandwidthPool()
+	budget := pool.budget(0, zfs.BandwidthSchedule{Default: 600})
+	stream := pool.join(context.Background(), budget)
+	defer stream.leave()
+	require.Equal(t, 600.0, stream.rate())
+
+	// Change the schedule behind the back of the pool, it is only picked up once the rates expire
+	budget.mutex.Lock()
+	budget.schedule = zfs.BandwidthSchedule{Default: 300}
+	budget.mutex.Unlock()
+	require.Equal(t, 600.0, stream.rate())
+
+	pool.expires.Store(time.Now().Add(-time.Second).UnixNano())
+	require.Equal(t, 300.0, stream.rate())
+}
+
+func Test_fairRates(t *testing.T) {
+	pool := newBandwidthPool()
+	global := pool.budget(1000, zfs.BandwidthSchedule{})
+	tenantA := pool.budget(100, zfs.BandwidthSchedule{})
+	tenantB := pool.budget(600, zfs.BandwidthSchedule{})
+
+	a1 := pool.join(context.Background(), global, tenantA)
+	a2 := pool.join(context.Background(), global, tenantA)
+	b1 := pool.join(context.Background(), global, tenantB)
+	anonymous := pool.join(context.Background(), global)
+	unlimited := pool.join(context.Background(), pool.budget(0, zfs.BandwidthSchedule{}))
+
+	pool.mutex.Lock()
+	rates := fairRates(pool.streams, time.Now())
+	pool.mutex.Unlock()
+	// Tenant A is held back to 100, the other 900 is divided between b1 and the anonymous stream
+	require.Equal(t, map[*bandwidthStream]float64{a1: 50, a2: 50, b1: 450, anonymous: 450}, rates)
+	require.Zero(t, unlimited.rate())
+
+	var total float64
+	for _, rate := range rates {
+		total += rate
+	}
+	require.Equal(t, 1000.0, total, "the whole budget is used")
+}
+
+func TestBandwidth_stream(t *testing.T) {
+	// The pacing itself is tested with the pacer, this checks the stream follows its budget and context
+	pool := newBandwidthPool()
+	stream := pool.join(context.Background(), pool.budget(0, zfs.BandwidthSchedule{}))
+	defer stream.leave()
+
+	n, err := io.Copy(io.Discard, stream.reader(io.LimitReader(neverEnding('a'), 10*1024*1024)))
+	require.NoError(t, err)
+	require.EqualValues(t, 10*1024*1024, n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := pool.join(ctx, pool.budget(1, zfs.BandwidthSchedule{}))
+	defer canceled.leave()
+	_, err = canceled.writer(io.Discard).Write([]byte("hello"))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBandwidth_principal(t *testing.T) {
+	conf := Config{BandwidthBytesPerSecond: 1000}
+	conf.Policies = map[string]Policy{"backup": {BandwidthBytesPerSecond: 200}}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	anonymous := h.joinBandwidth(req.Context(), req)
+	require.Len(t, anonymous.budgets, 1)
+	require.Equal(t, 1000.0, anonymous.rate())
+
+	req = req.WithContext(ContextWithIdentity(req.Context(), &Identity{Principal: "backup"}))
+	stream := h.joinBandwidth(req.Context(), req)
+	require.Equal(t, 200.0, stream.rate())
+	require.Equal(t, 800.0, anonymous.rate(), "the share the principal cannot use goes to the others")
+
+	h.SetPrincipalBandwidthLimit("backup", 0)
+	require.Equal(t, 500.0, stream.rate())
+	h.SetBandwidthLimit(4000)
+	require.Equal(t, 2000.0, stream.rate())
+
+	stream.leave()
+	require.Equal(t, 4000.0, anonymous.rate())
+}
+
+type neverEnding byte
+
+func (b neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
@@ -9,11 +9,16 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+
 	zfs "github.com/vansante/go-zfsutils"
 )
 
@@ -21,9 +26,51 @@ var (
 	ErrInvalidResumeToken = errors.New("invalid resume token given")
 	ErrResumeNotPossible  = errors.New("resume not possible")
 	ErrTooManyRequests    = errors.New("too many requests")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrReceiveNotFound    = errors.New("receive not found")
+	ErrForbidden          = errors.New("forbidden")
+)
+
+const (
+	clientUserAgent = "go-zfsutils@%s"
+
+	defaultMaxRetries = 3
+	defaultMaxBackoff = 5 * time.Minute
 )
 
-const clientUserAgent = "go-zfsutils@%s"
+// RetryAfterError is returned when the server refused a request and asked to retry it later
+type RetryAfterError struct {
+	Err error
+	// RetryAfter is how long the server asked to wait, zero when it did not say
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	if e.RetryAfter <= 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter parses a Retry-After header in seconds, the HTTP date form is supported as well
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	return max(date.Sub(now), 0)
+}
 
 // Client is the struct used to send requests to a zfs http server
 type Client struct {
@@ -31,6 +78,16 @@ type Client struct {
 	headers map[string]string
 	logger  *slog.Logger
 	client  *http.Client
+
+	codecs       []zfs.Codec
+	serverCodecs []zfs.Codec
+	codecsMutex  sync.Mutex
+
+	hmacKeyID  string
+	hmacSecret string
+
+	maxRetries int
+	maxBackoff time.Duration
 }
 
 // NewClient creates a new client for a zfs http server
@@ -40,6 +97,10 @@ func NewClient(server string, logger *slog.Logger) *Client {
 		headers: make(map[string]string, 8),
 		logger:  logger,
 		client:  http.DefaultClient,
+		codecs:  zfs.SupportedCodecs,
+
+		maxRetries: defaultMaxRetries,
+		maxBackoff: defaultMaxBackoff,
 	}
 	host, _ := os.Hostname()
 	client.headers["User-Agent"] = fmt.Sprintf(
@@ -60,11 +121,174 @@ func (c *Client) SetHeader(name, value string) {
 	c.headers[name] = value
 }
 
+// SetBearerToken configures a bearer token to authenticate all requests with
+func (c *Client) SetBearerToken(token string) {
+	c.headers["Authorization"] = fmt.Sprintf("%s %s", authSchemeBearer, token)
+}
+
+// SetHMACKey configures a key to sign all requests with, see AuthenticationConfig.HMACKeys.
+// Snapshot streams are not hashed, so only send them to an https server.
+func (c *Client) SetHMACKey(keyID, secret string) {
+	c.hmacKeyID = keyID
+	c.hmacSecret = secret
+}
+
+// SetRetries configures how often a send refused with 429 Too Many Requests is retried, and the maximum
+// time to wait between attempts. The client waits as long as the Retry-After header of the server asks, or
+// backs off exponentially when the server did not say. Set maxRetries to zero to disable retries.
+func (c *Client) SetRetries(maxRetries int, maxBackoff time.Duration) {
+	c.maxRetries = maxRetries
+	c.maxBackoff = maxBackoff
+}
+
+// backoff returns how long to wait before the next attempt
+func (c *Client) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	wait := time.Second << min(attempt, 16)
+	if retryAfter > 0 {
+		wait = retryAfter
+	}
+	return min(wait, c.maxBackoff)
+}
+
+// retry runs the send until it succeeds, fails with another error than a RetryAfterError,
+// or runs out of attempts
+func (c *Client) retry(ctx context.Context, send func() (SendResult, error)) (SendResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := send()
+		var retryErr *RetryAfterError
+		if !errors.As(err, &retryErr) || attempt >= c.maxRetries {
+			return result, err
+		}
+
+		wait := c.backoff(attempt, retryErr.RetryAfter)
+		c.logger.Info("zfs.http.Client.retry: Server busy, retrying",
+			"server", c.server,
+			"attempt", attempt+1,
+			"wait", wait,
+		)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+	}
+}
+
 // Server returns the server
 func (c *Client) Server() string {
 	return c.server
 }
 
+// SetCodecPreference configures the codecs that may be negotiated for zfs.CodecAuto, in order of preference
+func (c *Client) SetCodecPreference(codecs ...zfs.Codec) {
+	c.codecsMutex.Lock()
+	defer c.codecsMutex.Unlock()
+	c.codecs = codecs
+}
+
+// ServerCodecs requests the compression codecs the server supports. The result is cached after the first
+// successful request. Servers that predate codec negotiation only support zstd through the legacy parameter,
+// for those an empty list is returned.
+func (c *Client) ServerCodecs(ctx context.Context) ([]zfs.Codec, error) {
+	c.codecsMutex.Lock()
+	defer c.codecsMutex.Unlock()
+	if c.serverCodecs != nil {
+		return c.serverCodecs, nil
+	}
+
+	req, err := c.request(ctx, http.MethodGet, "codecs", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting codecs: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Continue
+	case http.StatusNotFound:
+		c.serverCodecs = []zfs.Codec{}
+		return c.serverCodecs, nil
+	default:
+		return nil, fmt.Errorf("error requesting codecs: %w", responseError(resp))
+	}
+
+	var codecs []zfs.Codec
+	err = json.NewDecoder(resp.Body).Decode(&codecs)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding codecs: %w", err)
+	}
+	c.serverCodecs = codecs
+	return codecs, nil
+}
+
+// negotiateCompression resolves zfs.CodecAuto into the most preferred codec the server supports.
+// When there is none, the codec is cleared so the legacy zstd compression level applies.
+func (c *Client) negotiateCompression(ctx context.Context, compression zfs.CompressionOptions) (zfs.CompressionOptions, error) {
+	if compression.Codec != zfs.CodecAuto {
+		return compression, nil
+	}
+
+	serverCodecs, err := c.ServerCodecs(ctx)
+	if err != nil {
+		return compression, err
+	}
+
+	c.codecsMutex.Lock()
+	defer c.codecsMutex.Unlock()
+	compression.Codec = ""
+	for _, codec := range c.codecs {
+		if slices.Contains(serverCodecs, codec) {
+			compression.Codec = codec
+			break
+		}
+	}
+	return compression, nil
+}
+
+// setStreamEncoding announces the codec of the stream body to the server. The legacy enable decompression
+// parameter is set as well for zstd, so servers that predate codec negotiation can receive it.
+func setStreamEncoding(req *http.Request, level zstd.EncoderLevel, compression zfs.CompressionOptions) {
+	codec := compression.Codec
+	if codec == "" && level > 0 {
+		codec = zfs.CodecZstd
+	}
+
+	q := req.URL.Query()
+	q.Set(GETParamEnableDecompression, strconv.FormatBool(codec == zfs.CodecZstd))
+	req.URL.RawQuery = q.Encode()
+
+	if codec != "" && codec != zfs.CodecNone {
+		req.Header.Set(HeaderStreamEncoding, string(codec))
+	}
+}
+
+// setExpectedSize announces the expected size of a stream, so the server can refuse it up front
+func setExpectedSize(req *http.Request, size uint64) {
+	if size > 0 {
+		req.Header.Set(HeaderExpectedSize, strconv.FormatUint(size, 10))
+	}
+}
+
+// escapeDataset escapes a dataset path as a single URL path segment,
+// so a nested path like customers/acme/db is sent as customers%2Facme%2Fdb
+func escapeDataset(name string) string {
+	return url.PathEscape(name)
+}
+
+// datasetCollection returns the path the server serves datasets of the type under
+func datasetCollection(datasetType zfs.DatasetType) string {
+	if datasetType == zfs.DatasetVolume {
+		return "volumes"
+	}
+	return "filesystems"
+}
+
 func (c *Client) request(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/%s", c.server, url), body)
 	if err != nil {
@@ -73,13 +297,72 @@ func (c *Client) request(ctx context.Context, method, url string, body io.Reader
 	for hdr := range c.headers {
 		req.Header.Set(hdr, c.headers[hdr])
 	}
+	err = c.sign(req)
+	if err != nil {
+		return nil, err
+	}
 	return req, nil
 }
 
+// sign adds a HMAC signature to the request when a key is configured.
+// It must be called again when the URL of the request changes.
+func (c *Client) sign(req *http.Request) error {
+	if c.hmacKeyID == "" {
+		return nil
+	}
+	return signHMAC(req, c.hmacKeyID, c.hmacSecret, time.Now())
+}
+
+// ListFilesystems requests the filesystems on the remote server
+func (c *Client) ListFilesystems(ctx context.Context, extraProps []string) ([]zfs.Dataset, error) {
+	return c.listDatasets(ctx, datasetCollection(zfs.DatasetFilesystem), extraProps)
+}
+
+// ListVolumes requests the volumes on the remote server
+func (c *Client) ListVolumes(ctx context.Context, extraProps []string) ([]zfs.Dataset, error) {
+	return c.listDatasets(ctx, datasetCollection(zfs.DatasetVolume), extraProps)
+}
+
+func (c *Client) listDatasets(ctx context.Context, collection string, extraProps []string) ([]zfs.Dataset, error) {
+	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s?%s=%s",
+		collection,
+		GETParamExtraProperties, strings.Join(extraProps, ","),
+	), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting remote %s: %w", collection, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Continue
+	default:
+		return nil, fmt.Errorf("error requesting remote %s: %w", collection, responseError(resp))
+	}
+
+	var datasets []zfs.Dataset
+	err = json.NewDecoder(resp.Body).Decode(&datasets)
+	return datasets, err
+}
+
 // DatasetSnapshots requests the snapshots for a remote dataset
 func (c *Client) DatasetSnapshots(ctx context.Context, dataset string, extraProps []string) ([]zfs.Dataset, error) {
-	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("filesystems/%s/snapshots?%s=%s",
-		dataset,
+	return c.datasetSnapshots(ctx, datasetCollection(zfs.DatasetFilesystem), dataset, extraProps)
+}
+
+// VolumeSnapshots requests the snapshots for a remote volume
+func (c *Client) VolumeSnapshots(ctx context.Context, volume string, extraProps []string) ([]zfs.Dataset, error) {
+	return c.datasetSnapshots(ctx, datasetCollection(zfs.DatasetVolume), volume, extraProps)
+}
+
+func (c *Client) datasetSnapshots(ctx context.Context, collection, dataset string, extraProps []string) ([]zfs.Dataset, error) {
+	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s/%s/snapshots?%s=%s",
+		collection, escapeDataset(dataset),
 		GETParamExtraProperties, strings.Join(extraProps, ","),
 	), nil)
 	if err != nil {
@@ -95,10 +378,8 @@ func (c *Client) DatasetSnapshots(ctx context.Context, dataset string, extraProp
 	switch resp.StatusCode {
 	case http.StatusOK:
 		// Continue
-	case http.StatusNotFound:
-		return nil, zfs.ErrDatasetNotFound
 	default:
-		return nil, fmt.Errorf("unexpected status %d requesting remote snapshots", resp.StatusCode)
+		return nil, fmt.Errorf("error requesting remote snapshots: %w", responseError(resp))
 	}
 
 	var datasets []zfs.Dataset
@@ -108,8 +389,17 @@ func (c *Client) DatasetSnapshots(ctx context.Context, dataset string, extraProp
 
 // ResumableSendToken requests the resume token for a remote dataset, if there is one
 func (c *Client) ResumableSendToken(ctx context.Context, dataset string) (token string, curBytes uint64, err error) {
-	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("filesystems/%s/resume-token",
-		dataset,
+	return c.resumableSendToken(ctx, datasetCollection(zfs.DatasetFilesystem), dataset)
+}
+
+// VolumeResumableSendToken requests the resume token for a remote volume, if there is one
+func (c *Client) VolumeResumableSendToken(ctx context.Context, volume string) (token string, curBytes uint64, err error) {
+	return c.resumableSendToken(ctx, datasetCollection(zfs.DatasetVolume), volume)
+}
+
+func (c *Client) resumableSendToken(ctx context.Context, collection, dataset string) (token string, curBytes uint64, err error) {
+	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s/%s/resume-token",
+		collection, escapeDataset(dataset),
 	), nil)
 	if err != nil {
 		return "", 0, fmt.Errorf("error creating token request: %w", err)
@@ -119,25 +409,53 @@ func (c *Client) ResumableSendToken(ctx context.Context, dataset string) (token
 	if err != nil {
 		return "", 0, fmt.Errorf("error requesting resume token: %w", err)
 	}
-	_ = resp.Body.Close()
+	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusNoContent:
 		curBytes, _ = strconv.ParseUint(resp.Header.Get(HeaderResumeReceivedBytes), 10, 64)
 		return resp.Header.Get(HeaderResumeReceiveToken), curBytes, nil
-	case http.StatusNotFound:
-		return "", 0, zfs.ErrDatasetNotFound
 	case http.StatusPreconditionFailed:
 		return "", 0, nil // Nothing to resume
 	default:
-		return "", 0, fmt.Errorf("unexpected status %d requesting resume token", resp.StatusCode)
+		return "", 0, fmt.Errorf("error requesting resume token: %w", responseError(resp))
+	}
+}
+
+// AbortResumableReceive discards the partially received state of an interrupted resumable receive into the
+// remote dataset, so the next send starts over. It returns ErrResumeNotPossible when there is nothing to abort.
+func (c *Client) AbortResumableReceive(ctx context.Context, dataset string) error {
+	return c.abortResumableReceive(ctx, datasetCollection(zfs.DatasetFilesystem), dataset)
+}
+
+// VolumeAbortResumableReceive discards the partially received state of an interrupted resumable receive into
+// the remote volume
+func (c *Client) VolumeAbortResumableReceive(ctx context.Context, volume string) error {
+	return c.abortResumableReceive(ctx, datasetCollection(zfs.DatasetVolume), volume)
+}
+
+func (c *Client) abortResumableReceive(ctx context.Context, collection, dataset string) error {
+	req, err := c.request(ctx, http.MethodDelete, fmt.Sprintf("%s/%s/resume-token",
+		collection, escapeDataset(dataset),
+	), nil)
+	if err != nil {
+		return fmt.Errorf("error creating abort request: %w", err)
 	}
+	return c.noContentResponse(req)
 }
 
 // ResumeSendOptions is a struct for a resume of a send job to a remote server using a Client
 type ResumeSendOptions struct {
 	zfs.ResumeSendOptions
 
+	// DatasetType is the type of the remote dataset, filesystem when empty
+	DatasetType zfs.DatasetType
+
+	// ExpectedSize is sent to the server, so it can refuse a receive that does not fit up front. Zero omits it.
+	ExpectedSize uint64
+	// EstimateSize sets the ExpectedSize to the estimate of zfs send, when it is zero
+	EstimateSize bool
+
 	// ProgressFn: Set a callback function to receive updates about progress
 	ProgressFn zfs.ProgressCallback
 	// ProgressEvery determines progress update interval
@@ -146,6 +464,24 @@ type ResumeSendOptions struct {
 
 // ResumeSend resumes a send for a dataset given the resume token
 func (c *Client) ResumeSend(ctx context.Context, dataset, resumeToken string, options ResumeSendOptions) (SendResult, error) {
+	var err error
+	options.Compression, err = c.negotiateCompression(ctx, options.Compression)
+	if err != nil {
+		return SendResult{}, fmt.Errorf("error negotiating codec: %w", err)
+	}
+	if options.EstimateSize && options.ExpectedSize == 0 {
+		options.ExpectedSize, err = zfs.ResumeSendSize(ctx, resumeToken)
+		if err != nil {
+			return SendResult{}, fmt.Errorf("error estimating send size: %w", err)
+		}
+	}
+
+	return c.retry(ctx, func() (SendResult, error) {
+		return c.resumeSend(ctx, dataset, resumeToken, options)
+	})
+}
+
+func (c *Client) resumeSend(ctx context.Context, dataset, resumeToken string, options ResumeSendOptions) (SendResult, error) {
 	pipeRdr, pipeWrtr := io.Pipe()
 
 	sendCtx, cancelSend := context.WithCancel(ctx)
@@ -173,10 +509,11 @@ func (c *Client) ResumeSend(ctx context.Context, dataset, resumeToken string, op
 	startTime := time.Now()
 	countReader := zfs.NewCountReader(pipeRdr)
 	countReader.SetProgressCallback(options.ProgressEvery, options.ProgressFn)
-	req, err := c.request(ctx, http.MethodPut, fmt.Sprintf("filesystems/%s/snapshots?%s=%s&%s=%s",
-		dataset,
+	req, err := c.request(ctx, http.MethodPut, fmt.Sprintf("%s/%s/snapshots?%s=%s&%s=%s&%s=%s",
+		datasetCollection(options.DatasetType), escapeDataset(dataset),
 		GETParamResumable, "true",
-		GETParamEnableDecompression, strconv.FormatBool(options.CompressionLevel > 0),
+		GETParamFramed, strconv.FormatBool(options.Framed),
+		GETParamEncrypted, strconv.FormatBool(options.EncryptionKey != nil),
 	), countReader)
 	if err != nil {
 		cancelSend()
@@ -185,6 +522,13 @@ func (c *Client) ResumeSend(ctx context.Context, dataset, resumeToken string, op
 			TimeTaken: time.Since(startTime),
 		}, fmt.Errorf("error creating resume request: %w", err)
 	}
+	setStreamEncoding(req, options.CompressionLevel, options.Compression)
+	setExpectedSize(req, options.ExpectedSize)
+	err = c.sign(req)
+	if err != nil {
+		cancelSend()
+		return SendResult{}, fmt.Errorf("error signing resume request: %w", err)
+	}
 
 	err = c.doSendStream(req, pipeWrtr, cancelSend)
 	return SendResult{
@@ -199,6 +543,8 @@ type SnapshotSendOptions struct {
 
 	// Which dataset to send to
 	DatasetName string
+	// DatasetType is the type of the dataset to send to, filesystem when empty
+	DatasetType zfs.DatasetType
 	// Which snapshot to send to (optional)
 	SnapshotName string
 	// The snapshot to send
@@ -207,6 +553,10 @@ type SnapshotSendOptions struct {
 	Resumable bool
 	// ReceiveForceRollback sets whether the receiving dataset is rolled back to the received snapshot
 	ReceiveForceRollback bool
+	// ExpectedSize is sent to the server, so it can refuse a receive that does not fit up front. Zero omits it.
+	ExpectedSize uint64
+	// EstimateSize sets the ExpectedSize to the estimate of zfs send, when it is zero
+	EstimateSize bool
 
 	// Properties are set on the receiving dataset (filesystem usually)
 	Properties ReceiveProperties
@@ -225,6 +575,24 @@ type SendResult struct {
 
 // Send sends the snapshot job to the remote server
 func (c *Client) Send(ctx context.Context, send SnapshotSendOptions) (SendResult, error) {
+	var err error
+	send.Compression, err = c.negotiateCompression(ctx, send.Compression)
+	if err != nil {
+		return SendResult{}, fmt.Errorf("error negotiating codec: %w", err)
+	}
+	if send.EstimateSize && send.ExpectedSize == 0 {
+		send.ExpectedSize, err = send.Snapshot.SendSize(ctx, send.SendOptions)
+		if err != nil {
+			return SendResult{}, fmt.Errorf("error estimating send size: %w", err)
+		}
+	}
+
+	return c.retry(ctx, func() (SendResult, error) {
+		return c.send(ctx, send)
+	})
+}
+
+func (c *Client) send(ctx context.Context, send SnapshotSendOptions) (SendResult, error) {
 	pipeRdr, pipeWrtr := io.Pipe()
 
 	sendCtx, cancelSend := context.WithCancel(ctx)
@@ -249,9 +617,10 @@ func (c *Client) Send(ctx context.Context, send SnapshotSendOptions) (SendResult
 		}
 	}()
 
-	url := fmt.Sprintf("filesystems/%s/snapshots", send.DatasetName)
+	collection := datasetCollection(send.DatasetType)
+	url := fmt.Sprintf("%s/%s/snapshots", collection, escapeDataset(send.DatasetName))
 	if send.SnapshotName != "" {
-		url = fmt.Sprintf("filesystems/%s/snapshots/%s", send.DatasetName, send.SnapshotName)
+		url = fmt.Sprintf("%s/%s/snapshots/%s", collection, escapeDataset(send.DatasetName), send.SnapshotName)
 	}
 
 	startTime := time.Now()
@@ -264,12 +633,20 @@ func (c *Client) Send(ctx context.Context, send SnapshotSendOptions) (SendResult
 	}
 	q := req.URL.Query()
 	q.Set(GETParamResumable, strconv.FormatBool(send.Resumable))
-	q.Set(GETParamEnableDecompression, strconv.FormatBool(send.CompressionLevel > 0))
 	q.Set(GETParamForceRollback, strconv.FormatBool(send.ReceiveForceRollback))
+	q.Set(GETParamFramed, strconv.FormatBool(send.Framed))
+	q.Set(GETParamEncrypted, strconv.FormatBool(send.EncryptionKey != nil))
 	if len(send.Properties) > 0 {
 		q.Set(GETParamReceiveProperties, send.Properties.Encode())
 	}
 	req.URL.RawQuery = q.Encode() // Add new GET params
+	setStreamEncoding(req, send.CompressionLevel, send.Compression)
+	setExpectedSize(req, send.ExpectedSize)
+	err = c.sign(req)
+	if err != nil {
+		cancelSend()
+		return SendResult{}, fmt.Errorf("error signing incremental send request: %w", err)
+	}
 	err = c.doSendStream(req, pipeWrtr, cancelSend)
 	result := SendResult{
 		BytesSent: countReader.Count(),
@@ -292,68 +669,412 @@ func (c *Client) doSendStream(req *http.Request, pipeWrtr *io.PipeWriter, cancel
 		return fmt.Errorf("error closing transfer pipe: %w", err)
 	}
 
-	switch resp.StatusCode {
-	case http.StatusCreated:
-		return nil
-	case http.StatusNotFound:
-		return zfs.ErrDatasetNotFound
-	case http.StatusConflict:
-		return zfs.ErrDatasetExists
-	case http.StatusExpectationFailed:
-		return ErrInvalidResumeToken
-	case http.StatusPreconditionFailed:
-		return ErrResumeNotPossible
-	case http.StatusTooManyRequests:
-		return ErrTooManyRequests
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// FetchOptions configures the download of a snapshot stream from the remote server
+type FetchOptions struct {
+	// DatasetType is the type of the remote dataset, filesystem when empty
+	DatasetType zfs.DatasetType
+	// BytesPerSecond overrides the speed limit of the server, which requires the AllowSpeedOverride permission
+	BytesPerSecond int64
+	// IncludeProperties includes the dataset properties, which requires the AllowIncludeProperties permission
+	IncludeProperties bool
+	// Raw requests a raw stream. Without the AllowNonRaw permission streams are always raw.
+	Raw bool
+	// Codec requests a compressed stream, zfs.CodecAuto picks the most preferred codec the server supports
+	Codec zfs.Codec
+	// Framed requests a framed stream, see zfs.NewFrameWriter
+	Framed bool
+	// Encrypted requests a stream encrypted with the stream key of the server
+	Encrypted bool
+}
+
+// SnapshotStream is a snapshot stream downloaded from the remote server. It has to be closed.
+type SnapshotStream struct {
+	io.ReadCloser
+
+	// Codec is the compression codec of the stream
+	Codec zfs.Codec
+}
+
+// FetchSnapshot downloads a full stream of the snapshot of the remote dataset
+func (c *Client) FetchSnapshot(ctx context.Context, dataset, snapshot string, options FetchOptions) (*SnapshotStream, error) {
+	return c.fetch(ctx, fmt.Sprintf("%s/%s/snapshots/%s",
+		datasetCollection(options.DatasetType), escapeDataset(dataset), snapshot,
+	), options)
+}
+
+// FetchIncrementalSnapshot downloads an incremental stream from the base snapshot to the snapshot of the remote dataset
+func (c *Client) FetchIncrementalSnapshot(ctx context.Context, dataset, baseSnapshot, snapshot string,
+	options FetchOptions,
+) (*SnapshotStream, error) {
+	return c.fetch(ctx, fmt.Sprintf("%s/%s/snapshots/%s/incremental/%s",
+		datasetCollection(options.DatasetType), escapeDataset(dataset), snapshot, baseSnapshot,
+	), options)
+}
+
+// FetchResumeSnapshot downloads the remainder of a stream that was interrupted, given the resume token of the
+// local receive
+func (c *Client) FetchResumeSnapshot(ctx context.Context, resumeToken string, options FetchOptions) (*SnapshotStream, error) {
+	return c.fetch(ctx, fmt.Sprintf("snapshot/resume/%s", resumeToken), options)
+}
+
+func (c *Client) fetch(ctx context.Context, path string, options FetchOptions) (*SnapshotStream, error) {
+	q := url.Values{}
+	if options.BytesPerSecond > 0 {
+		q.Set(GETParamBytesPerSecond, strconv.FormatInt(options.BytesPerSecond, 10))
+	}
+	q.Set(GETParamIncludeProperties, strconv.FormatBool(options.IncludeProperties))
+	q.Set(GETParamRaw, strconv.FormatBool(options.Raw))
+	q.Set(GETParamFramed, strconv.FormatBool(options.Framed))
+	q.Set(GETParamEncrypted, strconv.FormatBool(options.Encrypted))
+
+	req, err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s?%s", path, q.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating fetch request: %w", err)
+	}
+	switch options.Codec {
+	case "":
+		// No compression
+	case zfs.CodecAuto:
+		c.codecsMutex.Lock()
+		req.Header.Set(HeaderAcceptStreamEncoding, formatCodecList(c.codecs))
+		c.codecsMutex.Unlock()
 	default:
-		return fmt.Errorf("unexpected status %d sending stream, server error: %s", resp.StatusCode, resp.Header.Get(HeaderError))
+		req.Header.Set(HeaderAcceptStreamEncoding, string(options.Codec))
 	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting stream: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	codec := zfs.CodecNone
+	if encoding := resp.Header.Get(HeaderStreamEncoding); encoding != "" {
+		codec, err = zfs.ParseCodec(encoding)
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("error parsing stream encoding: %w", err)
+		}
+	}
+	return &SnapshotStream{ReadCloser: resp.Body, Codec: codec}, nil
+}
+
+// SnapshotReceiveOptions is a struct for a receive of a remote snapshot into a local dataset using a Client
+type SnapshotReceiveOptions struct {
+	FetchOptions
+
+	// DatasetName is the remote dataset to receive from
+	DatasetName string
+	// SnapshotName is the remote snapshot to receive
+	SnapshotName string
+	// IncrementalBase is the remote snapshot to receive an incremental stream from (optional)
+	IncrementalBase string
+	// ResumeToken resumes an interrupted receive instead, the remote dataset and snapshots are ignored
+	ResumeToken string
+
+	// LocalName is the local dataset or snapshot to receive into
+	LocalName string
+	// ReceiveOptions configure the local receive. The decompression and framing follow from the stream.
+	ReceiveOptions zfs.ReceiveOptions
+
+	// ProgressFn: Set a callback function to receive updates about progress
+	ProgressFn zfs.ProgressCallback
+	// ProgressEvery determines progress update interval
+	ProgressEvery time.Duration
+}
+
+// ReceiveResult contains the received dataset and some statistics from the receiving of a snapshot
+type ReceiveResult struct {
+	Dataset       *zfs.Dataset
+	BytesReceived int64
+	TimeTaken     time.Duration
+}
+
+// Receive downloads a snapshot stream from the remote server and receives it into a local dataset
+func (c *Client) Receive(ctx context.Context, receive SnapshotReceiveOptions) (ReceiveResult, error) {
+	var stream *SnapshotStream
+	var err error
+	switch {
+	case receive.ResumeToken != "":
+		stream, err = c.FetchResumeSnapshot(ctx, receive.ResumeToken, receive.FetchOptions)
+	case receive.IncrementalBase != "":
+		stream, err = c.FetchIncrementalSnapshot(ctx, receive.DatasetName, receive.IncrementalBase,
+			receive.SnapshotName, receive.FetchOptions,
+		)
+	default:
+		stream, err = c.FetchSnapshot(ctx, receive.DatasetName, receive.SnapshotName, receive.FetchOptions)
+	}
+	if err != nil {
+		return ReceiveResult{}, err
+	}
+	defer stream.Close()
+
+	startTime := time.Now()
+	countReader := zfs.NewCountReader(stream)
+	countReader.SetProgressCallback(receive.ProgressEvery, receive.ProgressFn)
+
+	options := receive.ReceiveOptions
+	options.Decompression = zfs.CompressionOptions{Codec: stream.Codec}
+	options.Framed = receive.Framed
+	ds, err := zfs.ReceiveSnapshot(ctx, countReader, receive.LocalName, options)
+	result := ReceiveResult{
+		Dataset:       ds,
+		BytesReceived: countReader.Count(),
+		TimeTaken:     time.Since(startTime),
+	}
+	if err != nil {
+		return result, fmt.Errorf("error receiving stream into %s: %w", receive.LocalName, err)
+	}
+	return result, nil
 }
 
 // SetFilesystemProperties sets and/or unsets properties on the remote zfs filesystem
 func (c *Client) SetFilesystemProperties(ctx context.Context, filesystem string, props SetProperties) error {
+	return c.setDatasetProperties(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, props)
+}
+
+// SetVolumeProperties sets and/or unsets properties on the remote zfs volume
+func (c *Client) SetVolumeProperties(ctx context.Context, volume string, props SetProperties) error {
+	return c.setDatasetProperties(ctx, datasetCollection(zfs.DatasetVolume), volume, props)
+}
+
+func (c *Client) setDatasetProperties(ctx context.Context, collection, dataset string, props SetProperties) error {
 	payload, err := json.Marshal(&props)
 	if err != nil {
 		return fmt.Errorf("error encoding payload json: %w", err)
 	}
 
-	req, err := c.request(ctx, http.MethodPatch, fmt.Sprintf("filesystems/%s",
-		filesystem,
+	req, err := c.request(ctx, http.MethodPatch, fmt.Sprintf("%s/%s",
+		collection, escapeDataset(dataset),
 	), bytes.NewBuffer(payload))
 	if err != nil {
 		return fmt.Errorf("error creating property request: %w", err)
 	}
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error sending request: %w", err)
-	}
-	_ = resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
-	}
-	return nil
+	_, err = c.datasetResponse(req, http.StatusOK)
+	return err
 }
 
 // SetSnapshotProperties sets and/or unsets properties on the remote zfs snapshot
 func (c *Client) SetSnapshotProperties(ctx context.Context, filesystem, snapshot string, props SetProperties) error {
+	return c.setSnapshotProperties(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, snapshot, props)
+}
+
+// SetVolumeSnapshotProperties sets and/or unsets properties on the remote zfs snapshot of a volume
+func (c *Client) SetVolumeSnapshotProperties(ctx context.Context, volume, snapshot string, props SetProperties) error {
+	return c.setSnapshotProperties(ctx, datasetCollection(zfs.DatasetVolume), volume, snapshot, props)
+}
+
+func (c *Client) setSnapshotProperties(ctx context.Context, collection, dataset, snapshot string, props SetProperties) error {
 	payload, err := json.Marshal(&props)
 	if err != nil {
 		return fmt.Errorf("error encoding payload json: %w", err)
 	}
 
-	req, err := c.request(ctx, http.MethodPatch, fmt.Sprintf("filesystems/%s/snapshots/%s",
-		filesystem, snapshot,
+	req, err := c.request(ctx, http.MethodPatch, fmt.Sprintf("%s/%s/snapshots/%s",
+		collection, escapeDataset(dataset), snapshot,
 	), bytes.NewBuffer(payload))
 	if err != nil {
 		return fmt.Errorf("error creating property request: %w", err)
 	}
+	_, err = c.datasetResponse(req, http.StatusOK)
+	return err
+}
+
+// DestroyFilesystem destroys the remote zfs filesystem
+func (c *Client) DestroyFilesystem(ctx context.Context, filesystem string) error {
+	return c.destroyDataset(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem)
+}
+
+// DestroyVolume destroys the remote zfs volume
+func (c *Client) DestroyVolume(ctx context.Context, volume string) error {
+	return c.destroyDataset(ctx, datasetCollection(zfs.DatasetVolume), volume)
+}
+
+func (c *Client) destroyDataset(ctx context.Context, collection, dataset string) error {
+	req, err := c.request(ctx, http.MethodDelete, fmt.Sprintf("%s/%s",
+		collection, escapeDataset(dataset),
+	), nil)
+	if err != nil {
+		return fmt.Errorf("error creating destroy request: %w", err)
+	}
+	return c.noContentResponse(req)
+}
+
+// RollbackSnapshot rolls the remote filesystem back to the given snapshot. Unless destroyMoreRecent is set,
+// it returns zfs.ErrMoreRecentSnapshotsExist when the snapshot is not the most recent one.
+func (c *Client) RollbackSnapshot(ctx context.Context, filesystem, snapshot string, destroyMoreRecent bool) error {
+	return c.rollbackSnapshot(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, snapshot, destroyMoreRecent)
+}
+
+// VolumeRollbackSnapshot rolls the remote volume back to the given snapshot
+func (c *Client) VolumeRollbackSnapshot(ctx context.Context, volume, snapshot string, destroyMoreRecent bool) error {
+	return c.rollbackSnapshot(ctx, datasetCollection(zfs.DatasetVolume), volume, snapshot, destroyMoreRecent)
+}
+
+func (c *Client) rollbackSnapshot(ctx context.Context, collection, dataset, snapshot string, destroyMoreRecent bool) error {
+	req, err := c.request(ctx, http.MethodPost, fmt.Sprintf("%s/%s/snapshots/%s/rollback?%s=%s",
+		collection, escapeDataset(dataset), snapshot,
+		GETParamDestroyMoreRecent, strconv.FormatBool(destroyMoreRecent),
+	), nil)
+	if err != nil {
+		return fmt.Errorf("error creating rollback request: %w", err)
+	}
+	return c.noContentResponse(req)
+}
+
+// CloneSnapshot clones the snapshot of the remote filesystem into a new filesystem, relative to the parent dataset
+func (c *Client) CloneSnapshot(ctx context.Context, filesystem, snapshot, target string) (*zfs.Dataset, error) {
+	return c.cloneSnapshot(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, snapshot, target)
+}
+
+// VolumeCloneSnapshot clones the snapshot of the remote volume into a new volume
+func (c *Client) VolumeCloneSnapshot(ctx context.Context, volume, snapshot, target string) (*zfs.Dataset, error) {
+	return c.cloneSnapshot(ctx, datasetCollection(zfs.DatasetVolume), volume, snapshot, target)
+}
+
+func (c *Client) cloneSnapshot(ctx context.Context, collection, dataset, snapshot, target string) (*zfs.Dataset, error) {
+	req, err := c.request(ctx, http.MethodPost, fmt.Sprintf("%s/%s/snapshots/%s/clone/%s",
+		collection, escapeDataset(dataset), snapshot, escapeDataset(target),
+	), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating clone request: %w", err)
+	}
+	return c.datasetResponse(req, http.StatusCreated)
+}
+
+// RenameFilesystem renames the remote filesystem, the target is relative to the parent dataset
+func (c *Client) RenameFilesystem(ctx context.Context, filesystem, target string) (*zfs.Dataset, error) {
+	return c.renameDataset(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, target)
+}
+
+// RenameVolume renames the remote volume
+func (c *Client) RenameVolume(ctx context.Context, volume, target string) (*zfs.Dataset, error) {
+	return c.renameDataset(ctx, datasetCollection(zfs.DatasetVolume), volume, target)
+}
+
+func (c *Client) renameDataset(ctx context.Context, collection, dataset, target string) (*zfs.Dataset, error) {
+	req, err := c.request(ctx, http.MethodPost, fmt.Sprintf("%s/%s/rename/%s",
+		collection, escapeDataset(dataset), escapeDataset(target),
+	), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating rename request: %w", err)
+	}
+	return c.datasetResponse(req, http.StatusOK)
+}
+
+// noContentResponse sends a request which responds without content on success
+func (c *Client) noContentResponse(req *http.Request) error {
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("error sending request: %w", err)
 	}
-	_ = resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp)
 	}
 	return nil
 }
+
+// datasetResponse sends a request which responds with a dataset on success
+func (c *Client) datasetResponse(req *http.Request, successStatus int) (*zfs.Dataset, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != successStatus {
+		return nil, responseError(resp)
+	}
+
+	ds := &zfs.Dataset{}
+	err = json.NewDecoder(resp.Body).Decode(ds)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding dataset: %w", err)
+	}
+	return ds, nil
+}
+
+// MakeSnapshot creates a snapshot of the remote filesystem
+func (c *Client) MakeSnapshot(ctx context.Context, filesystem, snapshot string) (*zfs.Dataset, error) {
+	return c.makeSnapshot(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, snapshot)
+}
+
+// MakeVolumeSnapshot creates a snapshot of the remote volume
+func (c *Client) MakeVolumeSnapshot(ctx context.Context, volume, snapshot string) (*zfs.Dataset, error) {
+	return c.makeSnapshot(ctx, datasetCollection(zfs.DatasetVolume), volume, snapshot)
+}
+
+func (c *Client) makeSnapshot(ctx context.Context, collection, dataset, snapshot string) (*zfs.Dataset, error) {
+	req, err := c.request(ctx, http.MethodPost, fmt.Sprintf("%s/%s/snapshots/%s",
+		collection, escapeDataset(dataset), snapshot,
+	), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating snapshot request: %w", err)
+	}
+	return c.datasetResponse(req, http.StatusCreated)
+}
+
+// DestroySnapshot destroys the snapshot of the remote filesystem
+func (c *Client) DestroySnapshot(ctx context.Context, filesystem, snapshot string) error {
+	return c.destroySnapshot(ctx, datasetCollection(zfs.DatasetFilesystem), filesystem, snapshot)
+}
+
+// DestroyVolumeSnapshot destroys the snapshot of the remote volume
+func (c *Client) DestroyVolumeSnapshot(ctx context.Context, volume, snapshot string) error {
+	return c.destroySnapshot(ctx, datasetCollection(zfs.DatasetVolume), volume, snapshot)
+}
+
+func (c *Client) destroySnapshot(ctx context.Context, collection, dataset, snapshot string) error {
+	req, err := c.request(ctx, http.MethodDelete, fmt.Sprintf("%s/%s/snapshots/%s",
+		collection, escapeDataset(dataset), snapshot,
+	), nil)
+	if err != nil {
+		return fmt.Errorf("error creating destroy request: %w", err)
+	}
+	return c.noContentResponse(req)
+}
+
+// Receives requests the receives in progress on the remote server
+func (c *Client) Receives(ctx context.Context) ([]Receive, error) {
+	req, err := c.request(ctx, http.MethodGet, "receives", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting receives: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Continue
+	default:
+		return nil, fmt.Errorf("error requesting receives: %w", responseError(resp))
+	}
+
+	var receives []Receive
+	err = json.NewDecoder(resp.Body).Decode(&receives)
+	return receives, err
+}
+
+// CancelReceive cancels a receive in progress on the remote server
+func (c *Client) CancelReceive(ctx context.Context, id string) error {
+	req, err := c.request(ctx, http.MethodDelete, fmt.Sprintf("receives/%s", url.PathEscape(id)), nil)
+	if err != nil {
+		return fmt.Errorf("error creating cancel request: %w", err)
+	}
+	return c.noContentResponse(req)
+}
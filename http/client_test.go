@@ -2,14 +2,18 @@ package http
 
 import (
 	"context"
+	"io"
 	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
-	zfs "github.com/vansante/go-zfsutils"
-
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
 )
 
 func clientTest(t *testing.T, fn func(client *Client)) {
@@ -80,3 +84,293 @@ func TestClient_Send(t *testing.T) {
 		require.Equal(t, fullNewFs+"@lala2", snaps[1].Name)
 	})
 }
+
+func TestClient_SendFramed(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		ds, err := zfs.GetDataset(context.Background(), testFilesystem)
+		require.NoError(t, err)
+
+		snap, err := ds.Snapshot(context.Background(), "framed", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		const newFs = "framedfs"
+		results, err := client.Send(ctx, SnapshotSendOptions{
+			DatasetName: newFs,
+			Snapshot:    snap,
+			Properties: ReceiveProperties{
+				zfs.PropertyCanMount: zfs.ValueOff,
+			},
+			SendOptions: zfs.SendOptions{
+				Raw:              true,
+				Framed:           true,
+				CompressionLevel: zstd.SpeedFastest,
+			},
+		})
+		require.NoError(t, err)
+		require.NotZero(t, results.BytesSent)
+
+		snaps, err := zfs.ListSnapshots(context.Background(), zfs.ListOptions{ParentDataset: testZPool + "/" + newFs})
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		require.Equal(t, testZPool+"/"+newFs+"@framed", snaps[0].Name)
+	})
+}
+
+func TestClient_SendCodecAuto(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		codecs, err := client.ServerCodecs(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, zfs.SupportedCodecs, codecs)
+
+		ds, err := zfs.GetDataset(context.Background(), testFilesystem)
+		require.NoError(t, err)
+
+		snap, err := ds.Snapshot(context.Background(), "codec", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		client.SetCodecPreference(zfs.CodecLZ4, zfs.CodecZstd)
+		compression, err := client.negotiateCompression(ctx, zfs.CompressionOptions{Codec: zfs.CodecAuto})
+		require.NoError(t, err)
+		require.Equal(t, zfs.CodecLZ4, compression.Codec)
+
+		const newFs = "codecfs"
+		_, err = client.Send(ctx, SnapshotSendOptions{
+			DatasetName: newFs,
+			Snapshot:    snap,
+			Properties: ReceiveProperties{
+				zfs.PropertyCanMount: zfs.ValueOff,
+			},
+			SendOptions: zfs.SendOptions{
+				Raw:         true,
+				Compression: zfs.CompressionOptions{Codec: zfs.CodecAuto},
+			},
+		})
+		require.NoError(t, err)
+
+		snaps, err := zfs.ListSnapshots(context.Background(), zfs.ListOptions{ParentDataset: testZPool + "/" + newFs})
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+	})
+}
+
+func TestClient_SendVolume(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		vol, err := zfs.CreateVolume(ctx, testZPool+"/vol", 16*1024*1024, zfs.CreateVolumeOptions{
+			Properties: map[string]string{zfs.PropertyVolBlockSize: "16384"},
+			Sparse:     true,
+		})
+		require.NoError(t, err)
+		snap, err := vol.Snapshot(ctx, "disk1", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		const newVol = "vms/disk"
+		_, err = client.Send(ctx, SnapshotSendOptions{
+			DatasetName: newVol,
+			DatasetType: zfs.DatasetVolume,
+			Snapshot:    snap,
+		})
+		require.NoError(t, err)
+
+		volumes, err := client.ListVolumes(ctx, nil)
+		require.NoError(t, err)
+		require.Len(t, volumes, 2)
+		require.Equal(t, testZPool+"/"+newVol, volumes[1].Name)
+		require.EqualValues(t, 16*1024*1024, volumes[1].Volsize)
+		require.EqualValues(t, 16384, volumes[1].Volblocksize)
+
+		snaps, err := client.VolumeSnapshots(ctx, newVol, nil)
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		require.Equal(t, testZPool+"/"+newVol+"@disk1", snaps[0].Name)
+
+		err = client.SetVolumeProperties(ctx, newVol, SetProperties{Set: map[string]string{"nl.test:vm": "web1"}})
+		require.NoError(t, err)
+
+		err = client.SetFilesystemProperties(ctx, newVol, SetProperties{Set: map[string]string{"nl.test:vm": "web1"}})
+		require.Error(t, err, "a volume is not a filesystem")
+
+		// Destroying a volume with snapshots fails, so remove the snapshot first
+		ds, err := zfs.GetDataset(ctx, testZPool+"/"+newVol+"@disk1")
+		require.NoError(t, err)
+		require.NoError(t, ds.Destroy(ctx, zfs.DestroyOptions{}))
+		require.NoError(t, client.DestroyVolume(ctx, newVol))
+		_, err = zfs.GetDataset(ctx, testZPool+"/"+newVol)
+		require.ErrorIs(t, err, zfs.ErrDatasetNotFound)
+	})
+}
+
+func TestClient_AbortResumableReceive(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		ctx := context.Background()
+		ds, err := zfs.GetDataset(ctx, testFilesystem)
+		require.NoError(t, err)
+		snap, err := ds.Snapshot(ctx, "send", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		const newFilesystem = "partial"
+		require.ErrorIs(t, client.AbortResumableReceive(ctx, newFilesystem), zfs.ErrDatasetNotFound)
+
+		// Interrupt a resumable receive to leave partial state behind
+		pipeRdr, pipeWrtr := io.Pipe()
+		go func() {
+			_ = snap.SendSnapshot(ctx, pipeWrtr, zfs.SendOptions{Raw: true})
+			_ = pipeWrtr.Close()
+		}()
+		_, err = zfs.ReceiveSnapshot(ctx, io.LimitReader(pipeRdr, 28_725), testZPool+"/"+newFilesystem+"@recv", zfs.ReceiveOptions{
+			Resumable:  true,
+			Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.Error(t, err)
+		_ = pipeRdr.Close()
+
+		token, _, err := client.ResumableSendToken(ctx, newFilesystem)
+		require.NoError(t, err)
+		require.NotEmpty(t, token)
+
+		require.NoError(t, client.AbortResumableReceive(ctx, newFilesystem))
+		require.ErrorIs(t, client.AbortResumableReceive(ctx, newFilesystem), ErrResumeNotPossible)
+
+		_, err = zfs.GetDataset(ctx, testZPool+"/"+newFilesystem)
+		require.ErrorIs(t, err, zfs.ErrDatasetNotFound, "the partial filesystem of a full receive is removed")
+	})
+}
+
+func TestClient_RollbackCloneRename(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		ctx := context.Background()
+		ds, err := zfs.GetDataset(ctx, testFilesystem)
+		require.NoError(t, err)
+		_, err = ds.Snapshot(ctx, "snap1", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+		_, err = ds.Snapshot(ctx, "snap2", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		const filesystem = testFilesystemName
+		err = client.RollbackSnapshot(ctx, filesystem, "snap1", false)
+		require.ErrorIs(t, err, zfs.ErrMoreRecentSnapshotsExist)
+		require.NoError(t, client.RollbackSnapshot(ctx, filesystem, "snap2", false))
+		require.ErrorIs(t, client.RollbackSnapshot(ctx, filesystem, "nope", false), zfs.ErrDatasetNotFound)
+
+		clone, err := client.CloneSnapshot(ctx, filesystem, "snap1", "restore/drill")
+		require.NoError(t, err)
+		require.Equal(t, testZPool+"/restore/drill", clone.Name)
+		_, err = client.CloneSnapshot(ctx, filesystem, "snap1", "restore/drill")
+		require.ErrorIs(t, err, zfs.ErrDatasetExists)
+
+		renamed, err := client.RenameFilesystem(ctx, "restore/drill", "restore/drill2")
+		require.NoError(t, err)
+		require.Equal(t, testZPool+"/restore/drill2", renamed.Name)
+		_, err = client.RenameFilesystem(ctx, "restore/drill", "restore/drill3")
+		require.ErrorIs(t, err, zfs.ErrDatasetNotFound)
+
+		require.NoError(t, client.RollbackSnapshot(ctx, filesystem, "snap1", true))
+		snaps, err := client.DatasetSnapshots(ctx, filesystem, nil)
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		require.Equal(t, testFilesystem+"@snap1", snaps[0].Name)
+	})
+}
+
+func TestClient_MakeSnapshotReceive(t *testing.T) {
+	clientTest(t, func(client *Client) {
+		ctx := context.Background()
+		const filesystem = testFilesystemName
+
+		snap1, err := client.MakeSnapshot(ctx, filesystem, "snap1")
+		require.NoError(t, err)
+		require.Equal(t, testFilesystem+"@snap1", snap1.Name)
+		_, err = client.MakeSnapshot(ctx, filesystem, "snap2")
+		require.NoError(t, err)
+		_, err = client.MakeSnapshot(ctx, filesystem, "snap2")
+		require.ErrorIs(t, err, zfs.ErrDatasetExists)
+
+		const localFs = testZPool + "/local"
+		result, err := client.Receive(ctx, SnapshotReceiveOptions{
+			FetchOptions: FetchOptions{Codec: zfs.CodecAuto, Framed: true},
+			DatasetName:  filesystem,
+			SnapshotName: "snap1",
+			LocalName:    localFs + "@snap1",
+			ReceiveOptions: zfs.ReceiveOptions{
+				Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+			},
+		})
+		require.NoError(t, err)
+		require.NotZero(t, result.BytesReceived)
+		require.Equal(t, localFs+"@snap1", result.Dataset.Name)
+
+		result, err = client.Receive(ctx, SnapshotReceiveOptions{
+			DatasetName:     filesystem,
+			IncrementalBase: "snap1",
+			SnapshotName:    "snap2",
+			LocalName:       localFs + "@snap2",
+		})
+		require.NoError(t, err)
+		require.Equal(t, localFs+"@snap2", result.Dataset.Name)
+
+		require.NoError(t, client.DestroySnapshot(ctx, filesystem, "snap2"))
+		require.ErrorIs(t, client.DestroySnapshot(ctx, filesystem, "snap2"), zfs.ErrDatasetNotFound)
+
+		_, err = client.FetchSnapshot(ctx, filesystem, "snap2", FetchOptions{})
+		require.ErrorIs(t, err, zfs.ErrDatasetNotFound)
+	})
+}
+
+func TestClient_Fetch(t *testing.T) {
+	var query url.Values
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/filesystems/customers%2Facme/snapshots/snap2/incremental/snap1", req.URL.EscapedPath())
+		query = req.URL.Query()
+		accept = req.Header.Get(HeaderAcceptStreamEncoding)
+		w.Header().Set(HeaderStreamEncoding, string(zfs.CodecLZ4))
+		_, _ = w.Write([]byte("stream"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, slog.Default())
+	client.SetCodecPreference(zfs.CodecLZ4, zfs.CodecZstd)
+	stream, err := client.FetchIncrementalSnapshot(context.Background(), "customers/acme", "snap1", "snap2", FetchOptions{
+		BytesPerSecond: 1024,
+		Raw:            true,
+		Codec:          zfs.CodecAuto,
+		Framed:         true,
+	})
+	require.NoError(t, err)
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, "stream", string(data))
+	require.Equal(t, zfs.CodecLZ4, stream.Codec)
+
+	require.Equal(t, "lz4, zstd", accept)
+	require.Equal(t, "1024", query.Get(GETParamBytesPerSecond))
+	require.Equal(t, "true", query.Get(GETParamRaw))
+	require.Equal(t, "true", query.Get(GETParamFramed))
+	require.Equal(t, "false", query.Get(GETParamEncrypted))
+}
+
+func TestClient_SnapshotErrors(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL, slog.Default())
+	require.ErrorIs(t, client.DestroySnapshot(ctx, "fs", "snap"), ErrForbidden)
+	require.ErrorIs(t, client.DestroyVolumeSnapshot(ctx, "vol", "snap"), ErrForbidden)
+	_, err := client.MakeSnapshot(ctx, "fs", "invalid snapshot")
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	_, err = client.FetchSnapshot(ctx, "fs", "invalid snapshot", FetchOptions{})
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	_, err = client.FetchResumeSnapshot(ctx, "short", FetchOptions{})
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+}
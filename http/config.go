@@ -1,8 +1,15 @@
 package http
 
+import zfs "github.com/vansante/go-zfsutils"
+
 const (
 	defaultBytesPerSecond            = 100 * 1024 * 1024
 	defaultMaximumConcurrentReceives = 3
+	defaultReceiveQueueSize          = 10
+	defaultReceiveQueueMaxWait       = 60
+	defaultReceiveRetryAfter         = 30
+	defaultOpenAPIPath               = "/openapi.json"
+	defaultMetricsPath               = "/metrics"
 )
 
 // Config specifies the configuration for the zfs http server
@@ -11,10 +18,48 @@ type Config struct {
 	ParentDataset       string `json:"ParentDataset" yaml:"ParentDataset"`
 	SpeedBytesPerSecond int64  `json:"SpeedBytesPerSecond" yaml:"SpeedBytesPerSecond"`
 
+	// BandwidthBytesPerSecond is the bandwidth budget shared by all sends and receives, every active stream gets
+	// an equal share of it and streams held back by their principal budget leave the rest to the others.
+	// It applies on top of the SpeedBytesPerSecond of a send, set to zero to disable it.
+	BandwidthBytesPerSecond int64 `json:"BandwidthBytesPerSecond" yaml:"BandwidthBytesPerSecond"`
+	// BandwidthSchedule varies the shared bandwidth budget by the time of day, like
+	// "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited". It takes precedence over BandwidthBytesPerSecond.
+	BandwidthSchedule zfs.BandwidthSchedule `json:"BandwidthSchedule" yaml:"BandwidthSchedule"`
+
 	// MaximumConcurrentReceives limits the concurrent amount of ZFS receives, set to zero to disable limits
 	MaximumConcurrentReceives int `json:"MaximumConcurrentReceives" yaml:"MaximumConcurrentReceives"`
+	// ReceiveQueueSize is the amount of receives that wait in order for a free slot when the limits are reached,
+	// set to zero to refuse them right away
+	ReceiveQueueSize int `json:"ReceiveQueueSize" yaml:"ReceiveQueueSize"`
+	// ReceiveQueueMaxWaitSeconds is how long a receive waits in the queue before it is refused
+	ReceiveQueueMaxWaitSeconds int64 `json:"ReceiveQueueMaxWaitSeconds" yaml:"ReceiveQueueMaxWaitSeconds"`
+	// ReceiveRetryAfterSeconds is sent as Retry-After header when a receive is refused, set to zero to omit it
+	ReceiveRetryAfterSeconds int64 `json:"ReceiveRetryAfterSeconds" yaml:"ReceiveRetryAfterSeconds"`
+
+	// ReadinessMinimumFreeBytes is the free space the parent dataset needs for the server to report it is ready
+	ReadinessMinimumFreeBytes uint64 `json:"ReadinessMinimumFreeBytes" yaml:"ReadinessMinimumFreeBytes"`
+
+	// OpenAPIPath is the path the OpenAPI specification of the server is served at, set to empty to disable it
+	OpenAPIPath string `json:"OpenAPIPath" yaml:"OpenAPIPath"`
+	// MetricsPath is the path the Prometheus metrics of the server are served at, set to empty to disable it.
+	// They are served without authentication, like the health endpoints. HTTP.MetricsHandler serves them as well,
+	// to mount them elsewhere.
+	MetricsPath string `json:"MetricsPath" yaml:"MetricsPath"`
 
+	// StreamKeys are hex encoded keys for stream encryption. Encrypted streams are received with the key they were
+	// encrypted with, streams sent by the server are encrypted with the first key.
+	StreamKeys []zfs.StreamKey `json:"StreamKeys" yaml:"StreamKeys"`
+
+	// Authentication configures how clients are authenticated, without authenticators all requests are allowed
+	Authentication AuthenticationConfig `json:"Authentication" yaml:"Authentication"`
+
+	// Permissions apply to requests without identity and to principals without a policy
 	Permissions Permissions `json:"Permissions" yaml:"Permissions"`
+
+	// Policies maps authenticated principals to their own parent dataset, permissions and limits
+	Policies map[string]Policy `json:"Policies" yaml:"Policies"`
+	// RequirePolicy refuses requests from principals without a policy
+	RequirePolicy bool `json:"RequirePolicy" yaml:"RequirePolicy"`
 }
 
 // Permissions specifies permissions for requests over zfs http
@@ -24,10 +69,26 @@ type Permissions struct {
 	AllowIncludeProperties  bool `json:"AllowIncludeProperties" yaml:"AllowIncludeProperties"`
 	AllowDestroyFilesystems bool `json:"AllowDestroyFilesystems" yaml:"AllowDestroyFilesystems"`
 	AllowDestroySnapshots   bool `json:"AllowDestroySnapshots" yaml:"AllowDestroySnapshots"`
+	// AllowAbortResumableReceive allows discarding the partial state of interrupted resumable receives
+	AllowAbortResumableReceive bool `json:"AllowAbortResumableReceive" yaml:"AllowAbortResumableReceive"`
+	// AllowManageReceives allows listing and canceling the receives of all principals, instead of only their own
+	AllowManageReceives bool `json:"AllowManageReceives" yaml:"AllowManageReceives"`
+	// AllowRollback allows rolling back filesystems and volumes to one of their snapshots
+	AllowRollback bool `json:"AllowRollback" yaml:"AllowRollback"`
+	// AllowClone allows cloning snapshots into new filesystems and volumes
+	AllowClone bool `json:"AllowClone" yaml:"AllowClone"`
+	// AllowRename allows renaming filesystems and volumes
+	AllowRename bool `json:"AllowRename" yaml:"AllowRename"`
 }
 
 // ApplyDefaults sets all config values to their defaults (if they have one)
 func (c *Config) ApplyDefaults() {
 	c.SpeedBytesPerSecond = defaultBytesPerSecond
 	c.MaximumConcurrentReceives = defaultMaximumConcurrentReceives
+	c.ReceiveQueueSize = defaultReceiveQueueSize
+	c.ReceiveQueueMaxWaitSeconds = defaultReceiveQueueMaxWait
+	c.ReceiveRetryAfterSeconds = defaultReceiveRetryAfter
+	c.OpenAPIPath = defaultOpenAPIPath
+	c.MetricsPath = defaultMetricsPath
+	c.Authentication.ApplyDefaults()
 }
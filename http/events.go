@@ -0,0 +1,228 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ReceiveStartedEvent  = "receive-started"
+	ReceiveFinishedEvent = "receive-finished"
+)
+
+const (
+	eventHistorySize      = 100
+	eventSubscriberBuffer = 100
+	eventHeartbeat        = 15 * time.Second
+
+	contentTypeEventStream = "text/event-stream"
+)
+
+// Event is a server or job event, streamed as server-sent event. Fields that do not apply to the type are omitted.
+type Event struct {
+	ID        uint64    `json:"ID"`
+	Type      string    `json:"Type"`
+	Time      time.Time `json:"Time"`
+	Dataset   string    `json:"Dataset,omitempty"`
+	Snapshot  string    `json:"Snapshot,omitempty"`
+	Server    string    `json:"Server,omitempty"`
+	Principal string    `json:"Principal,omitempty"`
+	ReceiveID string    `json:"ReceiveID,omitempty"`
+	Bytes     int64     `json:"Bytes,omitempty"`
+	// DurationSeconds is how long the send, pull or receive took
+	DurationSeconds float64 `json:"DurationSeconds,omitempty"`
+	Error           string  `json:"Error,omitempty"`
+}
+
+// EventStream publishes events to server-sent event subscribers. It keeps a short history, so clients
+// reconnecting with the Last-Event-ID header miss no events. Subscribers that cannot keep up are disconnected.
+type EventStream struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+	closed      bool
+	logger      *slog.Logger
+}
+
+// NewEventStream creates a new event stream
+func NewEventStream(logger *slog.Logger) *EventStream {
+	return &EventStream{
+		subscribers: make(map[chan Event]struct{}),
+		logger:      logger,
+	}
+}
+
+// Publish sends the event to all subscribers, it never blocks. The ID is assigned by the stream, the time is set
+// when it is zero.
+func (s *EventStream) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.lastID++
+	event.ID = s.lastID
+	s.history = append(s.history, event)
+	if len(s.history) > eventHistorySize {
+		s.history = slices.Delete(s.history, 0, len(s.history)-eventHistorySize)
+	}
+
+	for sub := range s.subscribers {
+		select {
+		case sub <- event:
+		default:
+			// The subscriber is too slow, it can reconnect with the last event ID it got
+			delete(s.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// Close disconnects all subscribers, later events are dropped
+func (s *EventStream) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub)
+	}
+}
+
+// subscribe returns a channel of the events from now on. When the subscriber saw events before, the events in
+// the history after the last one it saw are returned as well.
+func (s *EventStream) subscribe(lastID string) ([]Event, chan Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var missed []Event
+	afterID, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		afterID = s.lastID
+	}
+	for _, event := range s.history {
+		if event.ID > afterID {
+			missed = append(missed, event)
+		}
+	}
+	sub := make(chan Event, eventSubscriberBuffer)
+	if s.closed {
+		close(sub)
+		return missed, sub
+	}
+	s.subscribers[sub] = struct{}{}
+	return missed, sub
+}
+
+func (s *EventStream) unsubscribe(sub chan Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub)
+	}
+}
+
+// ServeHTTP streams the events as server-sent events, filtered by the types parameter
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.serve(w, req, s.logger, nil)
+}
+
+// serve streams the events the filter allows, a nil filter allows all events
+func (s *EventStream) serve(w http.ResponseWriter, req *http.Request, logger *slog.Logger, filter func(Event) bool) {
+	var types []string
+	if list := req.URL.Query().Get(GETParamEventTypes); list != "" {
+		types = strings.Split(list, ",")
+	}
+	allowed := func(event Event) bool {
+		if len(types) > 0 && !slices.Contains(types, event.Type) {
+			return false
+		}
+		return filter == nil || filter(event)
+	}
+	missed, sub := s.subscribe(req.Header.Get("Last-Event-ID"))
+	defer s.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{}) // The stream outlives any write timeout of the server
+
+	w.Header().Set("Content-Type", contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event Event) error {
+		if !allowed(event) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+	for _, event := range missed {
+		if err := write(event); err != nil {
+			logger.Info("zfs.http.EventStream.serve: Error writing event", "error", err)
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		logger.Info("zfs.http.EventStream.serve: Streaming not supported", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case event, ok := <-sub:
+			if !ok {
+				return
+			}
+			err = write(event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logger.Info("zfs.http.EventStream.serve: Error writing event", "error", err)
+			return
+		}
+	}
+}
+
+// Events returns the stream of the events of the server, to publish events of other sources to the same stream
+func (h *HTTP) Events() *EventStream {
+	return h.events
+}
+
+// handleEvents streams the events of the server. Principals only see their own receives, unless they may
+// manage all receives. Events without principal, like those of a job runner, are visible to all.
+func (h *HTTP) handleEvents(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	manageAll := h.policy(req).Permissions.AllowManageReceives
+	name := principal(req)
+	h.events.serve(w, req, logger, func(event Event) bool {
+		return manageAll || event.Principal == "" || event.Principal == name
+	})
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the next server-sent event of the stream, skipping comments
+func readEvent(t *testing.T, rdr *bufio.Reader) (string, Event) {
+	t.Helper()
+
+	var eventType string
+	var event Event
+	for {
+		line, err := rdr.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			return eventType, event
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		}
+	}
+}
+
+func openEvents(t *testing.T, url, token, lastID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, contentTypeEventStream, resp.Header.Get("Content-Type"))
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestEventStream(t *testing.T) {
+	stream := NewEventStream(slog.Default())
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	stream.Publish(Event{Type: "created-snapshot", Dataset: "tank/fs", Snapshot: "snap1"})
+
+	resp, rdr := openEvents(t, server.URL+"?"+GETParamEventTypes+"=created-snapshot,sent-snapshot", "", "")
+	defer resp.Body.Close()
+
+	// Events are only replayed for clients that say which one they saw last
+	stream.Publish(Event{Type: "start-sending-snapshot", Dataset: "tank/fs", Snapshot: "snap2"})
+	stream.Publish(Event{Type: "sent-snapshot", Dataset: "tank/fs", Snapshot: "snap2", Bytes: 1024})
+	eventType, event := readEvent(t, rdr)
+	require.Equal(t, "sent-snapshot", eventType)
+	require.EqualValues(t, 3, event.ID)
+	require.Equal(t, "snap2", event.Snapshot)
+	require.EqualValues(t, 1024, event.Bytes)
+	require.False(t, event.Time.IsZero())
+
+	resp2, rdr2 := openEvents(t, server.URL, "", "1")
+	defer resp2.Body.Close()
+	eventType, event = readEvent(t, rdr2)
+	require.Equal(t, "start-sending-snapshot", eventType)
+	require.EqualValues(t, 2, event.ID)
+	eventType, _ = readEvent(t, rdr2)
+	require.Equal(t, "sent-snapshot", eventType)
+
+	stream.Close()
+	_, err := rdr.ReadString('\n')
+	require.Error(t, err, "the stream ends when it is closed")
+}
+
+func TestHTTP_handleEvents(t *testing.T) {
+	conf := Config{}
+	conf.Authentication.BearerTokens = map[string]string{"token-a": "a", "token-b": "b"}
+	conf.Permissions.AllowManageReceives = false
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, rdr := openEvents(t, server.URL+"/events", "token-a", "")
+	defer resp.Body.Close()
+
+	h.Events().Publish(Event{Type: ReceiveStartedEvent, Dataset: "tank/b", Principal: "b", ReceiveID: "1"})
+	h.Events().Publish(Event{Type: ReceiveStartedEvent, Dataset: "tank/a", Principal: "a", ReceiveID: "2"})
+	h.Events().Publish(Event{Type: "sent-snapshot", Dataset: "tank/job"})
+
+	eventType, event := readEvent(t, rdr)
+	require.Equal(t, ReceiveStartedEvent, eventType)
+	require.Equal(t, "2", event.ReceiveID)
+	_, event = readEvent(t, rdr)
+	require.Equal(t, "tank/job", event.Dataset)
+
+	require.NoError(t, h.Shutdown(context.Background()))
+	_, err := rdr.ReadString('\n')
+	require.Error(t, err, "the stream ends on shutdown")
+}
@@ -0,0 +1,177 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+const (
+	healthPath    = "/healthz"
+	readinessPath = "/readyz"
+
+	readinessTimeout = 10 * time.Second
+)
+
+// HealthStatus is the status of a health check
+type HealthStatus string
+
+const (
+	HealthStatusOK      HealthStatus = "ok"
+	HealthStatusFailed  HealthStatus = "failed"
+	HealthStatusSkipped HealthStatus = "skipped"
+)
+
+// HealthCheck is the result of a single health check
+type HealthCheck struct {
+	Name    string       `json:"Name"`
+	Status  HealthStatus `json:"Status"`
+	Message string       `json:"Message,omitempty"`
+}
+
+// Health is the response of the health and readiness endpoints. The status fails when one of the checks failed.
+type Health struct {
+	Status HealthStatus  `json:"Status"`
+	Checks []HealthCheck `json:"Checks"`
+}
+
+// registerHealthRoutes registers the health, readiness and metrics endpoints. They are meant for load balancers
+// and scrapers, which do not authenticate, so they skip the middleware.
+func (h *HTTP) registerHealthRoutes() {
+	h.router.HandleFunc(fmt.Sprintf("%s %s%s", http.MethodGet, h.config.HTTPPathPrefix, healthPath),
+		func(w http.ResponseWriter, req *http.Request) {
+			h.handleHealth(w, req, h.logger)
+		},
+	)
+	h.router.HandleFunc(fmt.Sprintf("%s %s%s", http.MethodGet, h.config.HTTPPathPrefix, readinessPath),
+		func(w http.ResponseWriter, req *http.Request) {
+			h.handleReadiness(w, req, h.logger)
+		},
+	)
+	if h.config.MetricsPath != "" {
+		h.router.Handle(fmt.Sprintf("%s %s%s", http.MethodGet, h.config.HTTPPathPrefix, h.config.MetricsPath), h.MetricsHandler())
+	}
+}
+
+// handleHealth reports whether the server is alive
+func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, logger *slog.Logger) {
+	writeHealth(w, Health{Status: HealthStatusOK, Checks: []HealthCheck{}}, logger)
+}
+
+// handleReadiness reports whether the server can accept receives, it fails once the server is shutting down
+func (h *HTTP) handleReadiness(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := h.datasetChecks(ctx)
+	checks = append(checks, h.receiveSlotsCheck(), h.shutdownCheck())
+
+	health := Health{Status: HealthStatusOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status == HealthStatusFailed {
+			logger.Warn("zfs.http.handleReadiness: Check failed", "check", check.Name, "message", check.Message)
+			health.Status = HealthStatusFailed
+		}
+	}
+	writeHealth(w, health, logger)
+}
+
+// datasetChecks checks the parent dataset exists, its pool is online and it has enough free space
+func (h *HTTP) datasetChecks(ctx context.Context) []HealthCheck {
+	datasetCheck := HealthCheck{Name: "parent_dataset", Status: HealthStatusOK}
+	poolCheck := HealthCheck{Name: "pool", Status: HealthStatusOK}
+	spaceCheck := HealthCheck{Name: "free_space", Status: HealthStatusOK}
+
+	if h.config.ParentDataset == "" {
+		datasetCheck.Status = HealthStatusSkipped
+		datasetCheck.Message = "no parent dataset configured"
+		poolCheck.Status = HealthStatusSkipped
+		spaceCheck.Status = HealthStatusSkipped
+		return []HealthCheck{datasetCheck, poolCheck, spaceCheck}
+	}
+
+	// The pool is checked with zpool, zfs properties can still be read from a pool that is not healthy
+	pool := zfs.PoolName(h.config.ParentDataset)
+	health, err := zfs.GetPoolHealth(ctx, pool)
+	switch {
+	case err != nil:
+		poolCheck.Status = HealthStatusFailed
+		poolCheck.Message = err.Error()
+	case health != zfs.PoolHealthOnline:
+		poolCheck.Status = HealthStatusFailed
+		poolCheck.Message = fmt.Sprintf("pool %s is %s", pool, health)
+	default:
+		poolCheck.Message = fmt.Sprintf("pool %s is %s", pool, health)
+	}
+
+	ds, err := zfs.GetDataset(ctx, h.config.ParentDataset)
+	switch {
+	case errors.Is(err, zfs.ErrPoolIOSuspended):
+		datasetCheck.Status = HealthStatusSkipped
+		poolCheck.Status = HealthStatusFailed
+		poolCheck.Message = err.Error()
+		spaceCheck.Status = HealthStatusSkipped
+		return []HealthCheck{datasetCheck, poolCheck, spaceCheck}
+	case err != nil:
+		datasetCheck.Status = HealthStatusFailed
+		datasetCheck.Message = err.Error()
+		spaceCheck.Status = HealthStatusSkipped
+		return []HealthCheck{datasetCheck, poolCheck, spaceCheck}
+	}
+
+	spaceCheck.Message = fmt.Sprintf("%d bytes available", ds.Available)
+	if ds.Available < h.config.ReadinessMinimumFreeBytes {
+		spaceCheck.Status = HealthStatusFailed
+		spaceCheck.Message = fmt.Sprintf("%d bytes available, minimum is %d", ds.Available, h.config.ReadinessMinimumFreeBytes)
+	}
+	return []HealthCheck{datasetCheck, poolCheck, spaceCheck}
+}
+
+// receiveSlotsCheck checks a receive can get a slot without waiting
+func (h *HTTP) receiveSlotsCheck() HealthCheck {
+	check := HealthCheck{Name: "receive_slots", Status: HealthStatusOK}
+	if h.config.MaximumConcurrentReceives <= 0 {
+		check.Message = "no limit"
+		return check
+	}
+
+	h.receiveMutex.Lock()
+	count := h.receiveCount
+	h.receiveMutex.Unlock()
+
+	check.Message = fmt.Sprintf("%d of %d receives in progress", count, h.config.MaximumConcurrentReceives)
+	if count >= h.config.MaximumConcurrentReceives {
+		check.Status = HealthStatusFailed
+	}
+	return check
+}
+
+// shutdownCheck fails once the server is shutting down, so load balancers stop sending it receives while it drains
+func (h *HTTP) shutdownCheck() HealthCheck {
+	check := HealthCheck{Name: "shutting_down", Status: HealthStatusOK}
+	if h.isShuttingDown() {
+		check.Status = HealthStatusFailed
+		check.Message = "not accepting receives"
+	}
+	return check
+}
+
+func writeHealth(w http.ResponseWriter, health Health, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if health.Status != HealthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		logger.Error("zfs.http.writeHealth: Error encoding json", "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, h *HTTP, path string) (int, Health) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var health Health
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&health))
+	return rec.Code, health
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	conf := Config{MaximumConcurrentReceives: 1, HTTPPathPrefix: "/zfs"}
+	conf.Authentication.BearerTokens = map[string]string{"token": "backup"}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	// No authentication is needed
+	status, health := getHealth(t, h, "/zfs/healthz")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, HealthStatusOK, health.Status)
+
+	status, health = getHealth(t, h, "/zfs/readyz")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, Health{
+		Status: HealthStatusOK,
+		Checks: []HealthCheck{
+			{Name: "parent_dataset", Status: HealthStatusSkipped, Message: "no parent dataset configured"},
+			{Name: "pool", Status: HealthStatusSkipped},
+			{Name: "free_space", Status: HealthStatusSkipped},
+			{Name: "receive_slots", Status: HealthStatusOK, Message: "0 of 1 receives in progress"},
+			{Name: "shutting_down", Status: HealthStatusOK},
+		},
+	}, health)
+
+	h.receiveMutex.Lock()
+	h.reserveSlot("backup")
+	h.receiveMutex.Unlock()
+
+	status, health = getHealth(t, h, "/zfs/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, HealthStatusFailed, health.Status)
+	require.Equal(t, HealthCheck{
+		Name: "receive_slots", Status: HealthStatusFailed, Message: "1 of 1 receives in progress",
+	}, health.Checks[3])
+
+	// Liveness does not depend on the readiness checks
+	status, _ = getHealth(t, h, "/zfs/healthz")
+	require.Equal(t, http.StatusOK, status)
+
+	h.receiveMutex.Lock()
+	h.releaseSlot("backup")
+	h.receiveMutex.Unlock()
+
+	// A draining server is not ready
+	require.NoError(t, h.Shutdown(context.Background()))
+	status, health = getHealth(t, h, "/zfs/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, HealthCheck{
+		Name: "shutting_down", Status: HealthStatusFailed, Message: "not accepting receives",
+	}, health.Checks[4])
+	status, _ = getHealth(t, h, "/zfs/healthz")
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestHealth_ReadinessDataset(t *testing.T) {
+	TestHTTPZPool(testZPool, testPrefix, "", func(server *httptest.Server) {
+		h := NewHTTP(context.Background(), Config{ParentDataset: testZPool + "/missing"}, slog.Default())
+		status, health := getHealth(t, h, "/readyz")
+		require.Equal(t, http.StatusServiceUnavailable, status)
+		require.Equal(t, "parent_dataset", health.Checks[0].Name)
+		require.Equal(t, HealthStatusFailed, health.Checks[0].Status)
+
+		h = NewHTTP(context.Background(), Config{ParentDataset: testZPool}, slog.Default())
+		status, health = getHealth(t, h, "/readyz")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, HealthCheck{
+			Name: "pool", Status: HealthStatusOK, Message: "pool " + testZPool + " is ONLINE",
+		}, health.Checks[1])
+		require.Equal(t, HealthStatusOK, health.Checks[2].Status)
+
+		h = NewHTTP(context.Background(), Config{ParentDataset: testZPool, ReadinessMinimumFreeBytes: 1 << 50}, slog.Default())
+		status, health = getHealth(t, h, "/readyz")
+		require.Equal(t, http.StatusServiceUnavailable, status)
+		require.Equal(t, "free_space", health.Checks[2].Name)
+		require.Equal(t, HealthStatusFailed, health.Checks[2].Status)
+	})
+}
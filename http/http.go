@@ -2,15 +2,22 @@ package http
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/klauspost/compress/zstd"
+
+	zfs "github.com/vansante/go-zfsutils"
 )
 
+var errNoStreamKeys = errors.New("stream encryption requested but no stream keys configured")
+
 // HTTP is the main object for serving the ZFS HTTP server
 type HTTP struct {
 	router       *http.ServeMux
@@ -18,7 +25,37 @@ type HTTP struct {
 	logger       *slog.Logger
 	receiveCount int
 	receiveMutex sync.Mutex
-	ctx          context.Context
+
+	principalReceives map[string]int
+	receiveQueue      []*receiveWaiter
+	receives          map[string]*activeReceive
+	ctx               context.Context
+
+	// shutdown is closed when Shutdown is called, drained once no receive handlers are left after that
+	shutdown          chan struct{}
+	drained           chan struct{}
+	shuttingDown      bool
+	interruptReceives bool
+	receiveHandlers   int
+
+	// routes lists the registered routes as method and path, without the path prefix
+	routes []string
+
+	reservations *receiveReservations
+
+	bandwidthPool       *bandwidthPool
+	bandwidth           *bandwidth
+	principalBandwidths map[string]*bandwidth
+	bandwidthMutex      sync.Mutex
+
+	authenticators      []Authenticator
+	authenticatorsMutex sync.RWMutex
+
+	metrics *metrics
+	events  *EventStream
+
+	auditSink  AuditSink
+	auditMutex sync.RWMutex
 }
 
 type handle func(http.ResponseWriter, *http.Request, *slog.Logger)
@@ -30,40 +67,95 @@ func NewHTTP(ctx context.Context, conf Config, logger *slog.Logger) *HTTP {
 		config: conf,
 		logger: logger,
 		ctx:    ctx,
+
+		principalReceives: make(map[string]int),
+		receives:          make(map[string]*activeReceive),
+		shutdown:          make(chan struct{}),
+		drained:           make(chan struct{}),
+		authenticators:    conf.Authentication.authenticators(),
+
+		reservations:        newReceiveReservations(),
+		bandwidthPool:       newBandwidthPool(),
+		principalBandwidths: make(map[string]*bandwidth),
+		metrics:             newMetrics(),
+		events:              NewEventStream(logger),
 	}
 
+	h.bandwidth = h.bandwidthPool.budget(conf.BandwidthBytesPerSecond, conf.BandwidthSchedule)
 	h.registerRoutes()
+	h.registerHealthRoutes()
+	if conf.OpenAPIPath != "" {
+		// The specification is not a route of the API itself, so it is not listed in it
+		h.router.HandleFunc(fmt.Sprintf("%s %s%s", http.MethodGet, conf.HTTPPathPrefix, conf.OpenAPIPath), h.middleware(h.handleOpenAPI))
+	}
 	return h
 }
 
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Server", "go-zfsutils")
+	w.Header().Set(HeaderAcceptStreamEncoding, formatCodecList(zfs.SupportedCodecs))
 
 	h.router.ServeHTTP(w, req)
 }
 
 // nolint: goconst
 func (h *HTTP) registerRoutes() {
+	h.registerRoute(http.MethodGet, "/codecs", h.handleListCodecs)
+
+	h.registerRoute(http.MethodGet, "/receives", h.handleListReceives)
+	h.registerRoute(http.MethodDelete, "/receives/{id}", h.audited(AuditCancelReceive, h.handleCancelReceive))
+	h.registerRoute(http.MethodGet, "/events", h.handleEvents)
+
 	h.registerRoute(http.MethodGet, "/filesystems", h.handleListFilesystems)
-	h.registerRoute(http.MethodPatch, "/filesystems/{filesystem}", h.handleSetFilesystemProps)
-	h.registerRoute(http.MethodDelete, "/filesystems/{filesystem}", h.handleDestroyFilesystem)
+	h.registerRoute(http.MethodPatch, "/filesystems/{filesystem}", h.audited(AuditSetProperties, h.handleSetFilesystemProps))
+	h.registerRoute(http.MethodDelete, "/filesystems/{filesystem}", h.audited(AuditDestroyDataset, h.handleDestroyFilesystem))
+	h.registerRoute(http.MethodPost, "/filesystems/{filesystem}/rename/{target}", h.audited(AuditRenameDataset, h.handleRenameFilesystem))
 
 	h.registerRoute(http.MethodGet, "/filesystems/{filesystem}/snapshots", h.handleListSnapshots)
 	h.registerRoute(http.MethodGet, "/filesystems/{filesystem}/resume-token", h.handleGetResumeToken)
+	h.registerRoute(http.MethodDelete, "/filesystems/{filesystem}/resume-token", h.audited(AuditAbortResumableReceive, h.handleAbortResumableReceive))
 
 	h.registerRoute(http.MethodGet, "/filesystems/{filesystem}/snapshots/{snapshot}", h.handleGetSnapshot)
 	h.registerRoute(http.MethodGet, "/filesystems/{filesystem}/snapshots/{snapshot}/incremental/{basesnapshot}", h.handleGetSnapshotIncremental)
 	h.registerRoute(http.MethodGet, "/snapshot/resume/{token}", h.handleResumeGetSnapshot)
 
-	h.registerRoute(http.MethodPost, "/filesystems/{filesystem}/snapshots/{snapshot}", h.handleMakeSnapshot)
-	h.registerRoute(http.MethodPut, "/filesystems/{filesystem}/snapshots", h.handleReceiveSnapshot)
-	h.registerRoute(http.MethodPut, "/filesystems/{filesystem}/snapshots/{snapshot}", h.handleReceiveSnapshot)
-	h.registerRoute(http.MethodPatch, "/filesystems/{filesystem}/snapshots/{snapshot}", h.handleSetSnapshotProps)
-	h.registerRoute(http.MethodDelete, "/filesystems/{filesystem}/snapshots/{snapshot}", h.handleDestroySnapshot)
+	h.registerRoute(http.MethodPost, "/filesystems/{filesystem}/snapshots/{snapshot}", h.audited(AuditMakeSnapshot, h.handleMakeSnapshot))
+	h.registerRoute(http.MethodPut, "/filesystems/{filesystem}/snapshots", h.audited(AuditReceiveSnapshot, h.handleReceiveSnapshot))
+	h.registerRoute(http.MethodPut, "/filesystems/{filesystem}/snapshots/{snapshot}", h.audited(AuditReceiveSnapshot, h.handleReceiveSnapshot))
+	h.registerRoute(http.MethodPatch, "/filesystems/{filesystem}/snapshots/{snapshot}", h.audited(AuditSetSnapshotProperties, h.handleSetSnapshotProps))
+	h.registerRoute(http.MethodDelete, "/filesystems/{filesystem}/snapshots/{snapshot}", h.audited(AuditDestroySnapshot, h.handleDestroySnapshot))
+	h.registerRoute(http.MethodPost, "/filesystems/{filesystem}/snapshots/{snapshot}/rollback",
+		h.audited(AuditRollbackSnapshot, h.handleRollbackSnapshot),
+	)
+	h.registerRoute(http.MethodPost, "/filesystems/{filesystem}/snapshots/{snapshot}/clone/{target}",
+		h.audited(AuditCloneSnapshot, h.handleCloneSnapshot),
+	)
+
+	// Volumes share the filesystem handlers, the type of the dataset is derived from the path
+	h.registerRoute(http.MethodGet, "/volumes", h.handleListVolumes)
+	h.registerRoute(http.MethodPatch, "/volumes/{volume}", h.audited(AuditSetProperties, h.handleSetFilesystemProps))
+	h.registerRoute(http.MethodDelete, "/volumes/{volume}", h.audited(AuditDestroyDataset, h.handleDestroyFilesystem))
+	h.registerRoute(http.MethodPost, "/volumes/{volume}/rename/{target}", h.audited(AuditRenameDataset, h.handleRenameFilesystem))
+
+	h.registerRoute(http.MethodGet, "/volumes/{volume}/snapshots", h.handleListSnapshots)
+	h.registerRoute(http.MethodGet, "/volumes/{volume}/resume-token", h.handleGetResumeToken)
+	h.registerRoute(http.MethodDelete, "/volumes/{volume}/resume-token", h.audited(AuditAbortResumableReceive, h.handleAbortResumableReceive))
+
+	h.registerRoute(http.MethodGet, "/volumes/{volume}/snapshots/{snapshot}", h.handleGetSnapshot)
+	h.registerRoute(http.MethodGet, "/volumes/{volume}/snapshots/{snapshot}/incremental/{basesnapshot}", h.handleGetSnapshotIncremental)
+
+	h.registerRoute(http.MethodPost, "/volumes/{volume}/snapshots/{snapshot}", h.audited(AuditMakeSnapshot, h.handleMakeSnapshot))
+	h.registerRoute(http.MethodPut, "/volumes/{volume}/snapshots", h.audited(AuditReceiveSnapshot, h.handleReceiveSnapshot))
+	h.registerRoute(http.MethodPut, "/volumes/{volume}/snapshots/{snapshot}", h.audited(AuditReceiveSnapshot, h.handleReceiveSnapshot))
+	h.registerRoute(http.MethodPatch, "/volumes/{volume}/snapshots/{snapshot}", h.audited(AuditSetSnapshotProperties, h.handleSetSnapshotProps))
+	h.registerRoute(http.MethodDelete, "/volumes/{volume}/snapshots/{snapshot}", h.audited(AuditDestroySnapshot, h.handleDestroySnapshot))
+	h.registerRoute(http.MethodPost, "/volumes/{volume}/snapshots/{snapshot}/rollback", h.audited(AuditRollbackSnapshot, h.handleRollbackSnapshot))
+	h.registerRoute(http.MethodPost, "/volumes/{volume}/snapshots/{snapshot}/clone/{target}", h.audited(AuditCloneSnapshot, h.handleCloneSnapshot))
 }
 
 func (h *HTTP) registerRoute(method, url string, handler handle) {
-	h.router.HandleFunc(fmt.Sprintf("%s %s%s", method, h.config.HTTPPathPrefix, url), h.middleware(handler))
+	h.routes = append(h.routes, fmt.Sprintf("%s %s", method, url))
+	h.router.HandleFunc(fmt.Sprintf("%s %s%s", method, h.config.HTTPPathPrefix, url), h.instrument(method, url, h.middleware(handler)))
 }
 
 // middleware is an HTTP handler wrapper
@@ -75,6 +167,26 @@ func (h *HTTP) middleware(handle handle) http.HandlerFunc {
 			"remoteAddr", req.RemoteAddr,
 			"userAgent", req.UserAgent(),
 		)
+
+		identity, err := h.authenticate(req)
+		if err != nil {
+			logger.Warn("zfs.http.middleware: Authentication failed", "error", err)
+			w.Header().Set("WWW-Authenticate", authSchemeBearer)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if identity != nil {
+			logger = logger.With(slog.Group("identity",
+				"principal", identity.Principal,
+				"method", identity.Method,
+			))
+			req = req.WithContext(ContextWithIdentity(req.Context(), identity))
+		}
+		if !h.hasPolicy(req) {
+			logger.Warn("zfs.http.middleware: No policy for principal")
+			writeError(w, http.StatusForbidden, fmt.Errorf("%w: no policy for principal", ErrForbidden))
+			return
+		}
 		logger.Info("zfs.http.middleware: Handling")
 
 		handle(w, req, logger)
@@ -83,7 +195,7 @@ func (h *HTTP) middleware(handle handle) http.HandlerFunc {
 
 func (h *HTTP) getSpeed(req *http.Request) int64 {
 	speed := h.config.SpeedBytesPerSecond
-	if !h.config.Permissions.AllowSpeedOverride {
+	if !h.policy(req).Permissions.AllowSpeedOverride {
 		return speed
 	}
 	speedStr := req.URL.Query().Get(GETParamBytesPerSecond)
@@ -115,6 +227,103 @@ func (h *HTTP) getEnableDecompression(req *http.Request) bool {
 	return enable
 }
 
+func (h *HTTP) getFramed(req *http.Request) bool {
+	framed, _ := strconv.ParseBool(req.URL.Query().Get(GETParamFramed))
+	return framed
+}
+
+// getDecompression returns the decompression for a received stream. The stream encoding header
+// takes precedence over the legacy enable decompression parameter, which means zstd.
+func (h *HTTP) getDecompression(req *http.Request) (zfs.CompressionOptions, error) {
+	encoding := req.Header.Get(HeaderStreamEncoding)
+	if encoding == "" {
+		if h.getEnableDecompression(req) {
+			return zfs.CompressionOptions{Codec: zfs.CodecZstd}, nil
+		}
+		return zfs.CompressionOptions{}, nil
+	}
+
+	codec, err := zfs.ParseCodec(encoding)
+	if err != nil {
+		return zfs.CompressionOptions{}, err
+	}
+	return zfs.CompressionOptions{Codec: codec}, nil
+}
+
+// getCompression negotiates the compression for a stream sent to the client, and announces it in the response.
+// When the client lists the codecs it accepts, the first one the server supports is used. Otherwise the
+// legacy compression level parameter applies.
+func (h *HTTP) getCompression(w http.ResponseWriter, req *http.Request) zfs.CompressionOptions {
+	accept := req.Header.Get(HeaderAcceptStreamEncoding)
+	if accept == "" {
+		if h.getCompressionLevel(req) > 0 {
+			w.Header().Set(HeaderStreamEncoding, string(zfs.CodecZstd))
+		}
+		return zfs.CompressionOptions{}
+	}
+
+	for _, codec := range parseCodecList(accept) {
+		if codec == zfs.CodecNone || slices.Contains(zfs.SupportedCodecs, codec) {
+			w.Header().Set(HeaderStreamEncoding, string(codec))
+			return zfs.CompressionOptions{Codec: codec}
+		}
+	}
+	return zfs.CompressionOptions{Codec: zfs.CodecNone}
+}
+
+// parseCodecList parses a codec list in the format of the Accept-Encoding header. Parameters such as
+// quality values are ignored, the order of the list is the order of preference. Unknown codecs are skipped.
+func parseCodecList(list string) []zfs.Codec {
+	codecs := make([]zfs.Codec, 0, len(zfs.SupportedCodecs))
+	for _, item := range strings.Split(list, ",") {
+		name, _, _ := strings.Cut(item, ";")
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		codec, err := zfs.ParseCodec(name)
+		if err != nil {
+			continue
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+func formatCodecList(codecs []zfs.Codec) string {
+	names := make([]string, len(codecs))
+	for i := range codecs {
+		names[i] = string(codecs[i])
+	}
+	return strings.Join(names, ", ")
+}
+
+func (h *HTTP) getEncrypted(req *http.Request) bool {
+	encrypted, _ := strconv.ParseBool(req.URL.Query().Get(GETParamEncrypted))
+	return encrypted
+}
+
+// getDecryptionKeys returns the keys to decrypt a received stream with, if it is encrypted
+func (h *HTTP) getDecryptionKeys(req *http.Request) ([]zfs.StreamKey, error) {
+	if !h.getEncrypted(req) {
+		return nil, nil
+	}
+	if len(h.config.StreamKeys) == 0 {
+		return nil, errNoStreamKeys
+	}
+	return h.config.StreamKeys, nil
+}
+
+// getEncryptionKey returns the key to encrypt a sent stream with, if encryption was requested
+func (h *HTTP) getEncryptionKey(req *http.Request) (zfs.StreamKey, error) {
+	if !h.getEncrypted(req) {
+		return nil, nil
+	}
+	if len(h.config.StreamKeys) == 0 {
+		return nil, errNoStreamKeys
+	}
+	return h.config.StreamKeys[0], nil
+}
+
 func (h *HTTP) getCompressionLevel(req *http.Request) zstd.EncoderLevel {
 	level := zstd.EncoderLevel(0)
 	levelStr := req.URL.Query().Get(GETParamCompressionLevel)
@@ -126,7 +335,7 @@ func (h *HTTP) getCompressionLevel(req *http.Request) zstd.EncoderLevel {
 }
 
 func (h *HTTP) getRaw(req *http.Request) bool {
-	if !h.config.Permissions.AllowNonRaw {
+	if !h.policy(req).Permissions.AllowNonRaw {
 		return true
 	}
 	raw, _ := strconv.ParseBool(req.URL.Query().Get(GETParamRaw))
@@ -134,7 +343,7 @@ func (h *HTTP) getRaw(req *http.Request) bool {
 }
 
 func (h *HTTP) getIncludeProperties(req *http.Request) bool {
-	if !h.config.Permissions.AllowIncludeProperties {
+	if !h.policy(req).Permissions.AllowIncludeProperties {
 		return false
 	}
 	incl, _ := strconv.ParseBool(req.URL.Query().Get(GETParamIncludeProperties))
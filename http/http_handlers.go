@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	zfs "github.com/vansante/go-zfsutils"
+	"github.com/vansante/go-zfsutils/sendstream"
 )
 
 const (
@@ -24,12 +27,29 @@ const (
 	GETParamBytesPerSecond      = "bytesPerSecond"
 	GETParamEnableDecompression = "enableDecompression"
 	GETParamCompressionLevel    = "compressionLevel"
+	GETParamFramed              = "framed"
+	GETParamEncrypted           = "encrypted"
+	GETParamDestroyMoreRecent   = "destroyMoreRecent"
+	GETParamEventTypes          = "types"
 )
 
 const (
 	HeaderResumeReceiveToken  = "X-Receive-Resume-Token"
 	HeaderResumeReceivedBytes = "X-Received-Bytes"
 	HeaderError               = "X-Error"
+
+	// HeaderStreamEncoding names the compression codec of a stream body, like Content-Encoding
+	HeaderStreamEncoding = "X-Stream-Encoding"
+	// HeaderAcceptStreamEncoding lists compression codecs in order of preference, like Accept-Encoding.
+	// The server advertises its supported codecs with it, clients request a codec for streams they receive.
+	HeaderAcceptStreamEncoding = "X-Accept-Stream-Encoding"
+
+	// HeaderRetryAfter tells the client how many seconds to wait before retrying a refused receive
+	HeaderRetryAfter = "Retry-After"
+
+	// HeaderExpectedSize is the expected size of a received stream in bytes, like the estimate of zfs send -nvP.
+	// The server refuses receives up front that would not fit.
+	HeaderExpectedSize = "X-Expected-Size"
 )
 
 type ReceiveProperties map[string]string
@@ -66,6 +86,32 @@ func validIdentifier(name string) bool {
 	return validIdentifierRegexp.MatchString(name)
 }
 
+// maxDatasetPathLength is the maximum length of a dataset path relative to the parent dataset
+const maxDatasetPathLength = 200
+
+// validDatasetPath checks a filesystem path relative to the parent dataset, like customers/acme/db.
+// Every component has to be a valid identifier, so the path can never escape the parent dataset.
+func validDatasetPath(path string) bool {
+	if len(path) > maxDatasetPathLength {
+		return false
+	}
+	for _, component := range strings.Split(path, "/") {
+		if !validIdentifier(component) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathDataset returns the filesystem or volume path of the request, and the dataset type it has to be
+func pathDataset(req *http.Request) (string, zfs.DatasetType) {
+	volume := req.PathValue("volume")
+	if volume != "" {
+		return volume, zfs.DatasetVolume
+	}
+	return req.PathValue("filesystem"), zfs.DatasetFilesystem
+}
+
 func zfsExtraProperties(req *http.Request) []string {
 	fieldsStr := req.URL.Query().Get(GETParamExtraProperties)
 	if fieldsStr == "" {
@@ -83,20 +129,29 @@ func zfsExtraProperties(req *http.Request) []string {
 	return filtered
 }
 
+func (h *HTTP) handleListCodecs(w http.ResponseWriter, _ *http.Request, logger *slog.Logger) {
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(zfs.SupportedCodecs)
+	if err != nil {
+		logger.Error("zfs.http.handleListCodecs: Error encoding json", "error", err)
+		return
+	}
+}
+
 func (h *HTTP) handleListFilesystems(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
 	list, err := zfs.ListFilesystems(req.Context(), zfs.ListOptions{
-		ParentDataset:   h.config.ParentDataset,
+		ParentDataset:   h.policy(req).ParentDataset,
 		ExtraProperties: zfsExtraProperties(req),
 		Recursive:       true,
 	})
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleListFilesystems: Parent dataset not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleListFilesystems: Error getting filesystems", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -108,27 +163,52 @@ func (h *HTTP) handleListFilesystems(w http.ResponseWriter, req *http.Request, l
 	}
 }
 
+func (h *HTTP) handleListVolumes(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	list, err := zfs.ListVolumes(req.Context(), zfs.ListOptions{
+		ParentDataset:   h.policy(req).ParentDataset,
+		ExtraProperties: zfsExtraProperties(req),
+		Recursive:       true,
+	})
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleListVolumes: Parent dataset not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleListVolumes: Error getting volumes", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		logger.Error("zfs.http.handleListVolumes: Error encoding json", "error", err)
+		return
+	}
+}
+
 func (h *HTTP) handleSetFilesystemProps(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
-	if !validIdentifier(filesystem) {
+	filesystem, datasetType := pathDataset(req)
+	if !validDatasetPath(filesystem) {
 		logger.Info("zfs.http.handleSetFilesystemProps: Invalid identifier", "filesystem", filesystem)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(filesystem))
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleSetFilesystemProps: Filesystem not found", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleSetFilesystemProps: Error getting filesystem", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
-	case ds.Type != zfs.DatasetFilesystem:
+	case ds.Type != datasetType:
 		logger.Info("zfs.http.handleSetFilesystemProps: Invalid type", "type", ds.Type, "filesystem", filesystem)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
@@ -140,9 +220,11 @@ func (h *HTTP) setProperties(w http.ResponseWriter, req *http.Request, ds *zfs.D
 	err := json.NewDecoder(req.Body).Decode(props)
 	if err != nil {
 		logger.Error("zfs.http.setProperties: Error decoding properties", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: error decoding properties: %w", ErrInvalidRequest, err))
 		return
 	}
+	auditProperties(req, props.Set, props.Unset)
+
 	for prop, val := range props.Set {
 		err = ds.SetProperty(req.Context(), prop, val)
 		if err != nil {
@@ -151,7 +233,7 @@ func (h *HTTP) setProperties(w http.ResponseWriter, req *http.Request, ds *zfs.D
 				"property", prop,
 				"value", val,
 			)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	}
@@ -159,7 +241,7 @@ func (h *HTTP) setProperties(w http.ResponseWriter, req *http.Request, ds *zfs.D
 		err = ds.InheritProperty(req.Context(), prop)
 		if err != nil {
 			logger.Error("zfs.http.setProperties: Error inheriting property", "error", err, "property", prop)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	}
@@ -167,7 +249,7 @@ func (h *HTTP) setProperties(w http.ResponseWriter, req *http.Request, ds *zfs.D
 	ds, err = zfs.GetDataset(req.Context(), ds.Name, zfsExtraProperties(req)...)
 	if err != nil {
 		logger.Error("zfs.http.setProperties: Error fetching dataset", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -184,25 +266,41 @@ func (h *HTTP) setProperties(w http.ResponseWriter, req *http.Request, ds *zfs.D
 }
 
 func (h *HTTP) handleListSnapshots(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
-	if !validIdentifier(filesystem) {
+	filesystem, datasetType := pathDataset(req)
+	if !validDatasetPath(filesystem) {
 		logger.Info("zfs.http.handleListSnapshots: Invalid identifier", "filesystem", filesystem)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	parent, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleListSnapshots: Filesystem not found", "error", err, "filesystem", filesystem)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleListSnapshots: Error getting filesystem", "error", err, "filesystem", filesystem)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case parent.Type != datasetType:
+		logger.Info("zfs.http.handleListSnapshots: Invalid type", "filesystem", filesystem, "type", parent.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
 	list, err := zfs.ListSnapshots(req.Context(), zfs.ListOptions{
-		ParentDataset:   h.getFilesystem(filesystem),
+		ParentDataset:   h.getFilesystem(req, filesystem),
 		ExtraProperties: zfsExtraProperties(req),
 	})
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleListSnapshots: Filesystem not found", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleListSnapshots: Error getting filesystem", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -215,31 +313,31 @@ func (h *HTTP) handleListSnapshots(w http.ResponseWriter, req *http.Request, log
 }
 
 func (h *HTTP) handleGetResumeToken(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
-	if !validIdentifier(filesystem) {
+	filesystem, datasetType := pathDataset(req)
+	if !validDatasetPath(filesystem) {
 		logger.Info("zfs.http.handleGetResumeToken: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(filesystem), zfs.PropertyReceiveResumeToken)
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem), zfs.PropertyReceiveResumeToken)
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleGetResumeToken: Filesystem not found", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleGetResumeToken: Error getting filesystem", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
-	case ds.Type != zfs.DatasetFilesystem:
+	case ds.Type != datasetType:
 		logger.Info("zfs.http.handleGetResumeToken: Invalid type", "filesystem", filesystem, "type", ds.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
 	if len(ds.ExtraProps[zfs.PropertyReceiveResumeToken]) < 10 {
-		w.WriteHeader(http.StatusPreconditionFailed)
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("%w: no resume token on dataset", ErrResumeNotPossible))
 		return
 	}
 
@@ -248,24 +346,95 @@ func (h *HTTP) handleGetResumeToken(w http.ResponseWriter, req *http.Request, lo
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *HTTP) handleAbortResumableReceive(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	if !h.policy(req).Permissions.AllowAbortResumableReceive {
+		logger.Info("zfs.http.handleAbortResumableReceive: Abort forbidden")
+		writeError(w, http.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	filesystem, datasetType := pathDataset(req)
+	if !validDatasetPath(filesystem) {
+		logger.Info("zfs.http.handleAbortResumableReceive: Invalid identifier", "filesystem", filesystem)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem), zfs.PropertyReceiveResumeToken)
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleAbortResumableReceive: Filesystem not found", "error", err, "filesystem", filesystem)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleAbortResumableReceive: Error getting filesystem", "error", err, "filesystem", filesystem)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case ds.Type != datasetType:
+		logger.Info("zfs.http.handleAbortResumableReceive: Invalid type", "filesystem", filesystem, "type", ds.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	if len(ds.ExtraProps[zfs.PropertyReceiveResumeToken]) < 10 {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("%w: no resume token on dataset", ErrResumeNotPossible))
+		return
+	}
+
+	err = zfs.AbortResumableReceive(req.Context(), ds.Name)
+	if err != nil {
+		logger.Error("zfs.http.handleAbortResumableReceive: Error aborting receive", "error", err, "filesystem", filesystem)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("zfs.http.handleAbortResumableReceive: Resumable receive aborted",
+		"filesystem", filesystem, "dataset", ds.Name,
+	)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *HTTP) handleReceiveSnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
+	filesystem, _ := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	logger = logger.With(
 		"filesystem", filesystem,
 		"snapshot", snapshot,
 	)
 
-	if !validIdentifier(filesystem) || (snapshot != "" && !validIdentifier(snapshot)) {
+	end, ok := h.beginReceive()
+	if !ok {
+		logger.Info("zfs.http.handleReceiveSnapshot: Refusing receive, shutting down")
+		h.setRetryAfter(w)
+		writeError(w, http.StatusServiceUnavailable, ErrShuttingDown)
+		return
+	}
+	defer end()
+
+	if !validDatasetPath(filesystem) || (snapshot != "" && !validIdentifier(snapshot)) {
 		logger.Info("zfs.http.handleReceiveSnapshot: Invalid identifier")
-		w.Header().Set(HeaderError, "invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	decompression, err := h.getDecompression(req)
+	if err != nil {
+		logger.Info("zfs.http.handleReceiveSnapshot: Unsupported stream encoding", "error", err)
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	decryptionKeys, err := h.getDecryptionKeys(req)
+	if err != nil {
+		logger.Info("zfs.http.handleReceiveSnapshot: Cannot decrypt stream", "error", err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	givenResumeToken := req.Header.Get(HeaderResumeReceiveToken)
 	datasetResumeToken := ""
-	ds, dsErr := zfs.GetDataset(req.Context(), h.getFilesystem(filesystem), zfs.PropertyReceiveResumeToken)
+	ds, dsErr := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem), zfs.PropertyReceiveResumeToken)
 	if dsErr == nil {
 		datasetResumeToken = ds.ExtraProps[zfs.PropertyReceiveResumeToken]
 	}
@@ -277,8 +446,7 @@ func (h *HTTP) handleReceiveSnapshot(w http.ResponseWriter, req *http.Request, l
 
 	if datasetResumeToken == "" && givenResumeToken != "" {
 		logger.Info("zfs.http.handleReceiveSnapshot: Got resume token but found none on dataset", "resumeToken", givenResumeToken)
-		w.Header().Set(HeaderError, "no resume token on dataset")
-		w.WriteHeader(http.StatusPreconditionFailed)
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("%w: no resume token on dataset", ErrResumeNotPossible))
 		return
 	}
 
@@ -287,64 +455,134 @@ func (h *HTTP) handleReceiveSnapshot(w http.ResponseWriter, req *http.Request, l
 			"givenResumeToken", givenResumeToken,
 			"actualResumeToken", datasetResumeToken,
 		)
-		w.Header().Set(HeaderError, "invalid resume token")
-		w.WriteHeader(http.StatusExpectationFailed)
+		writeError(w, http.StatusExpectationFailed, ErrInvalidResumeToken)
 		return
 	}
 
+	size, err := expectedSize(req)
+	if err != nil {
+		logger.Info("zfs.http.handleReceiveSnapshot: Invalid expected size", "error", err)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	reservation, status, err := h.admitReceive(req, filesystem, size)
+	if err != nil {
+		logger.Warn("zfs.http.handleReceiveSnapshot: Refusing receive", "error", err, "expectedSize", size)
+		writeError(w, status, err)
+		return
+	}
+	defer reservation.release()
+
 	resumable, _ := strconv.ParseBool(req.URL.Query().Get(GETParamResumable))
 	props, _ := DecodeReceiveProperties(req.URL.Query().Get(GETParamReceiveProperties))
+	auditProperties(req, props, nil)
 
-	receiveDataset := h.getSnapshot(filesystem, snapshot)
+	receiveDataset := h.getSnapshot(req, filesystem, snapshot)
 	if snapshot == "" {
-		receiveDataset = h.getFilesystem(filesystem)
+		receiveDataset = h.getFilesystem(req, filesystem)
 	}
 
-	// If we are configured to limit receives
-	if h.config.MaximumConcurrentReceives > 0 {
-		h.receiveMutex.Lock()
-		curRcvCount := h.receiveCount
-		if curRcvCount >= h.config.MaximumConcurrentReceives {
-			h.receiveMutex.Unlock()
-			logger.Warn("zfs.http.handleReceiveSnapshot: Returning 429 Too Many Requests",
-				"receives", curRcvCount, "maxReceives", h.config.MaximumConcurrentReceives,
-			)
-			w.Header().Set(HeaderError, fmt.Sprintf("maximum concurrent receives of %d exceeded", h.config.MaximumConcurrentReceives))
-			w.WriteHeader(http.StatusTooManyRequests)
-			return
-		}
-		// Reserve a slot
-		h.receiveCount++
-		h.receiveMutex.Unlock()
-
-		logger.Debug("zfs.http.handleReceiveSnapshot: Receive slot claimed",
-			"receives", curRcvCount+1, "maxReceives", h.config.MaximumConcurrentReceives,
-		)
+	release, limit, ok := h.claimReceiveSlot(req, logger)
+	if !ok && h.isShuttingDown() {
+		logger.Info("zfs.http.handleReceiveSnapshot: Gave up waiting for a slot, shutting down")
+		h.setRetryAfter(w)
+		writeError(w, http.StatusServiceUnavailable, ErrShuttingDown)
+		return
+	}
+	if !ok {
+		logger.Warn("zfs.http.handleReceiveSnapshot: Returning 429 Too Many Requests", "maxReceives", limit)
+		h.metrics.receiveRejections.Add(1)
+		h.setRetryAfter(w)
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("%w: maximum concurrent receives of %d exceeded", ErrTooManyRequests, limit))
+		return
+	}
+	defer release()
 
-		defer func() {
-			// Unlock the slot at request completion
-			h.receiveMutex.Lock()
-			h.receiveCount--
-			h.receiveMutex.Unlock()
-		}()
+	err = h.createParentFilesystems(req, filesystem)
+	if err != nil {
+		logger.Error("zfs.http.handleReceiveSnapshot: Error creating parent filesystems", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	ds, err := zfs.ReceiveSnapshot(req.Context(), req.Body, receiveDataset, zfs.ReceiveOptions{
-		EnableDecompression: h.getEnableDecompression(req),
-		ForceRollback:       h.getReceiveForceRollback(req),
-		Resumable:           resumable,
-		Properties:          props,
+	quota := &quotaReader{r: req.Body, reservation: reservation}
+	var body io.Reader = quota
+
+	ctx, active, body, untrack := h.trackReceive(req, receiveDataset, body)
+	defer untrack()
+	logger = logger.With("receiveID", active.receive.ID)
+
+	// Pace on the receive context, so canceling or interrupting the receive also ends a wait for bandwidth
+	stream := h.joinBandwidth(ctx, req)
+	defer stream.leave()
+	body = stream.reader(body)
+	h.publishReceiveEvent(ReceiveStartedEvent, active, nil)
+
+	ds, err = zfs.ReceiveSnapshot(ctx, body, receiveDataset, zfs.ReceiveOptions{
+		Decompression:  decompression,
+		Framed:         h.getFramed(req),
+		DecryptionKeys: decryptionKeys,
+		ForceRollback:  h.getReceiveForceRollback(req),
+		Resumable:      resumable,
+		Properties:     props,
+		InspectHeader: func(header *sendstream.Header) error {
+			logger.Debug("zfs.http.handleReceiveSnapshot: Stream header decoded",
+				"toName", header.ToName,
+				"incremental", header.Incremental(),
+				"raw", header.Raw(),
+				"resuming", header.Resuming(),
+			)
+			if givenResumeToken != "" && !header.Resuming() {
+				return fmt.Errorf("%w: resume token given for a stream that does not resume", sendstream.ErrInvalidStream)
+			}
+			return nil
+		},
 	})
+	h.publishReceiveEvent(ReceiveFinishedEvent, active, err)
+	auditBytesReceived(req, active.counter.Count())
+	var frameErr *zfs.FrameError
 	switch {
+	case err != nil && active.interrupted.Load():
+		logger.Warn("zfs.http.handleReceiveSnapshot: Receive interrupted by shutdown", "error", err)
+		h.metrics.receiveFailed(ErrorCodeShuttingDown)
+		h.setInterruptedResumeToken(w, req, filesystem, logger)
+		h.setRetryAfter(w)
+		writeError(w, http.StatusServiceUnavailable, ErrShuttingDown)
+		return
+	case err != nil && active.canceled.Load():
+		logger.Warn("zfs.http.handleReceiveSnapshot: Receive canceled", "error", err)
+		h.metrics.receiveFailed(ErrorCodeReceiveCanceled)
+		writeError(w, http.StatusGone, ErrReceiveCanceled)
+		return
+	case err != nil && quota.exceeded:
+		logger.Warn("zfs.http.handleReceiveSnapshot: Quota exceeded during receive", "error", err)
+		h.metrics.receiveFailed(ErrorCodeQuotaExceeded)
+		writeError(w, http.StatusInsufficientStorage, ErrQuotaExceeded)
+		return
+	case errors.As(err, &frameErr):
+		logger.Warn("zfs.http.handleReceiveSnapshot: Stream failed verification", "error", err, "offset", frameErr.Offset)
+		h.metrics.receiveFailed(errorCode(err, http.StatusUnprocessableEntity))
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	case errors.Is(err, zfs.ErrStreamDecryption):
+		logger.Warn("zfs.http.handleReceiveSnapshot: Stream failed decryption", "error", err)
+		h.metrics.receiveFailed(errorCode(err, http.StatusUnprocessableEntity))
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	case errors.Is(err, sendstream.ErrInvalidStream), errors.Is(err, zfs.ErrUnknownStreamKey):
+		logger.Info("zfs.http.handleReceiveSnapshot: Invalid stream", "error", err)
+		h.metrics.receiveFailed(errorCode(err, http.StatusBadRequest))
+		writeError(w, http.StatusBadRequest, err)
+		return
 	case errors.Is(err, zfs.ErrDatasetExists):
 		logger.Warn("zfs.http.handleReceiveSnapshot: Dataset already exists")
-		w.Header().Set(HeaderError, err.Error())
-		w.WriteHeader(http.StatusConflict)
+		h.metrics.receiveFailed(errorCode(err, http.StatusConflict))
+		writeError(w, http.StatusConflict, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleReceiveSnapshot: Error storing", "error", err)
-		w.Header().Set(HeaderError, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		h.metrics.receiveFailed(errorCode(err, http.StatusInternalServerError))
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -360,33 +598,68 @@ func (h *HTTP) handleReceiveSnapshot(w http.ResponseWriter, req *http.Request, l
 	}
 }
 
+// publishReceiveEvent publishes the start or finish of a receive to the event stream
+func (h *HTTP) publishReceiveEvent(eventType string, active *activeReceive, err error) {
+	dataset, snapshot, _ := strings.Cut(active.receive.Dataset, "@")
+	event := Event{
+		Type:      eventType,
+		Dataset:   dataset,
+		Snapshot:  snapshot,
+		Principal: active.receive.Principal,
+		ReceiveID: active.receive.ID,
+	}
+	if eventType == ReceiveFinishedEvent {
+		event.Bytes = active.counter.Count()
+		event.DurationSeconds = time.Since(active.receive.Started).Seconds()
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	h.events.Publish(event)
+}
+
+// setInterruptedResumeToken sets the resume token an interrupted resumable receive left on the filesystem,
+// so the client can resume it
+func (h *HTTP) setInterruptedResumeToken(w http.ResponseWriter, req *http.Request, filesystem string, logger *slog.Logger) {
+	w.Header().Del(HeaderResumeReceiveToken)
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem), zfs.PropertyReceiveResumeToken)
+	if err != nil {
+		logger.Info("zfs.http.setInterruptedResumeToken: No resume state", "error", err)
+		return
+	}
+	token := ds.ExtraProps[zfs.PropertyReceiveResumeToken]
+	if token != "" {
+		w.Header().Set(HeaderResumeReceiveToken, token)
+	}
+}
+
 func (h *HTTP) handleSetSnapshotProps(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
+	filesystem, _ := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	logger = logger.With(
 		"filesystem", filesystem,
 		"snapshot", snapshot,
 	)
 
-	if !validIdentifier(filesystem) || !validIdentifier(snapshot) {
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) {
 		logger.Info("zfs.http.handleSetSnapshotProps: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(filesystem, snapshot))
+	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleSetSnapshotProps: Snapshot not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleSetSnapshotProps: Error getting snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	case ds.Type != zfs.DatasetSnapshot:
 		logger.Info("zfs.http.handleSetSnapshotProps: Invalid type", "type", ds.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
@@ -394,40 +667,69 @@ func (h *HTTP) handleSetSnapshotProps(w http.ResponseWriter, req *http.Request,
 }
 
 func (h *HTTP) handleGetSnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
+	filesystem, datasetType := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	logger = logger.With(
 		"filesystem", filesystem,
 		"snapshot", snapshot,
 	)
 
-	if !validIdentifier(filesystem) || !validIdentifier(snapshot) {
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) {
 		logger.Info("zfs.http.handleGetSnapshot: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	parent, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleGetSnapshot: Filesystem not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleGetSnapshot: Error getting filesystem", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case parent.Type != datasetType:
+		logger.Info("zfs.http.handleGetSnapshot: Invalid type", "type", parent.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(filesystem, snapshot))
+	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleGetSnapshot: Snapshot not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleGetSnapshot: Error getting snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	case ds.Type != zfs.DatasetSnapshot:
 		logger.Info("zfs.http.handleGetSnapshot: Invalid type", "type", ds.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	key, err := h.getEncryptionKey(req)
+	if err != nil {
+		logger.Info("zfs.http.handleGetSnapshot: Cannot encrypt stream", "error", err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	err = ds.SendSnapshot(req.Context(), w, zfs.SendOptions{
+	stream := h.joinBandwidth(req.Context(), req)
+	defer stream.leave()
+
+	err = ds.SendSnapshot(req.Context(), stream.writer(w), zfs.SendOptions{
 		BytesPerSecond:    h.getSpeed(req),
 		IncludeProperties: h.getIncludeProperties(req),
 		Raw:               h.getRaw(req),
 		CompressionLevel:  h.getCompressionLevel(req),
+		Compression:       h.getCompression(w, req),
+		Framed:            h.getFramed(req),
+		EncryptionKey:     key,
 	})
 	if err != nil {
 		logger.Error("zfs.http.handleGetSnapshot: Error sending snapshot", "error", err)
@@ -436,7 +738,7 @@ func (h *HTTP) handleGetSnapshot(w http.ResponseWriter, req *http.Request, logge
 }
 
 func (h *HTTP) handleGetSnapshotIncremental(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
+	filesystem, datasetType := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	basesnapshot := req.PathValue("basesnapshot")
 	logger = logger.With(
@@ -445,50 +747,79 @@ func (h *HTTP) handleGetSnapshotIncremental(w http.ResponseWriter, req *http.Req
 		"basesnapshot", basesnapshot,
 	)
 
-	if !validIdentifier(filesystem) || !validIdentifier(basesnapshot) || !validIdentifier(snapshot) {
+	if !validDatasetPath(filesystem) || !validIdentifier(basesnapshot) || !validIdentifier(snapshot) {
 		logger.Info("zfs.http.handleGetSnapshotIncremental: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	snap, err := zfs.GetDataset(req.Context(), h.getSnapshot(filesystem, snapshot))
+	parent, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleGetSnapshotIncremental: Filesystem not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleGetSnapshotIncremental: Error getting filesystem", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case parent.Type != datasetType:
+		logger.Info("zfs.http.handleGetSnapshotIncremental: Invalid type", "type", parent.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	snap, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleGetSnapshotIncremental: Snapshot not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleGetSnapshotIncremental: Error getting snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	case snap.Type != zfs.DatasetSnapshot:
 		logger.Info("zfs.http.handleGetSnapshotIncremental: Invalid base type", "type", snap.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
-	base, err := zfs.GetDataset(req.Context(), h.getSnapshot(filesystem, basesnapshot))
+	base, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, basesnapshot))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleGetSnapshotIncremental: Base snapshot not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleGetSnapshotIncremental: Error getting base snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	case base.Type != zfs.DatasetSnapshot:
 		logger.Info("zfs.http.handleGetSnapshotIncremental: Invalid base type", "type", base.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
-	err = snap.SendSnapshot(req.Context(), w, zfs.SendOptions{
+	key, err := h.getEncryptionKey(req)
+	if err != nil {
+		logger.Info("zfs.http.handleGetSnapshotIncremental: Cannot encrypt stream", "error", err)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	stream := h.joinBandwidth(req.Context(), req)
+	defer stream.leave()
+
+	err = snap.SendSnapshot(req.Context(), stream.writer(w), zfs.SendOptions{
 		BytesPerSecond:    h.getSpeed(req),
 		IncludeProperties: h.getIncludeProperties(req),
 		Raw:               h.getRaw(req),
 		IncrementalBase:   base,
 		CompressionLevel:  h.getCompressionLevel(req),
+		Compression:       h.getCompression(w, req),
+		Framed:            h.getFramed(req),
+		EncryptionKey:     key,
 	})
 	if err != nil {
 		logger.Error("zfs.http.handleGetSnapshotIncremental: Error sending incremental snapshot", "error", err)
@@ -500,13 +831,34 @@ func (h *HTTP) handleResumeGetSnapshot(w http.ResponseWriter, req *http.Request,
 	token := req.PathValue("token")
 	if !validResumeTokenRegexp.MatchString(token) {
 		logger.Info("zfs.http.handleResumeGetSnapshot: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	key, err := h.getEncryptionKey(req)
+	if err != nil {
+		logger.Info("zfs.http.handleResumeGetSnapshot: Cannot encrypt stream", "error", err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	err := zfs.ResumeSend(req.Context(), w, token, zfs.ResumeSendOptions{
+	// Check the token with a dry run first, once the stream started a stale token can no longer be reported
+	_, err = zfs.ResumeSendSize(req.Context(), token)
+	if err != nil {
+		logger.Info("zfs.http.handleResumeGetSnapshot: Cannot resume send", "error", err, "token", token)
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("%w: %w", ErrResumeNotPossible, err))
+		return
+	}
+
+	stream := h.joinBandwidth(req.Context(), req)
+	defer stream.leave()
+
+	err = zfs.ResumeSend(req.Context(), stream.writer(w), token, zfs.ResumeSendOptions{
 		BytesPerSecond:   h.getSpeed(req),
 		CompressionLevel: h.getCompressionLevel(req),
+		Compression:      h.getCompression(w, req),
+		Framed:           h.getFramed(req),
+		EncryptionKey:    key,
 	})
 	if err != nil {
 		logger.Error("zfs.http.handleResumeGetSnapshot: Error sending snapshot", "error", err, "token", token)
@@ -515,32 +867,32 @@ func (h *HTTP) handleResumeGetSnapshot(w http.ResponseWriter, req *http.Request,
 }
 
 func (h *HTTP) handleMakeSnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	filesystem := req.PathValue("filesystem")
+	filesystem, datasetType := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	logger = logger.With(
 		"filesystem", filesystem,
 		"snapshot", snapshot,
 	)
 
-	if !validIdentifier(filesystem) || !validIdentifier(snapshot) {
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) {
 		logger.Info("zfs.http.handleMakeSnapshot: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(filesystem))
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleMakeSnapshot: Filesystem not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleMakeSnapshot: Error getting filesystem", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
-	case ds.Type != zfs.DatasetFilesystem:
+	case ds.Type != datasetType:
 		logger.Info("zfs.http.handleMakeSnapshot: Invalid type", "type", ds.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
@@ -548,11 +900,11 @@ func (h *HTTP) handleMakeSnapshot(w http.ResponseWriter, req *http.Request, logg
 	switch {
 	case errors.Is(err, zfs.ErrDatasetExists):
 		logger.Warn("zfs.http.handleMakeSnapshot: Dataset already exists", "error", err)
-		w.WriteHeader(http.StatusConflict)
+		writeError(w, http.StatusConflict, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleMakeSnapshot: Error making snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -567,32 +919,32 @@ func (h *HTTP) handleMakeSnapshot(w http.ResponseWriter, req *http.Request, logg
 }
 
 func (h *HTTP) handleDestroyFilesystem(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	if !h.config.Permissions.AllowDestroyFilesystems {
+	if !h.policy(req).Permissions.AllowDestroyFilesystems {
 		logger.Info("zfs.http.handleDestroyFilesystem: Destroy forbidden")
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, http.StatusForbidden, ErrForbidden)
 		return
 	}
 
-	filesystem := req.PathValue("filesystem")
-	if !validIdentifier(filesystem) {
+	filesystem, datasetType := pathDataset(req)
+	if !validDatasetPath(filesystem) {
 		logger.Info("zfs.http.handleDestroyFilesystem: Invalid identifier", "filesystem", filesystem)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(filesystem))
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleDestroyFilesystem: Filesystem not found", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleDestroyFilesystem: Error getting filesystem", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
-	case ds.Type != zfs.DatasetFilesystem:
+	case ds.Type != datasetType:
 		logger.Info("zfs.http.handleDestroyFilesystem: Invalid type", "type", ds.Type, "filesystem", filesystem)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
@@ -600,7 +952,7 @@ func (h *HTTP) handleDestroyFilesystem(w http.ResponseWriter, req *http.Request,
 	err = ds.Destroy(req.Context(), zfs.DestroyOptions{})
 	if err != nil {
 		logger.Error("zfs.http.handleDestroyFilesystem: Error destroying", "error", err, "filesystem", filesystem)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -612,45 +964,45 @@ func (h *HTTP) handleDestroyFilesystem(w http.ResponseWriter, req *http.Request,
 }
 
 func (h *HTTP) handleDestroySnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
-	if !h.config.Permissions.AllowDestroySnapshots {
+	if !h.policy(req).Permissions.AllowDestroySnapshots {
 		logger.Info("zfs.http.handleDestroySnapshot: Destroy forbidden")
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, http.StatusForbidden, ErrForbidden)
 		return
 	}
 
-	filesystem := req.PathValue("filesystem")
+	filesystem, _ := pathDataset(req)
 	snapshot := req.PathValue("snapshot")
 	logger = logger.With(
 		"filesystem", filesystem,
 		"snapshot", snapshot,
 	)
 
-	if !validIdentifier(filesystem) || !validIdentifier(snapshot) {
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) {
 		logger.Info("zfs.http.handleDestroySnapshot: Invalid identifier")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
 		return
 	}
 
-	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(filesystem, snapshot))
+	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
 		logger.Info("zfs.http.handleDestroySnapshot: Snapshot not found", "error", err)
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err)
 		return
 	case err != nil:
 		logger.Error("zfs.http.handleDestroySnapshot: Error getting snapshot", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	case ds.Type != zfs.DatasetSnapshot:
 		logger.Info("zfs.http.handleDestroySnapshot: Invalid type", "type", ds.Type)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
 		return
 	}
 
 	err = ds.Destroy(req.Context(), zfs.DestroyOptions{})
 	if err != nil {
 		logger.Error("zfs.http.handleDestroySnapshot: Error destroying", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -659,16 +1011,220 @@ func (h *HTTP) handleDestroySnapshot(w http.ResponseWriter, req *http.Request, l
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *HTTP) getFilesystem(filesystem string) string {
-	if h.config.ParentDataset == "" {
+func (h *HTTP) handleRollbackSnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	if !h.policy(req).Permissions.AllowRollback {
+		logger.Info("zfs.http.handleRollbackSnapshot: Rollback forbidden")
+		writeError(w, http.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	filesystem, _ := pathDataset(req)
+	snapshot := req.PathValue("snapshot")
+	logger = logger.With(
+		"filesystem", filesystem,
+		"snapshot", snapshot,
+	)
+
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) {
+		logger.Info("zfs.http.handleRollbackSnapshot: Invalid identifier")
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleRollbackSnapshot: Snapshot not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleRollbackSnapshot: Error getting snapshot", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case ds.Type != zfs.DatasetSnapshot:
+		logger.Info("zfs.http.handleRollbackSnapshot: Invalid type", "type", ds.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	destroyMoreRecent, _ := strconv.ParseBool(req.URL.Query().Get(GETParamDestroyMoreRecent))
+	err = ds.Rollback(req.Context(), zfs.RollbackOptions{DestroyMoreRecent: destroyMoreRecent})
+	switch {
+	case errors.Is(err, zfs.ErrMoreRecentSnapshotsExist):
+		logger.Info("zfs.http.handleRollbackSnapshot: More recent snapshots exist", "error", err)
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleRollbackSnapshot: Error rolling back", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("zfs.http.handleRollbackSnapshot: Rolled back to snapshot", "dataset", ds.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTP) handleCloneSnapshot(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	if !h.policy(req).Permissions.AllowClone {
+		logger.Info("zfs.http.handleCloneSnapshot: Clone forbidden")
+		writeError(w, http.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	filesystem, _ := pathDataset(req)
+	snapshot := req.PathValue("snapshot")
+	target := req.PathValue("target")
+	logger = logger.With(
+		"filesystem", filesystem,
+		"snapshot", snapshot,
+		"target", target,
+	)
+
+	if !validDatasetPath(filesystem) || !validIdentifier(snapshot) || !validDatasetPath(target) {
+		logger.Info("zfs.http.handleCloneSnapshot: Invalid identifier")
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	ds, err := zfs.GetDataset(req.Context(), h.getSnapshot(req, filesystem, snapshot))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleCloneSnapshot: Snapshot not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleCloneSnapshot: Error getting snapshot", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case ds.Type != zfs.DatasetSnapshot:
+		logger.Info("zfs.http.handleCloneSnapshot: Invalid type", "type", ds.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	clone, err := ds.Clone(req.Context(), h.getFilesystem(req, target), zfs.CloneOptions{CreateParents: true})
+	switch {
+	case errors.Is(err, zfs.ErrDatasetExists):
+		logger.Info("zfs.http.handleCloneSnapshot: Target already exists", "error", err)
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleCloneSnapshot: Error cloning snapshot", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("zfs.http.handleCloneSnapshot: Snapshot cloned", "dataset", clone.Name)
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(clone)
+	if err != nil {
+		logger.Error("zfs.http.handleCloneSnapshot: Error encoding json", "error", err)
+		return
+	}
+}
+
+func (h *HTTP) handleRenameFilesystem(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	if !h.policy(req).Permissions.AllowRename {
+		logger.Info("zfs.http.handleRenameFilesystem: Rename forbidden")
+		writeError(w, http.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	filesystem, datasetType := pathDataset(req)
+	target := req.PathValue("target")
+	logger = logger.With(
+		"filesystem", filesystem,
+		"target", target,
+	)
+
+	if !validDatasetPath(filesystem) || !validDatasetPath(target) {
+		logger.Info("zfs.http.handleRenameFilesystem: Invalid identifier")
+		writeError(w, http.StatusBadRequest, ErrInvalidIdentifier)
+		return
+	}
+
+	ds, err := zfs.GetDataset(req.Context(), h.getFilesystem(req, filesystem))
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		logger.Info("zfs.http.handleRenameFilesystem: Filesystem not found", "error", err)
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleRenameFilesystem: Error getting filesystem", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	case ds.Type != datasetType:
+		logger.Info("zfs.http.handleRenameFilesystem: Invalid type", "type", ds.Type)
+		writeError(w, http.StatusBadRequest, ErrInvalidDatasetType)
+		return
+	}
+
+	name := h.getFilesystem(req, target)
+	err = ds.Rename(req.Context(), name, zfs.RenameOptions{CreateParent: true})
+	switch {
+	case errors.Is(err, zfs.ErrDatasetExists):
+		logger.Info("zfs.http.handleRenameFilesystem: Target already exists", "error", err)
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		logger.Error("zfs.http.handleRenameFilesystem: Error renaming", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ds, err = zfs.GetDataset(req.Context(), name)
+	if err != nil {
+		logger.Error("zfs.http.handleRenameFilesystem: Error getting renamed filesystem", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("zfs.http.handleRenameFilesystem: Filesystem renamed", "dataset", ds.Name)
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ds)
+	if err != nil {
+		logger.Error("zfs.http.handleRenameFilesystem: Error encoding json", "error", err)
+		return
+	}
+}
+
+// createParentFilesystems creates the missing intermediate filesystems of a nested filesystem path,
+// because zfs receive does not create them
+func (h *HTTP) createParentFilesystems(req *http.Request, filesystem string) error {
+	idx := strings.LastIndex(filesystem, "/")
+	if idx < 0 {
+		return nil
+	}
+	parent := h.getFilesystem(req, filesystem[:idx])
+	_, err := zfs.GetDataset(req.Context(), parent)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, zfs.ErrDatasetNotFound):
+		return fmt.Errorf("error getting parent filesystem %s: %w", parent, err)
+	}
+	_, err = zfs.CreateFilesystem(req.Context(), parent, zfs.CreateFilesystemOptions{CreateParents: true})
+	if err != nil {
+		return fmt.Errorf("error creating parent filesystem %s: %w", parent, err)
+	}
+	return nil
+}
+
+func (h *HTTP) getFilesystem(req *http.Request, filesystem string) string {
+	parent := h.policy(req).ParentDataset
+	if parent == "" {
 		return filesystem
 	}
-	return fmt.Sprintf("%s/%s", h.config.ParentDataset, filesystem)
+	return fmt.Sprintf("%s/%s", parent, filesystem)
 }
 
-func (h *HTTP) getSnapshot(filesystem, snapshot string) string {
-	if h.config.ParentDataset == "" {
+func (h *HTTP) getSnapshot(req *http.Request, filesystem, snapshot string) string {
+	parent := h.policy(req).ParentDataset
+	if parent == "" {
 		return fmt.Sprintf("%s@%s", filesystem, snapshot)
 	}
-	return fmt.Sprintf("%s/%s@%s", h.config.ParentDataset, filesystem, snapshot)
+	return fmt.Sprintf("%s/%s@%s", parent, filesystem, snapshot)
 }
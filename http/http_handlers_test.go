@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -206,6 +208,30 @@ func TestHTTP_handleGetSnapshotIncremental(t *testing.T) {
 	})
 }
 
+func TestHTTP_snapshotsWrongDatasetType(t *testing.T) {
+	httpHandlerTest(t, func(url string) {
+		ds, err := zfs.GetDataset(context.Background(), testFilesystem)
+		require.NoError(t, err)
+		_, err = ds.Snapshot(context.Background(), "snap1", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+		_, err = ds.Snapshot(context.Background(), "snap2", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		// A filesystem is not served under the volume paths
+		for _, path := range []string{
+			"snapshots",
+			"snapshots/snap2",
+			"snapshots/snap2/incremental/snap1",
+		} {
+			resp, err := http.Get(fmt.Sprintf("%s/volumes/%s/%s", url, testFilesystemName, path))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+			require.ErrorIs(t, responseError(resp), ErrInvalidDatasetType, path)
+			require.NoError(t, resp.Body.Close())
+		}
+	})
+}
+
 func TestHTTP_handleResumeGetSnapshot(t *testing.T) {
 	httpHandlerTest(t, func(url string) {
 		const snapName = "snappie"
@@ -269,6 +295,21 @@ func TestHTTP_handleResumeGetSnapshot(t *testing.T) {
 	})
 }
 
+func TestHTTP_handleResumeGetSnapshotStaleToken(t *testing.T) {
+	httpHandlerTest(t, func(url string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/snapshot/resume/%s",
+			url, strings.Repeat("a1b2c3", 30),
+		), nil)
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.EqualValues(t, http.StatusPreconditionFailed, resp.StatusCode)
+		require.ErrorIs(t, responseError(resp), ErrResumeNotPossible)
+	})
+}
+
 func TestHTTP_handleReceiveSnapshot(t *testing.T) {
 	httpHandlerTest(t, func(url string) {
 		const snapName = "send"
@@ -490,27 +531,26 @@ func TestHTTP_handleReceiveSnapshotResume(t *testing.T) {
 
 func TestHTTP_handleReceiveSnapshotMaxConcurrent(t *testing.T) {
 	httpHandlerTest(t, func(url string) {
-		startMutex := sync.RWMutex{}
-		startMutex.Lock()
 		endWg := sync.WaitGroup{}
-
-		const snapName = "snappy"
-
-		ds, err := zfs.GetDataset(context.Background(), testFilesystem)
-		require.NoError(t, err)
-
-		ds, err = ds.Snapshot(context.Background(), snapName, zfs.SnapshotOptions{})
-		require.NoError(t, err)
+		// The bodies stall until released, so the receives that got a slot keep it while the others are refused
+		release := make(chan struct{})
 
 		const newSnap = "recv"
 		var countError, countTooMany int32
 		endWg.Add(4)
 		for i, name := range []string{"bla1", "bla2", "bla3", "bla4"} {
 			go func(i int, name string) {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+				defer endWg.Done()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer cancel()
 
-				body := bytes.NewBuffer([]byte{0, 0, 7})
+				body, bodyWrtr := io.Pipe()
+				go func() {
+					_, _ = bodyWrtr.Write([]byte{0, 0, 7})
+					<-release
+					_ = bodyWrtr.Close()
+				}()
 				req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/filesystems/%s/snapshots/%s?%s=%s",
 					url, name,
 					newSnap,
@@ -518,35 +558,193 @@ func TestHTTP_handleReceiveSnapshotMaxConcurrent(t *testing.T) {
 						zfs.PropertyCanMount: zfs.ValueOff,
 					}.Encode(),
 				), body)
-
-				startMutex.RLock()
-				defer startMutex.RUnlock()
+				require.NoError(t, err)
 
 				resp, err := http.DefaultClient.Do(req)
 				require.NoError(t, err)
 				_ = resp.Body.Close()
 
 				switch resp.StatusCode {
-				case http.StatusInternalServerError:
+				case http.StatusBadRequest:
 					atomic.AddInt32(&countError, 1)
-					endWg.Done()
-					t.Logf("%d: Received OK", i)
+					t.Logf("%d: Received invalid stream", i)
 				case http.StatusTooManyRequests:
 					atomic.AddInt32(&countTooMany, 1)
-					endWg.Done()
 					t.Logf("%d: Received too many requests", i)
 				default:
-					endWg.Done()
 					t.Logf("%d: Got unexpected status code %d", i, resp.StatusCode)
 					t.Fail()
 				}
 			}(i, name)
 		}
-		startMutex.Unlock()
-		time.Sleep(10 * time.Millisecond)
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&countTooMany) == 2
+		}, 5*time.Second, 10*time.Millisecond, "the receives without slot are refused")
+		close(release)
 		endWg.Wait()
 
-		require.GreaterOrEqual(t, countTooMany, int32(1), "CountTooMany not returned")
-		require.GreaterOrEqual(t, countError, int32(2), "CountError is not at least 2")
+		require.EqualValues(t, 2, countTooMany, "CountTooMany is not 2")
+		require.EqualValues(t, 2, countError, "CountError is not 2")
+	})
+}
+
+func TestHTTP_handleReceiveSnapshotUnsupportedCodec(t *testing.T) {
+	httpHandlerTest(t, func(url string) {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/filesystems/%s/snapshots/%s",
+			url, "bla", "recv",
+		), bytes.NewBuffer([]byte{0, 0, 7}))
+		require.NoError(t, err)
+		req.Header.Set(HeaderStreamEncoding, "brotli")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+		require.Equal(t, "zstd, lz4, gzip", resp.Header.Get(HeaderAcceptStreamEncoding))
 	})
 }
+
+func TestHTTP_getCompression(t *testing.T) {
+	h := &HTTP{}
+	for accept, expect := range map[string]zfs.Codec{
+		"":                         "",
+		"lz4, zstd":                zfs.CodecLZ4,
+		"brotli;q=1.0, gzip;q=0.5": zfs.CodecGzip,
+		"brotli":                   zfs.CodecNone,
+		"none, zstd":               zfs.CodecNone,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if accept != "" {
+			req.Header.Set(HeaderAcceptStreamEncoding, accept)
+		}
+		w := httptest.NewRecorder()
+		require.Equal(t, expect, h.getCompression(w, req).Codec, accept)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?"+GETParamCompressionLevel+"=fastest", nil)
+	w := httptest.NewRecorder()
+	require.Equal(t, zfs.CompressionOptions{}, h.getCompression(w, req))
+	require.Equal(t, string(zfs.CodecZstd), w.Header().Get(HeaderStreamEncoding))
+}
+
+func TestHTTP_handleReceiveSnapshotNested(t *testing.T) {
+	httpHandlerTest(t, func(url string) {
+		const nestedFilesystem = "customers/acme/db"
+
+		ds, err := zfs.GetDataset(context.Background(), testFilesystem)
+		require.NoError(t, err)
+		snap, err := ds.Snapshot(context.Background(), "send", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		client := NewClient(url, slog.Default())
+		_, err = client.Send(context.Background(), SnapshotSendOptions{
+			DatasetName:  nestedFilesystem,
+			SnapshotName: "recv",
+			Snapshot:     snap,
+			SendOptions:  zfs.SendOptions{Raw: true},
+			Properties:   ReceiveProperties{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+
+		snaps, err := client.DatasetSnapshots(context.Background(), nestedFilesystem, nil)
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		require.Equal(t, testZPool+"/"+nestedFilesystem+"@recv", snaps[0].Name)
+	})
+}
+
+func TestHTTP_validDatasetPath(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"fs":                            true,
+		"customers/acme/db":             true,
+		"":                              false,
+		"customers//db":                 false,
+		"customers/":                    false,
+		"/customers":                    false,
+		"../customers":                  false,
+		"customers/../../other":         false,
+		"customers/acme@snap":           false,
+		strings.Repeat("a/", 101) + "a": false,
+	} {
+		require.Equal(t, valid, validDatasetPath(path), path)
+	}
+}
+
+func TestHTTP_nestedPathRouting(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	var filesystem string
+	h.registerRoute(http.MethodGet, "/nested/{filesystem}/snapshots", func(w http.ResponseWriter, req *http.Request, _ *slog.Logger) {
+		filesystem = req.PathValue("filesystem")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := NewClient(server.URL, slog.Default())
+	req, err := client.request(context.Background(), http.MethodGet,
+		fmt.Sprintf("nested/%s/snapshots", escapeDataset("customers/acme/db")), nil,
+	)
+	require.NoError(t, err)
+	resp, err := client.client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "customers/acme/db", filesystem)
+
+	// Paths trying to escape the parent dataset are refused before zfs is invoked
+	req, err = client.request(context.Background(), http.MethodGet,
+		fmt.Sprintf("filesystems/%s/snapshots", escapeDataset("../other")), nil,
+	)
+	require.NoError(t, err)
+	resp, err = client.client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTP_pathDataset(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetPathValue("filesystem", "fs")
+	name, datasetType := pathDataset(req)
+	require.Equal(t, "fs", name)
+	require.Equal(t, zfs.DatasetFilesystem, datasetType)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetPathValue("volume", "vms/disk")
+	name, datasetType = pathDataset(req)
+	require.Equal(t, "vms/disk", name)
+	require.Equal(t, zfs.DatasetVolume, datasetType)
+}
+
+func TestHTTP_handleAbortResumableReceiveForbidden(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := NewClient(server.URL, slog.Default())
+	require.ErrorIs(t, client.AbortResumableReceive(context.Background(), "fs"), ErrForbidden)
+	require.ErrorIs(t, client.VolumeAbortResumableReceive(context.Background(), "vol"), ErrForbidden)
+}
+
+func TestHTTP_restoreRoutesForbidden(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL, slog.Default())
+	require.ErrorIs(t, client.RollbackSnapshot(ctx, "fs", "snap", false), ErrForbidden)
+	require.ErrorIs(t, client.VolumeRollbackSnapshot(ctx, "vol", "snap", false), ErrForbidden)
+	_, err := client.CloneSnapshot(ctx, "fs", "snap", "restore/fs")
+	require.ErrorIs(t, err, ErrForbidden)
+	_, err = client.VolumeCloneSnapshot(ctx, "vol", "snap", "restore/vol")
+	require.ErrorIs(t, err, ErrForbidden)
+	_, err = client.RenameFilesystem(ctx, "fs", "fs2")
+	require.ErrorIs(t, err, ErrForbidden)
+	_, err = client.RenameVolume(ctx, "vol", "vol2")
+	require.ErrorIs(t, err, ErrForbidden)
+}
@@ -0,0 +1,246 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const contentTypeMetrics = "text/plain; version=0.0.4; charset=utf-8"
+
+// durationBuckets are the upper bounds in seconds of the request duration histogram. Streams can take hours,
+// so the buckets go well beyond the usual ones.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600, 14400}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type requestKey struct {
+	routeKey
+	status int
+}
+
+type histogram struct {
+	buckets []uint64 // Cumulative counts per bucket of durationBuckets
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metrics collects the metrics of the server in the Prometheus text format
+type metrics struct {
+	mutex           sync.Mutex
+	requests        map[requestKey]uint64
+	durations       map[routeKey]*histogram
+	receiveFailures map[ErrorCode]uint64
+
+	bytesSent         atomic.Int64
+	bytesReceived     atomic.Int64
+	receiveRejections atomic.Int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:        make(map[requestKey]uint64),
+		durations:       make(map[routeKey]*histogram),
+		receiveFailures: make(map[ErrorCode]uint64),
+	}
+}
+
+func (m *metrics) observeRequest(key routeKey, status int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{routeKey: key, status: status}]++
+	hist, ok := m.durations[key]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[key] = hist
+	}
+	hist.observe(duration.Seconds())
+}
+
+// receiveFailed counts a failed receive by the error code of its failure
+func (m *metrics) receiveFailed(code ErrorCode) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.receiveFailures[code]++
+}
+
+// metricsResponseWriter records the status and the amount of bytes of a response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	metrics *metrics
+	status  int
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.metrics.bytesSent.Add(int64(n))
+	return n, err
+}
+
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// metricsBody counts the bytes read from a request body
+type metricsBody struct {
+	io.ReadCloser
+	metrics *metrics
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.metrics.bytesReceived.Add(int64(n))
+	return n, err
+}
+
+// instrument records the requests of a route in the metrics
+func (h *HTTP) instrument(method, route string, next http.HandlerFunc) http.HandlerFunc {
+	key := routeKey{method: method, route: route}
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w, metrics: h.metrics}
+		if req.Body != nil {
+			req.Body = &metricsBody{ReadCloser: req.Body, metrics: h.metrics}
+		}
+
+		next(mw, req)
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		h.metrics.observeRequest(key, status, time.Since(start))
+	}
+}
+
+// MetricsHandler returns a handler serving the metrics of the server in the Prometheus text format. It can be
+// mounted next to the server, when the metrics should not be served under the MetricsPath.
+func (h *HTTP) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.handleMetrics(w, req, h.logger)
+	})
+}
+
+func (h *HTTP) handleMetrics(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	logger.Debug("zfs.http.handleMetrics: Serving metrics", "remoteAddr", req.RemoteAddr)
+	w.Header().Set("Content-Type", contentTypeMetrics)
+	_, err := io.WriteString(w, h.formatMetrics())
+	if err != nil {
+		logger.Error("zfs.http.handleMetrics: Error writing metrics", "error", err)
+	}
+}
+
+func (h *HTTP) formatMetrics() string {
+	h.receiveMutex.Lock()
+	activeReceives := len(h.receives)
+	queueDepth := len(h.receiveQueue)
+	h.receiveMutex.Unlock()
+
+	m := h.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var sb strings.Builder
+
+	writeMetricHeader(&sb, "zfs_http_requests_total", "counter", "Requests handled, by route and status.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	slices.SortFunc(requests, func(a, b requestKey) int {
+		if c := compareRouteKeys(a.routeKey, b.routeKey); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+	for _, key := range requests {
+		fmt.Fprintf(&sb, "zfs_http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n",
+			key.method, key.route, key.status, m.requests[key])
+	}
+
+	writeMetricHeader(&sb, "zfs_http_request_duration_seconds", "histogram", "Duration of requests, by route.")
+	routes := make([]routeKey, 0, len(m.durations))
+	for key := range m.durations {
+		routes = append(routes, key)
+	}
+	slices.SortFunc(routes, compareRouteKeys)
+	for _, key := range routes {
+		hist := m.durations[key]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&sb, "zfs_http_request_duration_seconds_bucket{method=%q,route=%q,le=%q} %d\n",
+				key.method, key.route, strconv.FormatFloat(bound, 'g', -1, 64), hist.buckets[i])
+		}
+		fmt.Fprintf(&sb, "zfs_http_request_duration_seconds_bucket{method=%q,route=%q,le=\"+Inf\"} %d\n",
+			key.method, key.route, hist.count)
+		fmt.Fprintf(&sb, "zfs_http_request_duration_seconds_sum{method=%q,route=%q} %s\n",
+			key.method, key.route, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(&sb, "zfs_http_request_duration_seconds_count{method=%q,route=%q} %d\n",
+			key.method, key.route, hist.count)
+	}
+
+	writeMetricHeader(&sb, "zfs_http_sent_bytes_total", "counter", "Bytes sent in response bodies.")
+	fmt.Fprintf(&sb, "zfs_http_sent_bytes_total %d\n", m.bytesSent.Load())
+	writeMetricHeader(&sb, "zfs_http_received_bytes_total", "counter", "Bytes received in request bodies.")
+	fmt.Fprintf(&sb, "zfs_http_received_bytes_total %d\n", m.bytesReceived.Load())
+
+	writeMetricHeader(&sb, "zfs_http_active_receives", "gauge", "Receives in progress.")
+	fmt.Fprintf(&sb, "zfs_http_active_receives %d\n", activeReceives)
+	writeMetricHeader(&sb, "zfs_http_receive_queue_depth", "gauge", "Receives waiting in the queue for a slot.")
+	fmt.Fprintf(&sb, "zfs_http_receive_queue_depth %d\n", queueDepth)
+	writeMetricHeader(&sb, "zfs_http_receive_rejections_total", "counter",
+		"Receives refused with 429 Too Many Requests.")
+	fmt.Fprintf(&sb, "zfs_http_receive_rejections_total %d\n", m.receiveRejections.Load())
+
+	writeMetricHeader(&sb, "zfs_http_receive_failures_total", "counter", "Failed receives, by error class.")
+	codes := make([]ErrorCode, 0, len(m.receiveFailures))
+	for code := range m.receiveFailures {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&sb, "zfs_http_receive_failures_total{class=%q} %d\n", code, m.receiveFailures[code])
+	}
+	return sb.String()
+}
+
+func writeMetricHeader(sb *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func compareRouteKeys(a, b routeKey) int {
+	if c := strings.Compare(a.route, b.route); c != 0 {
+		return c
+	}
+	return strings.Compare(a.method, b.method)
+}
@@ -0,0 +1,85 @@
+package http
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.HTTPPathPrefix = "/zfs"
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/zfs", slog.Default())
+	_, err := client.ServerCodecs(context.Background())
+	require.NoError(t, err)
+	require.ErrorIs(t, client.DestroyFilesystem(context.Background(), "fs"), ErrForbidden)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/zfs/filesystems/..%2Finvalid/snapshots", strings.NewReader("stream"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	h.metrics.receiveRejections.Add(1)
+	h.metrics.receiveFailed(ErrorCodeStreamTruncated)
+	h.metrics.receiveFailed(ErrorCodeStreamTruncated)
+
+	resp, err = http.Get(server.URL + "/zfs/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, contentTypeMetrics, resp.Header.Get("Content-Type"))
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	body := string(data)
+
+	for _, line := range []string{
+		"# TYPE zfs_http_requests_total counter",
+		`zfs_http_requests_total{method="GET",route="/codecs",status="200"} 1`,
+		`zfs_http_requests_total{method="DELETE",route="/filesystems/{filesystem}",status="403"} 1`,
+		`zfs_http_requests_total{method="PUT",route="/filesystems/{filesystem}/snapshots",status="400"} 1`,
+		"# TYPE zfs_http_request_duration_seconds histogram",
+		`zfs_http_request_duration_seconds_bucket{method="GET",route="/codecs",le="+Inf"} 1`,
+		`zfs_http_request_duration_seconds_count{method="GET",route="/codecs"} 1`,
+		"zfs_http_active_receives 0",
+		"zfs_http_receive_queue_depth 0",
+		"zfs_http_receive_rejections_total 1",
+		`zfs_http_receive_failures_total{class="stream_truncated"} 2`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+	require.NotContains(t, body, "/metrics", "the metrics endpoint is not a route")
+	require.NotContains(t, body, "zfs_http_sent_bytes_total 0\n")
+
+	// The handler can be mounted elsewhere as well
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `route="/codecs"`)
+}
+
+func TestMetrics_unauthenticated(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.Authentication.BearerTokens = map[string]string{"token1": "backup1"}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// Scrapers have no credentials or policy, like health checks
+	resp, err := http.Get(server.URL + conf.MetricsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,49 @@
+package http
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI specification of the routes in registerRoutes. It is maintained by hand, so a route
+// change has to update openapi.json as well. The tests check its routes, parameters and status codes against the
+// handlers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPISpec returns the hand-maintained OpenAPI 3 specification of the HTTP API in JSON
+func OpenAPISpec() []byte {
+	return append([]byte(nil), openAPISpec...)
+}
+
+func (h *HTTP) handleOpenAPI(w http.ResponseWriter, _ *http.Request, logger *slog.Logger) {
+	spec := openAPISpec
+	if h.config.HTTPPathPrefix != "" {
+		// Tell clients the paths are relative to the prefix
+		var doc map[string]any
+		err := json.Unmarshal(openAPISpec, &doc)
+		if err != nil {
+			logger.Error("zfs.http.handleOpenAPI: Error decoding specification", "error", err)
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		doc["servers"] = []map[string]string{{"url": h.config.HTTPPathPrefix}}
+		spec, err = json.Marshal(doc)
+		if err != nil {
+			logger.Error("zfs.http.handleOpenAPI: Error encoding specification", "error", err)
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(spec)
+	if err != nil {
+		logger.Error("zfs.http.handleOpenAPI: Error writing specification", "error", err)
+		return
+	}
+}
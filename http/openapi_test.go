@@ -0,0 +1,295 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type openAPIParameter struct {
+	Ref  string `json:"$ref"`
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+type openAPIOperation struct {
+	Parameters []openAPIParameter         `json:"parameters"`
+	Responses  map[string]json.RawMessage `json:"responses"`
+}
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+		Headers    map[string]json.RawMessage  `json:"headers"`
+		Schemas    map[string]struct {
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func (d *openAPIDocument) parameter(param openAPIParameter) openAPIParameter {
+	if param.Ref == "" {
+		return param
+	}
+	return d.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]
+}
+
+func TestOpenAPI_Routes(t *testing.T) {
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+
+	var specRoutes []string
+	pathParam := regexp.MustCompile(`{(\w+)}`)
+	for path, operations := range doc.Paths {
+		for method, operation := range operations {
+			specRoutes = append(specRoutes, strings.ToUpper(method)+" "+path)
+
+			var inPath []string
+			for _, param := range operation.Parameters {
+				param = doc.parameter(param)
+				require.NotEmpty(t, param.Name, "unresolved parameter in %s %s", method, path)
+				if param.In == "path" {
+					inPath = append(inPath, param.Name)
+				}
+			}
+			var expected []string
+			for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+				expected = append(expected, match[1])
+			}
+			require.ElementsMatch(t, expected, inPath, "path parameters of %s %s", method, path)
+		}
+	}
+
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	require.ElementsMatch(t, h.routes, specRoutes, "routes and the OpenAPI specification have drifted apart")
+}
+
+func TestOpenAPI_Parameters(t *testing.T) {
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+
+	names := make(map[string]bool)
+	for _, param := range doc.Components.Parameters {
+		names[param.Name] = true
+	}
+	for name := range doc.Components.Headers {
+		names[name] = true
+	}
+
+	for _, name := range []string{
+		GETParamExtraProperties, GETParamResumable, GETParamIncludeProperties, GETParamForceRollback, GETParamRaw,
+		GETParamReceiveProperties, GETParamBytesPerSecond, GETParamEnableDecompression, GETParamCompressionLevel,
+		GETParamFramed, GETParamEncrypted, GETParamDestroyMoreRecent, GETParamEventTypes,
+		HeaderResumeReceiveToken, HeaderResumeReceivedBytes, HeaderError, HeaderStreamEncoding,
+		HeaderAcceptStreamEncoding, HeaderRetryAfter, HeaderExpectedSize,
+	} {
+		require.True(t, names[name], "%s is missing from the OpenAPI specification", name)
+	}
+
+	codes := doc.Components.Schemas["Problem"].Properties["code"].Enum
+	for _, entry := range errorCodes {
+		require.Contains(t, codes, string(entry.code))
+	}
+	require.Contains(t, codes, string(ErrorCodeBadRequest))
+	require.Contains(t, codes, string(ErrorCodeInternal))
+}
+
+// routeUsage is what the handler of a route uses, including the package functions it calls
+type routeUsage struct {
+	statuses map[string]bool // The HTTP status codes
+	query    map[string]bool // The values of the GETParam constants
+	headers  map[string]bool // The values of the Header constants
+}
+
+// handlerUsage type checks the package source to find what the handler of every route in registerRoutes uses
+func handlerUsage(t *testing.T) map[string]routeUsage {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	notTest := func(fi fs.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+	pkgs, err := parser.ParseDir(fset, ".", notTest, 0)
+	require.NoError(t, err)
+	var files []*ast.File
+	for _, file := range pkgs["http"].Files {
+		files = append(files, file)
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("github.com/vansante/go-zfsutils/http", fset, files, info)
+	require.NoError(t, err)
+
+	funcs := make(map[types.Object]*ast.FuncDecl)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				funcs[info.Defs[fn.Name]] = fn
+			}
+		}
+	}
+
+	usage := func(handler types.Object) routeUsage {
+		u := routeUsage{statuses: make(map[string]bool), query: make(map[string]bool), headers: make(map[string]bool)}
+		visited := make(map[types.Object]bool)
+		var visit func(obj types.Object)
+		visit = func(obj types.Object) {
+			if visited[obj] || funcs[obj] == nil {
+				return
+			}
+			visited[obj] = true
+			ast.Inspect(funcs[obj].Body, func(n ast.Node) bool {
+				ident, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				switch obj := info.Uses[ident].(type) {
+				case *types.Const:
+					switch {
+					case obj.Pkg() == nil:
+						// Universe constants like true
+					case obj.Pkg().Path() == "net/http" && strings.HasPrefix(obj.Name(), "Status"):
+						u.statuses[obj.Val().ExactString()] = true
+					case obj.Pkg() == pkg && strings.HasPrefix(obj.Name(), "GETParam"):
+						u.query[constant.StringVal(obj.Val())] = true
+					case obj.Pkg() == pkg && strings.HasPrefix(obj.Name(), "Header"):
+						u.headers[constant.StringVal(obj.Val())] = true
+					}
+				case *types.Func:
+					visit(obj)
+				}
+				return true
+			})
+		}
+		visit(handler)
+		return u
+	}
+
+	var register *ast.FuncDecl
+	for _, fn := range funcs {
+		if fn.Name.Name == "registerRoutes" {
+			register = fn
+		}
+	}
+	require.NotNil(t, register)
+
+	routes := make(map[string]routeUsage)
+	ast.Inspect(register.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 3 {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "registerRoute" {
+			return true
+		}
+		method := constant.StringVal(info.Types[call.Args[0]].Value)
+		path := constant.StringVal(info.Types[call.Args[1]].Value)
+		// The handler may be wrapped, like by audited
+		ast.Inspect(call.Args[2], func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if ok && strings.HasPrefix(ident.Name, "handle") {
+				routes[method+" "+path] = usage(info.Uses[ident])
+			}
+			return true
+		})
+		return false
+	})
+	return routes
+}
+
+func TestOpenAPI_Operations(t *testing.T) {
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+	routes := handlerUsage(t)
+
+	for path, operations := range doc.Paths {
+		for method, operation := range operations {
+			route := strings.ToUpper(method) + " " + path
+			usage, ok := routes[route]
+			require.True(t, ok, "%s is not a route", route)
+
+			var documented, used []string
+			for _, param := range operation.Parameters {
+				param = doc.parameter(param)
+				switch param.In {
+				case "query":
+					documented = append(documented, param.Name)
+				case "header":
+					require.True(t, usage.headers[param.Name], "%s does not use header %s", route, param.Name)
+				}
+			}
+			for name := range usage.query {
+				used = append(used, name)
+			}
+			require.ElementsMatch(t, used, documented, "query parameters of %s", route)
+
+			documented = nil
+			var returned []string
+			for status := range operation.Responses {
+				if status != "default" {
+					documented = append(documented, status)
+				}
+			}
+			for status := range usage.statuses {
+				returned = append(returned, status)
+			}
+			// Streams are written without an explicit status
+			if !usage.statuses[strconv.Itoa(http.StatusOK)] && slices.Contains(documented, strconv.Itoa(http.StatusOK)) {
+				returned = append(returned, strconv.Itoa(http.StatusOK))
+			}
+			require.ElementsMatch(t, returned, documented, "status codes of %s", route)
+		}
+	}
+}
+
+func TestOpenAPI_Serve(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.HTTPPathPrefix = "/zfs"
+	server := httptest.NewServer(NewHTTP(context.Background(), conf, slog.Default()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/zfs/openapi.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var doc struct {
+		OpenAPI string              `json:"openapi"`
+		Servers []map[string]string `json:"servers"`
+	}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Equal(t, "3.1.0", doc.OpenAPI)
+	require.Equal(t, []map[string]string{{"url": "/zfs"}}, doc.Servers)
+
+	conf.OpenAPIPath = ""
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/zfs/openapi.json", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
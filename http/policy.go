@@ -0,0 +1,270 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+// ErrQuotaExceeded is returned when a receive would exceed the byte quota of a principal
+var ErrQuotaExceeded = errors.New("receive quota exceeded")
+
+// Policy scopes the datasets and permissions of a principal
+type Policy struct {
+	// ParentDataset is the dataset all filesystems of the principal are created under
+	ParentDataset string `json:"ParentDataset" yaml:"ParentDataset"`
+
+	// MaximumConcurrentReceives limits the concurrent receives of the principal, set to zero to disable limits.
+	// The server wide MaximumConcurrentReceives applies as well.
+	MaximumConcurrentReceives int `json:"MaximumConcurrentReceives" yaml:"MaximumConcurrentReceives"`
+
+	// ReceiveQuotaBytes limits the space used by the parent dataset of the principal, receives are refused or
+	// aborted when it is reached. Concurrent receives share what is left of it. A receive counts the bytes of its
+	// stream as received, which are compressed when the stream is, so the space on disk can differ.
+	// Set to zero to disable the quota.
+	ReceiveQuotaBytes uint64 `json:"ReceiveQuotaBytes" yaml:"ReceiveQuotaBytes"`
+
+	// BandwidthBytesPerSecond is the bandwidth budget shared by the sends and receives of the principal, set to
+	// zero to disable it. The server wide BandwidthBytesPerSecond applies as well.
+	BandwidthBytesPerSecond int64 `json:"BandwidthBytesPerSecond" yaml:"BandwidthBytesPerSecond"`
+
+	Permissions Permissions `json:"Permissions" yaml:"Permissions"`
+}
+
+// policy returns the policy for the principal of the request. Requests without identity, or principals without
+// a policy, get the server wide parent dataset and permissions.
+func (h *HTTP) policy(req *http.Request) Policy {
+	identity := IdentityFromContext(req.Context())
+	if identity != nil {
+		policy, ok := h.config.Policies[identity.Principal]
+		if ok {
+			return policy
+		}
+	}
+	return Policy{
+		ParentDataset: h.config.ParentDataset,
+		Permissions:   h.config.Permissions,
+	}
+}
+
+// hasPolicy returns whether the request is allowed when policies are required
+func (h *HTTP) hasPolicy(req *http.Request) bool {
+	if !h.config.RequirePolicy {
+		return true
+	}
+	identity := IdentityFromContext(req.Context())
+	if identity == nil {
+		return false
+	}
+	_, ok := h.config.Policies[identity.Principal]
+	return ok
+}
+
+func principal(req *http.Request) string {
+	identity := IdentityFromContext(req.Context())
+	if identity == nil {
+		return ""
+	}
+	return identity.Principal
+}
+
+// receiveQuota returns the parent dataset the receive quota of the principal of the request applies to, with the
+// quota and the bytes used by the parent. The parent is empty when the principal has no quota.
+func (h *HTTP) receiveQuota(req *http.Request) (parent string, quota, used uint64, err error) {
+	policy := h.policy(req)
+	if policy.ReceiveQuotaBytes == 0 || policy.ParentDataset == "" {
+		return "", 0, 0, nil
+	}
+
+	ds, err := zfs.GetDataset(req.Context(), policy.ParentDataset)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("error getting parent dataset: %w", err)
+	}
+	return policy.ParentDataset, policy.ReceiveQuotaBytes, ds.Used, nil
+}
+
+// receiveReservations divides the remaining receive quota of parent datasets, and the free space of pools, over
+// the receives into them. The space used by a parent does not include the streams still being received, so it is
+// only read when no receive into the parent is active. Until then the active receives draw from the same budget.
+// Receives admitted by their expected size reserve it up front, so concurrent receives cannot be admitted for the
+// same space.
+type receiveReservations struct {
+	mutex   sync.Mutex
+	budgets map[string]*quotaBudget
+	space   map[string]uint64 // Bytes admitted to receives that have not been received yet, by pool
+}
+
+func newReceiveReservations() *receiveReservations {
+	return &receiveReservations{
+		budgets: make(map[string]*quotaBudget),
+		space:   make(map[string]uint64),
+	}
+}
+
+type quotaBudget struct {
+	remaining int64 // Bytes the active receives may still receive together
+	admitted  int64 // Part of remaining reserved for the expected size of receives
+	receives  int
+}
+
+// receiveReservation is the share of a receive in the quota budget of its parent dataset and the space of its pool
+type receiveReservation struct {
+	reservations *receiveReservations
+	parent       string // Empty without quota
+	pool         string
+	admitted     int64 // Bytes of the expected size that have not been received yet
+	credit       int64 // Bytes taken from the budget that have not been read yet
+}
+
+// receiveAdmission describes the quota and space a receive is admitted for
+type receiveAdmission struct {
+	// parent is the dataset of the quota, empty without quota
+	parent      string
+	quota, used uint64
+	// pool is the pool of the target, which has available bytes of free space
+	pool      string
+	available uint64
+	// size is the expected size of the stream, zero when unknown
+	size uint64
+}
+
+// reserve adds a receive to the quota budget of its parent, and reserves its expected size in the budget and the
+// space of its pool. It fails with ErrQuotaExceeded or ErrInsufficientSpace when it does not fit.
+func (r *receiveReservations) reserve(admission receiveAdmission) (*receiveReservation, error) {
+	reservation := &receiveReservation{
+		reservations: r,
+		parent:       admission.parent,
+		pool:         admission.pool,
+		admitted:     int64(admission.size),
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var budget *quotaBudget
+	if admission.parent != "" {
+		var ok bool
+		budget, ok = r.budgets[admission.parent]
+		if !ok {
+			if admission.used >= admission.quota {
+				return nil, fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, admission.used, admission.quota)
+			}
+			budget = &quotaBudget{remaining: int64(admission.quota - admission.used)}
+		}
+		free := budget.remaining - budget.admitted
+		switch {
+		case free <= 0:
+			return nil, fmt.Errorf("%w: the rest of the quota is taken by other receives", ErrQuotaExceeded)
+		case reservation.admitted > free:
+			return nil, fmt.Errorf("%w: expected %d bytes, %d bytes of receive quota left",
+				ErrQuotaExceeded, admission.size, free,
+			)
+		}
+	}
+	if admission.size > 0 && r.space[admission.pool]+admission.size > admission.available {
+		return nil, fmt.Errorf("%w: expected %d bytes, %d bytes available of which %d are reserved for other receives",
+			ErrInsufficientSpace, admission.size, admission.available, r.space[admission.pool],
+		)
+	}
+
+	if budget != nil {
+		budget.admitted += reservation.admitted
+		budget.receives++
+		r.budgets[admission.parent] = budget
+	}
+	if admission.size > 0 {
+		r.space[admission.pool] += admission.size
+	}
+	return reservation, nil
+}
+
+// take takes up to n bytes from the budget, it returns -1 when the receive has nothing to account for
+func (r *receiveReservation) take(n int) int64 {
+	if r.parent == "" && r.admitted == 0 {
+		return -1
+	}
+	r.reservations.mutex.Lock()
+	defer r.reservations.mutex.Unlock()
+
+	taken := int64(n)
+	budget := r.reservations.budgets[r.parent]
+	if budget != nil {
+		// The bytes admitted to other receives are not available
+		taken = max(min(taken, budget.remaining-(budget.admitted-r.admitted)), 0)
+		budget.remaining -= taken
+	}
+
+	received := min(taken, r.admitted)
+	r.admitted -= received
+	if budget != nil {
+		budget.admitted -= received
+	}
+	r.reservations.releaseSpace(r.pool, received)
+	return taken
+}
+
+// release returns what the receive did not use, and drops the quota budget once no receive uses it
+func (r *receiveReservation) release() {
+	r.reservations.mutex.Lock()
+	defer r.reservations.mutex.Unlock()
+
+	r.reservations.releaseSpace(r.pool, r.admitted)
+	budget := r.reservations.budgets[r.parent]
+	if budget != nil {
+		budget.remaining += r.credit
+		budget.admitted -= r.admitted
+		budget.receives--
+		if budget.receives <= 0 {
+			delete(r.reservations.budgets, r.parent)
+		}
+	}
+	r.admitted = 0
+	r.credit = 0
+}
+
+// releaseSpace returns reserved bytes of the pool, the reservations must be locked
+func (r *receiveReservations) releaseSpace(pool string, n int64) {
+	if n <= 0 {
+		return
+	}
+	r.space[pool] -= min(uint64(n), r.space[pool])
+	if r.space[pool] == 0 {
+		delete(r.space, pool)
+	}
+}
+
+// quotaReader fails the stream with ErrQuotaExceeded once the receive is out of quota
+type quotaReader struct {
+	r           io.Reader
+	reservation *receiveReservation
+	exceeded    bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.reservation.credit <= 0 {
+		taken := q.reservation.take(len(p))
+		if taken < 0 {
+			return q.r.Read(p)
+		}
+		q.reservation.credit = taken
+	}
+	if q.reservation.credit <= 0 {
+		// Probe whether the stream continues, reaching the quota exactly is fine
+		n, err := q.r.Read(p[:min(len(p), 1)])
+		if n > 0 {
+			q.exceeded = true
+			return 0, ErrQuotaExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > q.reservation.credit {
+		p = p[:q.reservation.credit]
+	}
+	n, err := q.r.Read(p)
+	q.reservation.credit -= int64(n)
+	return n, err
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requestAs(principal string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/filesystems", nil)
+	if principal == "" {
+		return req
+	}
+	return req.WithContext(ContextWithIdentity(req.Context(), &Identity{Principal: principal, Method: AuthMethodBearerToken}))
+}
+
+func TestPolicy_Resolve(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.ParentDataset = "pool/default"
+	conf.Policies = map[string]Policy{
+		"tenant1": {ParentDataset: "pool/tenant1", Permissions: Permissions{AllowDestroySnapshots: true}},
+	}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	req := requestAs("tenant1")
+	require.Equal(t, "pool/tenant1/fs", h.getFilesystem(req, "fs"))
+	require.Equal(t, "pool/tenant1/fs@snap", h.getSnapshot(req, "fs", "snap"))
+	require.True(t, h.policy(req).Permissions.AllowDestroySnapshots)
+
+	req = requestAs("other")
+	require.Equal(t, "pool/default/fs", h.getFilesystem(req, "fs"))
+	require.False(t, h.policy(req).Permissions.AllowDestroySnapshots)
+	require.True(t, h.hasPolicy(req))
+
+	h.config.RequirePolicy = true
+	require.False(t, h.hasPolicy(req))
+	require.False(t, h.hasPolicy(requestAs("")))
+	require.True(t, h.hasPolicy(requestAs("tenant1")))
+}
+
+func TestPolicy_claimReceiveSlot(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.MaximumConcurrentReceives = 3
+	conf.ReceiveQueueSize = 0
+	conf.Policies = map[string]Policy{
+		"tenant1": {MaximumConcurrentReceives: 1},
+	}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	release, _, ok := h.claimReceiveSlot(requestAs("tenant1"), slog.Default())
+	require.True(t, ok)
+
+	_, limit, ok := h.claimReceiveSlot(requestAs("tenant1"), slog.Default())
+	require.False(t, ok, "principal limit should apply")
+	require.Equal(t, 1, limit)
+
+	release2, _, ok := h.claimReceiveSlot(requestAs("other"), slog.Default())
+	require.True(t, ok)
+	release3, _, ok := h.claimReceiveSlot(requestAs("other"), slog.Default())
+	require.True(t, ok)
+
+	_, limit, ok = h.claimReceiveSlot(requestAs("other"), slog.Default())
+	require.False(t, ok, "server limit should apply")
+	require.Equal(t, 3, limit)
+
+	release()
+	release2()
+	release3()
+	require.Zero(t, h.receiveCount)
+	require.Empty(t, h.principalReceives)
+
+	release, _, ok = h.claimReceiveSlot(requestAs("tenant1"), slog.Default())
+	require.True(t, ok)
+	release()
+}
+
+func TestPolicy_quotaReader(t *testing.T) {
+	reservations := newReceiveReservations()
+	reservation, err := reservations.reserve(receiveAdmission{parent: "tenant", quota: 150, used: 50})
+	require.NoError(t, err)
+	q := &quotaReader{r: bytes.NewReader(make([]byte, 100)), reservation: reservation}
+	data, err := io.ReadAll(q)
+	require.NoError(t, err, "reaching the quota exactly is allowed")
+	require.Len(t, data, 100)
+	require.False(t, q.exceeded)
+	reservation.release()
+	require.Empty(t, reservations.budgets)
+
+	reservation, err = reservations.reserve(receiveAdmission{parent: "tenant", quota: 150, used: 50})
+	require.NoError(t, err)
+	q = &quotaReader{r: bytes.NewReader(make([]byte, 101)), reservation: reservation}
+	_, err = io.ReadAll(q)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.True(t, q.exceeded)
+	reservation.release()
+
+	// Without quota nothing is counted
+	reservation, err = reservations.reserve(receiveAdmission{})
+	require.NoError(t, err)
+	data, err = io.ReadAll(&quotaReader{r: bytes.NewReader(make([]byte, 1000)), reservation: reservation})
+	require.NoError(t, err)
+	require.Len(t, data, 1000)
+	reservation.release()
+}
+
+func TestPolicy_quotaShared(t *testing.T) {
+	reservations := newReceiveReservations()
+	first, err := reservations.reserve(receiveAdmission{parent: "tenant", quota: 100, used: 0})
+	require.NoError(t, err)
+	// The used space is only read when no receive is active, the streams in progress are not in it yet
+	second, err := reservations.reserve(receiveAdmission{parent: "tenant", quota: 100, used: 0})
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(io.LimitReader(&quotaReader{r: bytes.NewReader(make([]byte, 100)), reservation: first}, 60))
+	require.NoError(t, err)
+	require.Len(t, data, 60)
+
+	q := &quotaReader{r: bytes.NewReader(make([]byte, 100)), reservation: second}
+	_, err = io.ReadAll(q)
+	require.ErrorIs(t, err, ErrQuotaExceeded, "the receives together may not exceed the quota")
+	require.True(t, q.exceeded)
+
+	second.release()
+	_, err = reservations.reserve(receiveAdmission{parent: "tenant", quota: 100, used: 0})
+	require.ErrorIs(t, err, ErrQuotaExceeded, "the budget is used up while a receive is active")
+
+	// Once no receive is active, the used space is read again
+	first.release()
+	require.Empty(t, reservations.budgets)
+	third, err := reservations.reserve(receiveAdmission{parent: "tenant", quota: 100, used: 50})
+	require.NoError(t, err)
+	require.EqualValues(t, 50, third.take(80))
+	third.release()
+}
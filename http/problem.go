@@ -0,0 +1,218 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+	"github.com/vansante/go-zfsutils/sendstream"
+)
+
+var (
+	ErrInvalidIdentifier  = errors.New("invalid identifier")
+	ErrInvalidDatasetType = errors.New("invalid dataset type")
+	ErrInvalidRequest     = errors.New("invalid request")
+)
+
+// ContentTypeProblem is the content type of problem details error responses
+const ContentTypeProblem = "application/problem+json"
+
+// ErrorCode is the stable, machine-readable identifier of the error in a problem details response
+type ErrorCode string
+
+const (
+	ErrorCodeDatasetNotFound            ErrorCode = "dataset_not_found"
+	ErrorCodeDatasetExists              ErrorCode = "dataset_exists"
+	ErrorCodeOnlySnapshotsSupported     ErrorCode = "only_snapshots_supported"
+	ErrorCodeSnapshotsNotSupported      ErrorCode = "snapshots_not_supported"
+	ErrorCodeDatasetBusy                ErrorCode = "dataset_busy"
+	ErrorCodePoolIOSuspended            ErrorCode = "pool_io_suspended"
+	ErrorCodeSnapshotHasDependentClones ErrorCode = "snapshot_has_dependent_clones"
+	ErrorCodeKeyAlreadyLoaded           ErrorCode = "key_already_loaded"
+	ErrorCodeKeyAlreadyUnloaded         ErrorCode = "key_already_unloaded"
+	ErrorCodeFilesystemAlreadyMounted   ErrorCode = "filesystem_already_mounted"
+	ErrorCodeMoreRecentSnapshotsExist   ErrorCode = "more_recent_snapshots_exist"
+	ErrorCodeStreamCorrupted            ErrorCode = "stream_corrupted"
+	ErrorCodeStreamTruncated            ErrorCode = "stream_truncated"
+	ErrorCodeStreamDecryption           ErrorCode = "stream_decryption_failed"
+	ErrorCodeInvalidStreamKey           ErrorCode = "invalid_stream_key"
+	ErrorCodeUnknownStreamKey           ErrorCode = "unknown_stream_key"
+	ErrorCodeUnsupportedCodec           ErrorCode = "unsupported_codec"
+	ErrorCodeInvalidStream              ErrorCode = "invalid_stream"
+	ErrorCodeInvalidResumeToken         ErrorCode = "invalid_resume_token"
+	ErrorCodeResumeNotPossible          ErrorCode = "resume_not_possible"
+	ErrorCodeTooManyRequests            ErrorCode = "too_many_requests"
+	ErrorCodeUnauthorized               ErrorCode = "unauthorized"
+	ErrorCodeForbidden                  ErrorCode = "forbidden"
+	ErrorCodeReceiveNotFound            ErrorCode = "receive_not_found"
+	ErrorCodeReceiveCanceled            ErrorCode = "receive_canceled"
+	ErrorCodeQuotaExceeded              ErrorCode = "quota_exceeded"
+	ErrorCodeInsufficientSpace          ErrorCode = "insufficient_space"
+	ErrorCodeShuttingDown               ErrorCode = "shutting_down"
+	ErrorCodeInvalidIdentifier          ErrorCode = "invalid_identifier"
+	ErrorCodeInvalidDatasetType         ErrorCode = "invalid_dataset_type"
+	ErrorCodeInvalidRequest             ErrorCode = "invalid_request"
+
+	// ErrorCodeBadRequest and ErrorCodeInternal are used for errors without a sentinel error
+	ErrorCodeBadRequest ErrorCode = "bad_request"
+	ErrorCodeInternal   ErrorCode = "internal_error"
+)
+
+// errorCodes maps the error codes to the sentinel errors they stand for. The first match wins, so an error
+// wrapping several sentinels gets the code of the most specific one, and a code decodes to its first sentinel.
+var errorCodes = []struct {
+	code ErrorCode
+	err  error
+}{
+	{ErrorCodeStreamDecryption, zfs.ErrStreamDecryption},
+	{ErrorCodeStreamTruncated, zfs.ErrStreamTruncated},
+	{ErrorCodeStreamCorrupted, zfs.ErrStreamCorrupted},
+	{ErrorCodeInvalidStreamKey, zfs.ErrInvalidStreamKey},
+	{ErrorCodeUnknownStreamKey, zfs.ErrUnknownStreamKey},
+	{ErrorCodeUnsupportedCodec, zfs.ErrUnsupportedCodec},
+	{ErrorCodeInvalidStream, sendstream.ErrInvalidStream},
+	{ErrorCodeDatasetNotFound, zfs.ErrDatasetNotFound},
+	{ErrorCodeDatasetExists, zfs.ErrDatasetExists},
+	{ErrorCodeOnlySnapshotsSupported, zfs.ErrOnlySnapshotsSupported},
+	{ErrorCodeSnapshotsNotSupported, zfs.ErrSnapshotsNotSupported},
+	{ErrorCodeDatasetBusy, zfs.ErrPoolOrDatasetBusy},
+	{ErrorCodePoolIOSuspended, zfs.ErrPoolIOSuspended},
+	{ErrorCodeSnapshotHasDependentClones, zfs.ErrSnapshotHasDependentClones},
+	{ErrorCodeKeyAlreadyLoaded, zfs.ErrKeyAlreadyLoaded},
+	{ErrorCodeKeyAlreadyUnloaded, zfs.ErrKeyAlreadyUnloaded},
+	{ErrorCodeFilesystemAlreadyMounted, zfs.ErrFilesystemAlreadyMounted},
+	{ErrorCodeMoreRecentSnapshotsExist, zfs.ErrMoreRecentSnapshotsExist},
+	{ErrorCodeInvalidResumeToken, ErrInvalidResumeToken},
+	{ErrorCodeResumeNotPossible, ErrResumeNotPossible},
+	{ErrorCodeTooManyRequests, ErrTooManyRequests},
+	{ErrorCodeUnauthorized, ErrUnauthorized},
+	{ErrorCodeUnauthorized, ErrUnauthenticated},
+	{ErrorCodeForbidden, ErrForbidden},
+	{ErrorCodeReceiveNotFound, ErrReceiveNotFound},
+	{ErrorCodeReceiveCanceled, ErrReceiveCanceled},
+	{ErrorCodeQuotaExceeded, ErrQuotaExceeded},
+	{ErrorCodeInsufficientSpace, ErrInsufficientSpace},
+	{ErrorCodeShuttingDown, ErrShuttingDown},
+	{ErrorCodeInvalidIdentifier, ErrInvalidIdentifier},
+	{ErrorCodeInvalidDatasetType, ErrInvalidDatasetType},
+	{ErrorCodeInvalidRequest, ErrInvalidRequest},
+}
+
+// statusErrors maps status codes to sentinel errors, for error responses without a known error code
+var statusErrors = map[int]error{
+	http.StatusNotFound:              zfs.ErrDatasetNotFound,
+	http.StatusConflict:              zfs.ErrDatasetExists,
+	http.StatusExpectationFailed:     ErrInvalidResumeToken,
+	http.StatusPreconditionFailed:    ErrResumeNotPossible,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusUnprocessableEntity:   zfs.ErrStreamCorrupted,
+	http.StatusGone:                  ErrReceiveCanceled,
+	http.StatusInsufficientStorage:   ErrQuotaExceeded,
+	http.StatusRequestEntityTooLarge: ErrQuotaExceeded,
+	http.StatusUnsupportedMediaType:  zfs.ErrUnsupportedCodec,
+	http.StatusServiceUnavailable:    ErrShuttingDown,
+}
+
+// Problem is a problem details (RFC 9457) error response body
+type Problem struct {
+	Type   string    `json:"type,omitempty"`
+	Title  string    `json:"title"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Code   ErrorCode `json:"code"`
+}
+
+// errorCode returns the error code of the first sentinel error the error wraps
+func errorCode(err error, status int) ErrorCode {
+	for _, entry := range errorCodes {
+		if errors.Is(err, entry.err) {
+			return entry.code
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		return ErrorCodeInternal
+	}
+	return ErrorCodeBadRequest
+}
+
+// codeError returns the sentinel error of the error code, or nil when the code is unknown
+func codeError(code ErrorCode) error {
+	for _, entry := range errorCodes {
+		if entry.code == code {
+			return entry.err
+		}
+	}
+	return nil
+}
+
+// writeError writes a problem details response for the error. The error is also set in the error header,
+// for clients that predate problem details.
+func writeError(w http.ResponseWriter, status int, err error) {
+	problem := Problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   errorCode(err, status),
+	}
+	if err != nil {
+		problem.Detail = err.Error()
+		w.Header().Set(HeaderError, problem.Detail)
+	}
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+// ProblemError is an error response of the server. It unwraps to the sentinel error of its error code,
+// so errors.Is works across the network.
+type ProblemError struct {
+	Problem
+	// Err is the sentinel error of the code or status, nil when there is none
+	Err error
+}
+
+func (e *ProblemError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("unexpected status %d, server error: %s", e.Status, e.Detail)
+	}
+	if e.Detail == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: server error: %s", e.Err, e.Detail)
+}
+
+func (e *ProblemError) Unwrap() error {
+	return e.Err
+}
+
+// responseError decodes an error response into a ProblemError. Responses without a problem details body, from
+// servers that predate them, are mapped by their status code and error header.
+func responseError(resp *http.Response) error {
+	problem := Problem{
+		Status: resp.StatusCode,
+		Detail: resp.Header.Get(HeaderError),
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == ContentTypeProblem {
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&problem)
+	}
+
+	err := codeError(problem.Code)
+	if err == nil {
+		err = statusErrors[resp.StatusCode]
+	}
+	problemErr := &ProblemError{Problem: problem, Err: err}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RetryAfterError{
+			Err:        problemErr,
+			RetryAfter: parseRetryAfter(resp.Header.Get(HeaderRetryAfter), time.Now()),
+		}
+	}
+	return problemErr
+}
@@ -0,0 +1,86 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+func TestProblem_writeError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusInternalServerError, fmt.Errorf("cannot destroy: %w", zfs.ErrPoolOrDatasetBusy))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, ContentTypeProblem, w.Header().Get("Content-Type"))
+	require.Equal(t, "cannot destroy: pool or dataset busy", w.Header().Get(HeaderError))
+
+	var problem Problem
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+	require.Equal(t, Problem{
+		Title:  "Internal Server Error",
+		Status: http.StatusInternalServerError,
+		Detail: "cannot destroy: pool or dataset busy",
+		Code:   ErrorCodeDatasetBusy,
+	}, problem)
+
+	require.Equal(t, ErrorCodeInternal, errorCode(errors.New("other"), http.StatusInternalServerError))
+	require.Equal(t, ErrorCodeBadRequest, errorCode(errors.New("other"), http.StatusBadRequest))
+	require.Equal(t, ErrorCodeStreamDecryption, errorCode(fmt.Errorf("%w: %w", zfs.ErrStreamDecryption, zfs.ErrStreamTruncated), 0))
+}
+
+func TestProblem_responseError(t *testing.T) {
+	for _, entry := range errorCodes {
+		w := httptest.NewRecorder()
+		writeError(w, http.StatusBadRequest, fmt.Errorf("wrapped: %w", entry.err))
+
+		err := responseError(w.Result())
+		require.ErrorIs(t, err, codeError(entry.code), entry.code)
+		var problemErr *ProblemError
+		require.ErrorAs(t, err, &problemErr)
+		require.Equal(t, entry.code, problemErr.Code)
+	}
+
+	// Servers without problem details are mapped by status code
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{HeaderError: {"busy"}, HeaderRetryAfter: {"5"}},
+		Body:       http.NoBody,
+	}
+	err := responseError(resp)
+	require.ErrorIs(t, err, ErrTooManyRequests)
+	var retryErr *RetryAfterError
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, 5*time.Second, retryErr.RetryAfter)
+
+	resp = &http.Response{StatusCode: http.StatusTeapot, Body: http.NoBody}
+	require.EqualError(t, responseError(resp), "unexpected status 418, server error: ")
+}
+
+func TestProblem_Client(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.Authentication.BearerTokens = map[string]string{"token": "backup"}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := NewClient(server.URL, slog.Default())
+	_, err := client.ListFilesystems(context.Background(), nil)
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	client.SetBearerToken("token")
+	_, err = client.DatasetSnapshots(context.Background(), "../escape", nil)
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	require.ErrorIs(t, client.CancelReceive(context.Background(), "unknown"), ErrReceiveNotFound)
+	require.ErrorIs(t, client.DestroyFilesystem(context.Background(), "fs"), ErrForbidden)
+}
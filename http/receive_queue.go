@@ -0,0 +1,144 @@
+package http
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// receiveWaiter is a receive waiting in the queue for a slot
+type receiveWaiter struct {
+	principal string
+	limit     int
+	// granted is closed once the slot has been reserved for the waiter
+	granted chan struct{}
+}
+
+// mayClaim returns whether a receive of the principal fits within the server and principal limits.
+// The receive mutex must be held.
+func (h *HTTP) mayClaim(principal string, principalLimit int) (limit int, ok bool) {
+	if h.config.MaximumConcurrentReceives > 0 && h.receiveCount >= h.config.MaximumConcurrentReceives {
+		return h.config.MaximumConcurrentReceives, false
+	}
+	if principalLimit > 0 && h.principalReceives[principal] >= principalLimit {
+		return principalLimit, false
+	}
+	return 0, true
+}
+
+// reserveSlot reserves a receive slot for the principal. The receive mutex must be held.
+func (h *HTTP) reserveSlot(principal string) {
+	h.receiveCount++
+	h.principalReceives[principal]++
+}
+
+// releaseSlot releases a receive slot of the principal and hands free slots to the queue in order.
+// The receive mutex must be held.
+func (h *HTTP) releaseSlot(principal string) {
+	h.receiveCount--
+	h.principalReceives[principal]--
+	if h.principalReceives[principal] <= 0 {
+		delete(h.principalReceives, principal)
+	}
+	h.grantQueued()
+}
+
+// grantQueued hands free slots to the waiters in the queue in order. The receive mutex must be held.
+func (h *HTTP) grantQueued() {
+	// Waiters blocked by their own principal limit do not hold up the waiters behind them
+	for i := 0; i < len(h.receiveQueue); {
+		waiter := h.receiveQueue[i]
+		_, ok := h.mayClaim(waiter.principal, waiter.limit)
+		if !ok {
+			if h.config.MaximumConcurrentReceives > 0 && h.receiveCount >= h.config.MaximumConcurrentReceives {
+				return // The server is full
+			}
+			i++
+			continue
+		}
+		h.reserveSlot(waiter.principal)
+		close(waiter.granted)
+		h.receiveQueue = slices.Delete(h.receiveQueue, i, i+1)
+	}
+}
+
+// claimReceiveSlot reserves a receive for the server and the principal of the request, respecting both limits.
+// When a limit has been reached the request waits in a FIFO queue, if the queue is enabled and not full.
+// It returns false when no slot could be claimed, otherwise the returned function releases the slot.
+func (h *HTTP) claimReceiveSlot(req *http.Request, logger *slog.Logger) (release func(), limit int, ok bool) {
+	principalLimit := h.policy(req).MaximumConcurrentReceives
+	name := principal(req)
+	release = func() {
+		// Unlock the slot at request completion
+		h.receiveMutex.Lock()
+		defer h.receiveMutex.Unlock()
+		h.releaseSlot(name)
+	}
+
+	h.receiveMutex.Lock()
+	limit, ok = h.mayClaim(name, principalLimit)
+	// A free slot is only claimed directly when nobody is waiting, otherwise the request queues behind the waiters
+	if ok && len(h.receiveQueue) == 0 {
+		h.reserveSlot(name)
+		logger.Debug("zfs.http.claimReceiveSlot: Receive slot claimed",
+			"receives", h.receiveCount, "maxReceives", h.config.MaximumConcurrentReceives,
+			"principalReceives", h.principalReceives[name], "maxPrincipalReceives", principalLimit,
+		)
+		h.receiveMutex.Unlock()
+		return release, 0, true
+	}
+	if ok {
+		limit = h.config.MaximumConcurrentReceives // Held back by the waiters of a full server
+	}
+	if len(h.receiveQueue) >= h.config.ReceiveQueueSize {
+		h.receiveMutex.Unlock()
+		return nil, limit, false
+	}
+	waiter := &receiveWaiter{
+		principal: name,
+		limit:     principalLimit,
+		granted:   make(chan struct{}),
+	}
+	h.receiveQueue = append(h.receiveQueue, waiter)
+	// The waiters ahead may all be held back by their own principal limit
+	h.grantQueued()
+	position := slices.Index(h.receiveQueue, waiter) + 1
+	h.receiveMutex.Unlock()
+
+	if position > 0 {
+		logger.Info("zfs.http.claimReceiveSlot: Waiting in receive queue", "position", position)
+	}
+	started := time.Now()
+
+	timer := time.NewTimer(time.Duration(h.config.ReceiveQueueMaxWaitSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-waiter.granted:
+		logger.Debug("zfs.http.claimReceiveSlot: Receive slot claimed from queue", "waited", time.Since(started))
+		return release, 0, true
+	case <-timer.C:
+	case <-req.Context().Done():
+	case <-h.shutdown:
+	}
+
+	h.receiveMutex.Lock()
+	defer h.receiveMutex.Unlock()
+	idx := slices.Index(h.receiveQueue, waiter)
+	if idx < 0 {
+		// The slot was granted while giving up, hand it on
+		h.releaseSlot(name)
+		return nil, limit, false
+	}
+	h.receiveQueue = slices.Delete(h.receiveQueue, idx, idx+1)
+	return nil, limit, false
+}
+
+// setRetryAfter tells the client when to retry a receive that could not claim a slot
+func (h *HTTP) setRetryAfter(w http.ResponseWriter) {
+	if h.config.ReceiveRetryAfterSeconds <= 0 {
+		return
+	}
+	w.Header().Set(HeaderRetryAfter, strconv.FormatInt(h.config.ReceiveRetryAfterSeconds, 10))
+}
@@ -0,0 +1,199 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type claimResult struct {
+	name    string
+	release func()
+	ok      bool
+}
+
+func claimAsync(h *HTTP, name string, results chan<- claimResult) {
+	go func() {
+		release, _, ok := h.claimReceiveSlot(requestAs(name), slog.Default())
+		results <- claimResult{name: name, release: release, ok: ok}
+	}()
+}
+
+func waitQueued(t *testing.T, h *HTTP, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		h.receiveMutex.Lock()
+		defer h.receiveMutex.Unlock()
+		return len(h.receiveQueue) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestReceiveQueue_FIFO(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.MaximumConcurrentReceives = 1
+	conf.ReceiveQueueSize = 2
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	release, _, ok := h.claimReceiveSlot(requestAs("first"), slog.Default())
+	require.True(t, ok)
+
+	results := make(chan claimResult, 3)
+	claimAsync(h, "second", results)
+	waitQueued(t, h, 1)
+	claimAsync(h, "third", results)
+	waitQueued(t, h, 2)
+
+	_, limit, ok := h.claimReceiveSlot(requestAs("fourth"), slog.Default())
+	require.False(t, ok, "queue is full")
+	require.Equal(t, 1, limit)
+
+	release()
+	result := <-results
+	require.True(t, result.ok)
+	require.Equal(t, "second", result.name)
+
+	result.release()
+	result = <-results
+	require.True(t, result.ok)
+	require.Equal(t, "third", result.name)
+
+	result.release()
+	require.Zero(t, h.receiveCount)
+}
+
+func TestReceiveQueue_NoJumping(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.MaximumConcurrentReceives = 1
+	conf.ReceiveQueueSize = 2
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	_, _, ok := h.claimReceiveSlot(requestAs("first"), slog.Default())
+	require.True(t, ok)
+
+	results := make(chan claimResult, 2)
+	claimAsync(h, "second", results)
+	waitQueued(t, h, 1)
+
+	// Free the slot without handing it on, like a release racing a new request
+	h.receiveMutex.Lock()
+	h.receiveCount--
+	h.principalReceives["first"]--
+	delete(h.principalReceives, "first")
+	h.receiveMutex.Unlock()
+
+	claimAsync(h, "third", results)
+	result := <-results
+	require.True(t, result.ok)
+	require.Equal(t, "second", result.name, "the waiter gets the free slot before the newcomer")
+	waitQueued(t, h, 1)
+
+	result.release()
+	result = <-results
+	require.True(t, result.ok)
+	require.Equal(t, "third", result.name)
+
+	result.release()
+	require.Zero(t, h.receiveCount)
+}
+
+func TestReceiveQueue_PrincipalLimit(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.MaximumConcurrentReceives = 2
+	conf.Policies = map[string]Policy{"tenant1": {MaximumConcurrentReceives: 1}}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	release1, _, ok := h.claimReceiveSlot(requestAs("tenant1"), slog.Default())
+	require.True(t, ok)
+	release2, _, ok := h.claimReceiveSlot(requestAs("other"), slog.Default())
+	require.True(t, ok)
+
+	results := make(chan claimResult, 2)
+	claimAsync(h, "tenant1", results)
+	waitQueued(t, h, 1)
+	claimAsync(h, "other", results)
+	waitQueued(t, h, 2)
+
+	// The freed slot cannot go to tenant1, which is at its own limit, so the next waiter gets it
+	release2()
+	result := <-results
+	require.True(t, result.ok)
+	require.Equal(t, "other", result.name)
+
+	result.release()
+	release1()
+	result = <-results
+	require.True(t, result.ok)
+	require.Equal(t, "tenant1", result.name)
+	result.release()
+}
+
+func TestReceiveQueue_MaxWait(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.MaximumConcurrentReceives = 1
+	conf.ReceiveQueueMaxWaitSeconds = 0
+	h := NewHTTP(context.Background(), conf, slog.Default())
+
+	release, _, ok := h.claimReceiveSlot(requestAs(""), slog.Default())
+	require.True(t, ok)
+	defer release()
+
+	_, _, ok = h.claimReceiveSlot(requestAs(""), slog.Default())
+	require.False(t, ok)
+	require.Empty(t, h.receiveQueue)
+}
+
+func TestClient_retry(t *testing.T) {
+	client := NewClient("http://localhost", slog.Default())
+	client.SetRetries(2, time.Millisecond)
+
+	attempts := 0
+	_, err := client.retry(context.Background(), func() (SendResult, error) {
+		attempts++
+		if attempts < 2 {
+			return SendResult{}, &RetryAfterError{Err: ErrTooManyRequests, RetryAfter: time.Hour}
+		}
+		return SendResult{BytesSent: 10}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+
+	attempts = 0
+	_, err = client.retry(context.Background(), func() (SendResult, error) {
+		attempts++
+		return SendResult{}, &RetryAfterError{Err: ErrTooManyRequests}
+	})
+	require.ErrorIs(t, err, ErrTooManyRequests)
+	require.Equal(t, 3, attempts)
+
+	attempts = 0
+	_, err = client.retry(context.Background(), func() (SendResult, error) {
+		attempts++
+		return SendResult{}, errors.New("other")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts, "other errors are not retried")
+}
+
+func TestClient_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	require.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	require.Zero(t, parseRetryAfter("", now))
+	require.Zero(t, parseRetryAfter("soon", now))
+	require.Zero(t, parseRetryAfter("-5", now))
+
+	client := NewClient("http://localhost", slog.Default())
+	require.Equal(t, time.Second, client.backoff(0, 0))
+	require.Equal(t, 4*time.Second, client.backoff(2, 0))
+	require.Equal(t, 30*time.Second, client.backoff(2, 30*time.Second))
+	require.Equal(t, defaultMaxBackoff, client.backoff(20, 0))
+}
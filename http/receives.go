@@ -0,0 +1,147 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+// ErrReceiveCanceled is returned when a receive was canceled on the server
+var ErrReceiveCanceled = errors.New("receive canceled")
+
+// Receive describes a receive in progress on the server
+type Receive struct {
+	ID             string    `json:"ID"`
+	Dataset        string    `json:"Dataset"`
+	Principal      string    `json:"Principal,omitempty"`
+	RemoteAddr     string    `json:"RemoteAddr"`
+	BytesReceived  int64     `json:"BytesReceived"`
+	Started        time.Time `json:"Started"`
+	BytesPerSecond int64     `json:"BytesPerSecond"`
+}
+
+// activeReceive is the registry entry of a receive in progress
+type activeReceive struct {
+	receive  Receive
+	counter  *zfs.CountReader
+	cancel   context.CancelFunc
+	canceled atomic.Bool
+	// interrupted is set when the receive was stopped by a shutdown of the server
+	interrupted atomic.Bool
+}
+
+// interrupt stops the receive for a shutdown of the server
+func (a *activeReceive) interrupt() {
+	a.interrupted.Store(true)
+	a.cancel()
+}
+
+// status returns the receive with its current byte count and rate
+func (a *activeReceive) status(now time.Time) Receive {
+	receive := a.receive
+	receive.BytesReceived = a.counter.Count()
+	elapsed := now.Sub(receive.Started).Seconds()
+	if elapsed > 0 {
+		receive.BytesPerSecond = int64(float64(receive.BytesReceived) / elapsed)
+	}
+	return receive
+}
+
+func newReceiveID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// trackReceive registers a receive into the dataset. The returned reader counts the bytes received from body, and
+// the returned context is canceled when the receive is canceled. The returned function removes the receive again.
+func (h *HTTP) trackReceive(req *http.Request, dataset string, body io.Reader) (context.Context, *activeReceive, io.Reader, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	active := &activeReceive{
+		receive: Receive{
+			ID:         newReceiveID(),
+			Dataset:    dataset,
+			Principal:  principal(req),
+			RemoteAddr: req.RemoteAddr,
+			Started:    time.Now(),
+		},
+		counter: zfs.NewCountReader(body),
+		cancel:  cancel,
+	}
+
+	h.receiveMutex.Lock()
+	h.receives[active.receive.ID] = active
+	if h.interruptReceives {
+		active.interrupt()
+	}
+	h.receiveMutex.Unlock()
+
+	return ctx, active, active.counter, func() {
+		h.receiveMutex.Lock()
+		delete(h.receives, active.receive.ID)
+		h.receiveMutex.Unlock()
+		cancel()
+	}
+}
+
+// mayManageReceive returns whether the request may see and cancel the receive. Principals manage their own
+// receives, the AllowManageReceives permission allows managing all receives.
+func (h *HTTP) mayManageReceive(req *http.Request, receive *Receive) bool {
+	return h.policy(req).Permissions.AllowManageReceives || receive.Principal == principal(req)
+}
+
+func (h *HTTP) handleListReceives(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	now := time.Now()
+	h.receiveMutex.Lock()
+	receives := make([]Receive, 0, len(h.receives))
+	for _, active := range h.receives {
+		if !h.mayManageReceive(req, &active.receive) {
+			continue
+		}
+		receives = append(receives, active.status(now))
+	}
+	h.receiveMutex.Unlock()
+
+	slices.SortFunc(receives, func(a, b Receive) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(receives)
+	if err != nil {
+		logger.Error("zfs.http.handleListReceives: Error encoding json", "error", err)
+		return
+	}
+}
+
+func (h *HTTP) handleCancelReceive(w http.ResponseWriter, req *http.Request, logger *slog.Logger) {
+	id := req.PathValue("id")
+
+	h.receiveMutex.Lock()
+	active, ok := h.receives[id]
+	h.receiveMutex.Unlock()
+	if !ok || !h.mayManageReceive(req, &active.receive) {
+		logger.Info("zfs.http.handleCancelReceive: Receive not found", "id", id)
+		writeError(w, http.StatusNotFound, ErrReceiveNotFound)
+		return
+	}
+	auditDataset(req, active.receive.Dataset)
+
+	active.canceled.Store(true)
+	active.cancel()
+
+	logger.Info("zfs.http.handleCancelReceive: Receive canceled",
+		"id", id, "dataset", active.receive.Dataset, "principal", active.receive.Principal,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
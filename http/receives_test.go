@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceives_ListCancel(t *testing.T) {
+	conf := Config{}
+	conf.ApplyDefaults()
+	conf.Authentication.BearerTokens = map[string]string{"token1": "backup1", "token2": "backup2", "admin": "admin"}
+	conf.Policies = map[string]Policy{
+		"admin": {Permissions: Permissions{AllowManageReceives: true}},
+	}
+	h := NewHTTP(context.Background(), conf, slog.Default())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	ctx, active, body, untrack := h.trackReceive(requestAs("backup1"), "pool/fs@snap", strings.NewReader("stream data"))
+	defer untrack()
+	_, err := io.ReadAll(body)
+	require.NoError(t, err)
+
+	clients := make(map[string]*Client)
+	for token, name := range conf.Authentication.BearerTokens {
+		clients[name] = NewClient(server.URL, slog.Default())
+		clients[name].SetBearerToken(token)
+	}
+
+	receives, err := clients["backup1"].Receives(context.Background())
+	require.NoError(t, err)
+	require.Len(t, receives, 1)
+	require.Equal(t, active.receive.ID, receives[0].ID)
+	require.Equal(t, "pool/fs@snap", receives[0].Dataset)
+	require.Equal(t, "backup1", receives[0].Principal)
+	require.EqualValues(t, 11, receives[0].BytesReceived)
+
+	receives, err = clients["backup2"].Receives(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, receives, "receives of other principals are hidden")
+	require.ErrorIs(t, clients["backup2"].CancelReceive(context.Background(), active.receive.ID), ErrReceiveNotFound)
+
+	receives, err = clients["admin"].Receives(context.Background())
+	require.NoError(t, err)
+	require.Len(t, receives, 1)
+
+	require.NoError(t, clients["admin"].CancelReceive(context.Background(), active.receive.ID))
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.True(t, active.canceled.Load())
+
+	untrack()
+	receives, err = clients["admin"].Receives(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, receives)
+}
+
+func TestReceives_trackReceiveRequestContext(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPut, "/filesystems/fs/snapshots", nil).WithContext(reqCtx)
+
+	ctx, active, _, untrack := h.trackReceive(req, "pool/fs", strings.NewReader(""))
+	defer untrack()
+	cancel()
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.False(t, active.canceled.Load(), "a closed request is not a canceled receive")
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrShuttingDown is returned when the server is shutting down and does not accept receives
+var ErrShuttingDown = errors.New("server shutting down")
+
+// Shutdown stops accepting receives, new ones are refused with 503 Service Unavailable and queued ones give up.
+// It waits for the receives in progress to finish until the context is done, then it interrupts the remaining
+// receives and waits for them to stop. Interrupted resumable receives leave their partial state behind, so
+// clients can resume them with the resume token in the response. It returns the error of the context when
+// receives had to be interrupted. The event streams of the server end as well.
+func (h *HTTP) Shutdown(ctx context.Context) error {
+	h.receiveMutex.Lock()
+	if !h.shuttingDown {
+		h.shuttingDown = true
+		close(h.shutdown)
+		h.checkDrained()
+	}
+	h.receiveMutex.Unlock()
+
+	// The event streams never end by themselves, end them once the last receive finished
+	defer h.events.Close()
+
+	select {
+	case <-h.drained:
+		h.logger.Info("zfs.http.HTTP.Shutdown: All receives finished")
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.receiveMutex.Lock()
+	h.interruptReceives = true
+	for _, active := range h.receives {
+		active.interrupt()
+	}
+	h.logger.Warn("zfs.http.HTTP.Shutdown: Interrupting receives", "receives", len(h.receives))
+	h.receiveMutex.Unlock()
+
+	<-h.drained
+	return ctx.Err()
+}
+
+// beginReceive registers a receive handler in progress, it returns false when the server is shutting down.
+// The returned function unregisters it again.
+func (h *HTTP) beginReceive() (end func(), ok bool) {
+	h.receiveMutex.Lock()
+	defer h.receiveMutex.Unlock()
+	if h.shuttingDown {
+		return nil, false
+	}
+	h.receiveHandlers++
+	return func() {
+		h.receiveMutex.Lock()
+		defer h.receiveMutex.Unlock()
+		h.receiveHandlers--
+		h.checkDrained()
+	}, true
+}
+
+// isShuttingDown returns whether Shutdown has been called
+func (h *HTTP) isShuttingDown() bool {
+	h.receiveMutex.Lock()
+	defer h.receiveMutex.Unlock()
+	return h.shuttingDown
+}
+
+// checkDrained signals Shutdown once the last receive handler finished. The receive mutex must be held.
+func (h *HTTP) checkDrained() {
+	if h.shuttingDown && h.receiveHandlers == 0 {
+		select {
+		case <-h.drained:
+		default:
+			close(h.drained)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+func TestShutdown_refuses(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{
+		MaximumConcurrentReceives:  1,
+		ReceiveQueueSize:           1,
+		ReceiveQueueMaxWaitSeconds: 60,
+		ReceiveRetryAfterSeconds:   30,
+	}, slog.Default())
+
+	h.receiveMutex.Lock()
+	h.reserveSlot("")
+	h.receiveMutex.Unlock()
+
+	queued := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(queued, httptest.NewRequest(http.MethodPut, "/filesystems/fs/snapshots/snap", strings.NewReader("stream")))
+	}()
+	require.Eventually(t, func() bool {
+		h.receiveMutex.Lock()
+		defer h.receiveMutex.Unlock()
+		return len(h.receiveQueue) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Queued receives give up right away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Shutdown(ctx))
+	<-done
+	require.Equal(t, http.StatusServiceUnavailable, queued.Code)
+	require.Equal(t, "30", queued.Header().Get(HeaderRetryAfter))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/filesystems/fs/snapshots", strings.NewReader("stream")))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.ErrorIs(t, responseError(rec.Result()), ErrShuttingDown)
+
+	// Other requests are still served
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/codecs", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Shutting down twice is fine
+	require.NoError(t, h.Shutdown(ctx))
+}
+
+func TestShutdown_interrupts(t *testing.T) {
+	h := NewHTTP(context.Background(), Config{}, slog.Default())
+
+	end, ok := h.beginReceive()
+	require.True(t, ok)
+	// The receive handler returns once the receive is canceled
+	active := &activeReceive{receive: Receive{ID: "receive"}, cancel: func() { go end() }}
+	h.receiveMutex.Lock()
+	h.receives[active.receive.ID] = active
+	h.receiveMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, h.Shutdown(ctx), context.DeadlineExceeded)
+	require.True(t, active.interrupted.Load())
+	require.False(t, active.canceled.Load())
+
+	_, ok = h.beginReceive()
+	require.False(t, ok)
+}
+
+func TestShutdown_interruptsResumableReceive(t *testing.T) {
+	zfs.TestZPool(testZPool, func() {
+		ctx := context.Background()
+		h := NewHTTP(ctx, Config{
+			ParentDataset: testZPool,
+			Permissions:   Permissions{AllowNonRaw: true},
+		}, slog.Default())
+		server := httptest.NewServer(h)
+		defer server.Close()
+
+		ds, err := zfs.CreateFilesystem(ctx, testFilesystem, zfs.CreateFilesystemOptions{
+			Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+		snap, err := ds.Snapshot(ctx, "snap", zfs.SnapshotOptions{})
+		require.NoError(t, err)
+
+		// Send the first part of the stream and then stall, like a client on a broken connection
+		stream, streamWrtr := io.Pipe()
+		go func() {
+			_ = snap.SendSnapshot(ctx, streamWrtr, zfs.SendOptions{})
+		}()
+		body, bodyWrtr := io.Pipe()
+		defer bodyWrtr.Close()
+		go func() {
+			_, _ = io.CopyN(bodyWrtr, stream, 29_636)
+			_ = stream.Close()
+		}()
+
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/filesystems/receive/snapshots/snap?%s=true",
+			server.URL, GETParamResumable,
+		), body)
+		require.NoError(t, err)
+		respCh := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			respCh <- resp
+		}()
+		require.Eventually(t, func() bool {
+			h.receiveMutex.Lock()
+			defer h.receiveMutex.Unlock()
+			for _, active := range h.receives {
+				return active.counter.Count() >= 29_636
+			}
+			return false
+		}, 10*time.Second, 10*time.Millisecond)
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, h.Shutdown(shutdownCtx), context.DeadlineExceeded)
+
+		resp := <-respCh
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		require.ErrorIs(t, responseError(resp), ErrShuttingDown)
+		token := resp.Header.Get(HeaderResumeReceiveToken)
+		require.NotEmpty(t, token, "an interrupted resumable receive can be resumed")
+
+		// Resume the receive with the token the server gave
+		resumeRdr, resumeWrtr := io.Pipe()
+		go func() {
+			require.NoError(t, zfs.ResumeSend(ctx, resumeWrtr, token, zfs.ResumeSendOptions{}))
+			require.NoError(t, resumeWrtr.Close())
+		}()
+		_, err = zfs.ReceiveSnapshot(ctx, resumeRdr, testZPool+"/receive", zfs.ReceiveOptions{
+			Resumable:  true,
+			Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+
+		received, err := zfs.GetDataset(ctx, testZPool+"/receive@snap")
+		require.NoError(t, err)
+		require.Equal(t, testZPool+"/receive@snap", received.Name)
+	})
+}
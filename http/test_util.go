@@ -23,6 +23,11 @@ func TestHTTPZPool(testZPool, prefix, testFs string, fn func(server *httptest.Se
 				AllowIncludeProperties:  true,
 				AllowDestroyFilesystems: true,
 				AllowDestroySnapshots:   true,
+
+				AllowAbortResumableReceive: true,
+				AllowRollback:              true,
+				AllowClone:                 true,
+				AllowRename:                true,
 			},
 		}, slog.Default())
 
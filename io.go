@@ -1,37 +1,66 @@
 package zfs
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log/slog"
 	"sync/atomic"
 	"time"
-
-	"github.com/juju/ratelimit"
-	"github.com/klauspost/compress/zstd"
 )
 
-func rateLimitWriter(writer io.Writer, bytesPerSecond int64) io.Writer {
+func rateLimitWriter(ctx context.Context, writer io.Writer, bytesPerSecond int64) io.Writer {
 	if bytesPerSecond <= 0 {
 		return writer
 	}
-	return ratelimit.Writer(writer, ratelimit.NewBucketWithRate(float64(bytesPerSecond), bytesPerSecond))
+	return NewPacer(ctx, func() float64 { return float64(bytesPerSecond) }).Writer(writer)
 }
 
-func zstdWriter(writer io.Writer, level zstd.EncoderLevel) (io.Writer, func(), error) {
-	if level == 0 {
-		return writer, func() {}, nil
+// sendWriter wraps the output with the writers configured for a send stream: compression, encryption, framing and
+// rate limiting. The returned finish function must be called with the result of the send, the last chunk of an
+// encrypted stream and the trailer of a framed stream are only written when the send succeeded.
+func sendWriter(ctx context.Context, output io.Writer, bytesPerSecond int64, framed bool, key StreamKey,
+	compression CompressionOptions) (io.Writer, func(sendErr error) error, error) {
+	output = rateLimitWriter(ctx, output, bytesPerSecond)
+
+	var frameWriter *FrameWriter
+	if framed {
+		frameWriter = NewFrameWriter(output)
+		output = frameWriter
+	}
+
+	var encryptWriter *EncryptWriter
+	if key != nil {
+		var err error
+		encryptWriter, err = NewEncryptWriter(output, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating encrypt writer: %w", err)
+		}
+		output = encryptWriter
 	}
 
-	encoder, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(level))
+	output, closer, err := compressWriter(output, compression)
 	if err != nil {
-		return writer, func() {}, fmt.Errorf("error creating zstd encoder: %w", err)
+		return nil, nil, err
 	}
-	return encoder, func() {
-		err := encoder.Close()
-		if err != nil {
-			slog.Error("zstdWriter: Error closing encoder", "error", err)
+	return output, func(sendErr error) error {
+		closeErr := closer()
+		if sendErr != nil {
+			return sendErr
+		}
+		if closeErr != nil {
+			// The end of the compressed stream is missing, a trailer would make the receiver accept it
+			return closeErr
+		}
+		if encryptWriter != nil {
+			err := encryptWriter.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if frameWriter != nil {
+			return frameWriter.Close()
 		}
+		return nil
 	}, nil
 }
 
@@ -23,6 +23,9 @@ type Config struct {
 	ParentDataset        string            `json:"ParentDataset" yaml:"ParentDataset"`
 	DatasetType          zfs.DatasetType   `json:"DatasetType" yaml:"DatasetType"`
 	HTTPHeaders          map[string]string `json:"HTTPHeaders" yaml:"HTTPHeaders"`
+	HTTPBearerToken      string            `json:"HTTPBearerToken" yaml:"HTTPBearerToken"`
+	HTTPHMACKeyID        string            `json:"HTTPHMACKeyID" yaml:"HTTPHMACKeyID"`
+	HTTPHMACSecret       string            `json:"HTTPHMACSecret" yaml:"HTTPHMACSecret"`
 	SnapshotNameTemplate string            `json:"SnapshotNameTemplate" yaml:"SnapshotNameTemplate"`
 
 	EnableSnapshotCreate     bool `json:"EnableSnapshotCreate" yaml:"EnableSnapshotCreate"`
@@ -31,11 +34,26 @@ type Config struct {
 	EnableSnapshotMarkRemote bool `json:"EnableSnapshotMarkRemote" yaml:"EnableSnapshotMarkRemote"`
 	EnableSnapshotPrune      bool `json:"EnableSnapshotPrune" yaml:"EnableSnapshotPrune"`
 	EnableFilesystemPrune    bool `json:"EnableFilesystemPrune" yaml:"EnableFilesystemPrune"`
+	// EnableSnapshotPull pulls the snapshots of datasets with the SnapshotPullFrom property from the remote server.
+	// The streams are requested with the SendRaw, SendCodec and SendFramed settings, and limited by the
+	// SendBandwidthSchedule.
+	EnableSnapshotPull bool `json:"EnableSnapshotPull" yaml:"EnableSnapshotPull"`
 
 	SendRoutines          int  `json:"SendRoutines" yaml:"SendRoutines"`
 	SendResumable         bool `json:"SendResumable" yaml:"SendResumable"`
 	SendRaw               bool `json:"SendRaw" yaml:"SendRaw"`
 	SendIncludeProperties bool `json:"SendIncludeProperties" yaml:"SendIncludeProperties"`
+	SendFramed            bool `json:"SendFramed" yaml:"SendFramed"`
+	// SendNestedDatasetNames sends datasets under their path relative to the ParentDataset, like customers/acme/db,
+	// instead of only the last component of their name
+	SendNestedDatasetNames bool `json:"SendNestedDatasetNames" yaml:"SendNestedDatasetNames"`
+	// SendAbortFailedResume discards the partial state on the remote server when resuming a send fails because
+	// the resume token is stale or does not match, and starts the send over. Other errors leave the state alone.
+	// This requires the AllowAbortResumableReceive permission on the server.
+	SendAbortFailedResume bool `json:"SendAbortFailedResume" yaml:"SendAbortFailedResume"`
+	// SendEstimateSize estimates the size of every send with zfs send -nvP, so the remote server can refuse sends
+	// that do not fit in its quota or free space before they start
+	SendEstimateSize bool `json:"SendEstimateSize" yaml:"SendEstimateSize"`
 
 	SendCopyProperties []string          `json:"SendCopyProperties" yaml:"SendCopyProperties"`
 	SendSetProperties  map[string]string `json:"SendSetProperties" yaml:"SendSetProperties"`
@@ -43,15 +61,30 @@ type Config struct {
 	SendCopySnapshotProperties []string          `json:"SendCopySnapshotProperties" yaml:"SendCopySnapshotProperties"`
 	SendSetSnapshotProperties  map[string]string `json:"SendSetSnapshotProperties" yaml:"SendSetSnapshotProperties"`
 
+	// PullReceiveProperties are set on the local datasets when receiving pulled snapshots
+	PullReceiveProperties map[string]string `json:"PullReceiveProperties" yaml:"PullReceiveProperties"`
+	// PullDecryptionKeys requests encrypted streams from the remote server, and decrypts them with these keys
+	PullDecryptionKeys []zfs.StreamKey `json:"PullDecryptionKeys" yaml:"PullDecryptionKeys"`
+	// PullReceiveForceRollback rolls back local changes made since the last pulled snapshot before receiving
+	PullReceiveForceRollback bool `json:"PullReceiveForceRollback" yaml:"PullReceiveForceRollback"`
+
 	//nolint:lll
 	SnapshotRetentionCountIgnoreWithoutCreated bool `json:"SnapshotRetentionCountIgnoreWithoutCreated" yaml:"SnapshotRetentionCountIgnoreWithoutCreated"`
 
-	SendCompressionLevel                 zstd.EncoderLevel `json:"SendCompressionLevel" yaml:"SendCompressionLevel"`
-	SendSpeedBytesPerSecond              int64             `json:"SendSpeedBytesPerSecond" yaml:"SendSpeedBytesPerSecond"`
-	SendProgressEventIntervalSeconds     int64             `json:"SendProgressEventIntervalSeconds" yaml:"SendProgressEventIntervalSeconds"`
-	SendReceiveForceRollback             bool              `json:"SendReceiveForceRollback" yaml:"SendReceiveForceRollback"`
-	MaximumSendTimeSeconds               int64             `json:"MaximumSendTimeSeconds" yaml:"MaximumSendTimeSeconds"`
-	MaximumRemoteSnapshotCacheAgeSeconds int64             `json:"MaximumRemoteSnapshotCacheAgeSeconds" yaml:"MaximumRemoteSnapshotCacheAgeSeconds"`
+	SendCompressionLevel zstd.EncoderLevel `json:"SendCompressionLevel" yaml:"SendCompressionLevel"`
+	SendCodec            zfs.Codec         `json:"SendCodec" yaml:"SendCodec"`
+	SendEncryptionKey    zfs.StreamKey     `json:"SendEncryptionKey" yaml:"SendEncryptionKey"`
+	// Deprecated: use SendBandwidthSchedule
+	SendSpeedBytesPerSecond              int64 `json:"SendSpeedBytesPerSecond" yaml:"SendSpeedBytesPerSecond"`
+	SendProgressEventIntervalSeconds     int64 `json:"SendProgressEventIntervalSeconds" yaml:"SendProgressEventIntervalSeconds"`
+	SendReceiveForceRollback             bool  `json:"SendReceiveForceRollback" yaml:"SendReceiveForceRollback"`
+	MaximumSendTimeSeconds               int64 `json:"MaximumSendTimeSeconds" yaml:"MaximumSendTimeSeconds"`
+	MaximumRemoteSnapshotCacheAgeSeconds int64 `json:"MaximumRemoteSnapshotCacheAgeSeconds" yaml:"MaximumRemoteSnapshotCacheAgeSeconds"`
+
+	// SendBandwidthSchedule limits the bandwidth of sends and pulls by the time of day, like
+	// "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited". Transfers in progress follow the schedule as it changes.
+	// It replaces SendSpeedBytesPerSecond, which only applies when no schedule is set.
+	SendBandwidthSchedule zfs.BandwidthSchedule `json:"SendBandwidthSchedule" yaml:"SendBandwidthSchedule"`
 
 	Properties Properties `json:"Properties" yaml:"Properties"`
 }
@@ -69,6 +102,7 @@ func (c *Config) ApplyDefaults() {
 	c.EnableSnapshotMark = true
 	c.EnableSnapshotPrune = true
 	c.EnableFilesystemPrune = false
+	c.EnableSnapshotPull = false
 
 	c.SnapshotRetentionCountIgnoreWithoutCreated = true
 
@@ -95,6 +129,13 @@ func (c *Config) maximumRemoteSnapshotCacheAge() time.Duration {
 	return time.Duration(c.MaximumRemoteSnapshotCacheAgeSeconds) * time.Second
 }
 
+func (c *Config) sendBandwidthSchedule() zfs.BandwidthSchedule {
+	if c.SendBandwidthSchedule.IsZero() {
+		return zfs.BandwidthSchedule{Default: c.SendSpeedBytesPerSecond}
+	}
+	return c.SendBandwidthSchedule
+}
+
 func (c *Config) sendSetProperties() map[string]string {
 	props := make(map[string]string, len(c.SendSetProperties)+len(c.SendCopyProperties))
 	for k, v := range c.SendSetProperties {
@@ -120,6 +161,7 @@ type Properties struct {
 	SnapshotCreatedAt          string `json:"SnapshotCreatedAt" yaml:"SnapshotCreatedAt"`
 	SnapshotIgnoreCreate       string `json:"SnapshotIgnoreCreate" yaml:"SnapshotIgnoreCreate"`
 	SnapshotSendTo             string `json:"SnapshotSendTo" yaml:"SnapshotSendTo"`
+	SnapshotPullFrom           string `json:"SnapshotPullFrom" yaml:"SnapshotPullFrom"`
 	SnapshotSending            string `json:"SnapshotSending" yaml:"SnapshotSending"`
 	SnapshotSentAt             string `json:"SnapshotSentAt" yaml:"SnapshotSentAt"`
 	SnapshotIgnoreSend         string `json:"SnapshotIgnoreSend" yaml:"SnapshotIgnoreSend"`
@@ -139,6 +181,7 @@ const (
 	defaultSnapshotCreatedAtProperty          = "snapshot-created-at"
 	defaultSnapshotIgnoreCreate               = "snapshot-ignore-create"
 	defaultSnapshotSendToProperty             = "snapshot-send-to"
+	defaultSnapshotPullFromProperty           = "snapshot-pull-from"
 	defaultSnapshotSendingProperty            = "snapshot-sending"
 	defaultSnapshotSentAtProperty             = "snapshot-sent-at"
 	defaultSnapshotIgnoreSendProperty         = "snapshot-ignore-send"
@@ -159,6 +202,7 @@ func (p *Properties) ApplyDefaults() {
 	p.SnapshotCreatedAt = defaultSnapshotCreatedAtProperty
 	p.SnapshotIgnoreCreate = defaultSnapshotIgnoreCreate
 	p.SnapshotSendTo = defaultSnapshotSendToProperty
+	p.SnapshotPullFrom = defaultSnapshotPullFromProperty
 	p.SnapshotSending = defaultSnapshotSendingProperty
 	p.SnapshotSentAt = defaultSnapshotSentAtProperty
 	p.SnapshotIgnoreSend = defaultSnapshotIgnoreSendProperty
@@ -190,6 +234,10 @@ func (p *Properties) snapshotSendTo() string {
 	return fmt.Sprintf("%s:%s", p.Namespace, p.SnapshotSendTo)
 }
 
+func (p *Properties) snapshotPullFrom() string {
+	return fmt.Sprintf("%s:%s", p.Namespace, p.SnapshotPullFrom)
+}
+
 func (p *Properties) snapshotSending() string {
 	return fmt.Sprintf("%s:%s", p.Namespace, p.SnapshotSending)
 }
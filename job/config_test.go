@@ -0,0 +1,23 @@
+package job
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+)
+
+func TestConfig_sendBandwidthSchedule(t *testing.T) {
+	schedule, err := zfs.ParseBandwidthSchedule("08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited")
+	require.NoError(t, err)
+
+	// A schedule that is unlimited outside its windows is not overridden by the deprecated speed
+	conf := Config{SendBandwidthSchedule: schedule, SendSpeedBytesPerSecond: 1024}
+	require.Equal(t, schedule, conf.sendBandwidthSchedule())
+
+	conf = Config{SendSpeedBytesPerSecond: 1024}
+	require.Equal(t, zfs.BandwidthSchedule{Default: 1024}, conf.sendBandwidthSchedule())
+
+	require.True(t, (&Config{}).sendBandwidthSchedule().IsZero())
+}
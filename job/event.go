@@ -1,6 +1,13 @@
 package job
 
-import eventemitter "github.com/vansante/go-event-emitter"
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	eventemitter "github.com/vansante/go-event-emitter"
+	zfshttp "github.com/vansante/go-zfsutils/http"
+)
 
 const (
 	CreatedSnapshotEvent         eventemitter.EventType = "created-snapshot"
@@ -9,7 +16,80 @@ const (
 	ResumeSendingSnapshotEvent   eventemitter.EventType = "resume-sending-snapshot"
 	SendSnapshotErrorEvent       eventemitter.EventType = "send-snapshot-error"
 	SentSnapshotEvent            eventemitter.EventType = "sent-snapshot"
+	StartPullingSnapshotEvent    eventemitter.EventType = "start-pulling-snapshot"
+	SnapshotPullingProgressEvent eventemitter.EventType = "snapshot-pulling-progress"
+	ResumePullingSnapshotEvent   eventemitter.EventType = "resume-pulling-snapshot"
+	PullSnapshotErrorEvent       eventemitter.EventType = "pull-snapshot-error"
+	PulledSnapshotEvent          eventemitter.EventType = "pulled-snapshot"
 	MarkSnapshotDeletionEvent    eventemitter.EventType = "mark-snapshot-deletion"
 	DeletedSnapshotEvent         eventemitter.EventType = "deleted-snapshot"
 	DeletedFilesystemEvent       eventemitter.EventType = "deleted-filesystem"
 )
+
+// streamEvent converts an event of the runner to an event of an event stream
+func streamEvent(eventType eventemitter.EventType, args []any) zfshttp.Event {
+	event := zfshttp.Event{Type: string(eventType)}
+	arg := func(i int) any {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	setName := func(name any) {
+		full, _ := name.(string)
+		event.Dataset, event.Snapshot, _ = strings.Cut(full, "@")
+	}
+
+	switch eventType {
+	case CreatedSnapshotEvent:
+		event.Dataset, _ = arg(0).(string)
+		event.Snapshot, _ = arg(1).(string)
+	case StartSendingSnapshotEvent, StartPullingSnapshotEvent, ResumePullingSnapshotEvent:
+		setName(arg(0))
+		event.Server, _ = arg(1).(string)
+	case SnapshotSendingProgressEvent, ResumeSendingSnapshotEvent, SnapshotPullingProgressEvent:
+		setName(arg(0))
+		event.Server, _ = arg(1).(string)
+		event.Bytes = eventBytes(arg(2))
+	case SendSnapshotErrorEvent, PullSnapshotErrorEvent:
+		setName(arg(0))
+		event.Server, _ = arg(1).(string)
+		if err, ok := arg(2).(error); ok {
+			event.Error = err.Error()
+		}
+	case SentSnapshotEvent, PulledSnapshotEvent:
+		setName(arg(0))
+		event.Server, _ = arg(1).(string)
+		event.Bytes = eventBytes(arg(2))
+		if took, ok := arg(3).(time.Duration); ok {
+			event.DurationSeconds = took.Seconds()
+		}
+	case MarkSnapshotDeletionEvent, DeletedSnapshotEvent, DeletedFilesystemEvent:
+		setName(arg(0))
+	}
+	return event
+}
+
+func eventBytes(arg any) int64 {
+	switch bytes := arg.(type) {
+	case int64:
+		return bytes
+	case uint64:
+		return int64(bytes)
+	case int:
+		return int64(bytes)
+	}
+	return 0
+}
+
+// PublishEvents publishes the events of the runner to the event stream, like the one of a zfs http server
+func (r *Runner) PublishEvents(stream *zfshttp.EventStream) {
+	r.AddCapturer(func(eventType eventemitter.EventType, args ...any) {
+		stream.Publish(streamEvent(eventType, args))
+	})
+}
+
+// EventsHandler returns a handler streaming the events of the runner as server-sent events
+func (r *Runner) EventsHandler() http.Handler {
+	return r.events
+}
@@ -0,0 +1,68 @@
+package job
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	eventemitter "github.com/vansante/go-event-emitter"
+	zfshttp "github.com/vansante/go-zfsutils/http"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_streamEvent(t *testing.T) {
+	tests := []struct {
+		eventType eventemitter.EventType
+		args      []any
+		want      zfshttp.Event
+	}{
+		{
+			CreatedSnapshotEvent, []any{"tank/fs", "snap", time.Now()},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap"},
+		},
+		{
+			StartSendingSnapshotEvent, []any{"tank/fs@snap", "http://server"},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap", Server: "http://server"},
+		},
+		{
+			ResumeSendingSnapshotEvent, []any{"tank/fs@snap", "http://server", uint64(512)},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap", Server: "http://server", Bytes: 512},
+		},
+		{
+			SnapshotPullingProgressEvent, []any{"tank/fs@snap", "http://server", int64(1024)},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap", Server: "http://server", Bytes: 1024},
+		},
+		{
+			ResumePullingSnapshotEvent, []any{"tank/fs", "http://server"},
+			zfshttp.Event{Dataset: "tank/fs", Server: "http://server"},
+		},
+		{
+			SendSnapshotErrorEvent, []any{"tank/fs@snap", "http://server", errors.New("broken pipe")},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap", Server: "http://server", Error: "broken pipe"},
+		},
+		{
+			SentSnapshotEvent, []any{"tank/fs@snap", "http://server", int64(2048), 2 * time.Second},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap", Server: "http://server", Bytes: 2048, DurationSeconds: 2},
+		},
+		{
+			DeletedSnapshotEvent, []any{"tank/fs@snap", "fs", "snap"},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap"},
+		},
+		{
+			DeletedFilesystemEvent, []any{"tank/fs", "fs"},
+			zfshttp.Event{Dataset: "tank/fs"},
+		},
+		{
+			// Missing arguments do not break the stream
+			SentSnapshotEvent, []any{"tank/fs@snap"},
+			zfshttp.Event{Dataset: "tank/fs", Snapshot: "snap"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.eventType), func(t *testing.T) {
+			tt.want.Type = string(tt.eventType)
+			require.Equal(t, tt.want, streamEvent(tt.eventType, tt.args))
+		})
+	}
+}
@@ -29,7 +29,11 @@ func (r *Runner) remoteDatasetSnapshots(client *zfshttp.Client, remoteDataset st
 	r.cacheLock.RUnlock()
 
 	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
-	remoteSnaps, err := client.DatasetSnapshots(ctx, remoteDataset, []string{r.config.Properties.snapshotCreatedAt()})
+	listSnapshots := client.DatasetSnapshots
+	if r.config.DatasetType == zfs.DatasetVolume {
+		listSnapshots = client.VolumeSnapshots
+	}
+	remoteSnaps, err := listSnapshots(ctx, remoteDataset, []string{r.config.Properties.snapshotCreatedAt()})
 	cancel()
 	switch {
 	case errors.Is(err, zfs.ErrDatasetNotFound):
@@ -3,9 +3,7 @@ package job
 import (
 	"context"
 	"errors"
-	"fmt"
 	"log/slog"
-	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +19,7 @@ const (
 
 	createSnapshotInterval   = 5 * time.Minute
 	sendSnapshotInterval     = 15 * time.Minute // Effectively divided by the amount of send routines configured (default 3)
+	pullSnapshotInterval     = 15 * time.Minute
 	pruneRemoteCacheInterval = 5 * time.Minute
 	markSnapshotInterval     = 10 * time.Minute
 	pruneSnapshotInterval    = 10 * time.Minute
@@ -35,14 +34,16 @@ func NewRunner(ctx context.Context, conf Config, logger *slog.Logger) *Runner {
 		datasetLock: make(map[string]struct{}),
 		remoteCache: make(map[string]map[string]*datasetCache),
 		sendChan:    make(chan string),
+		events:      zfshttp.NewEventStream(logger),
 		logger:      logger,
 		ctx:         ctx,
 	}
 	r.attachListeners()
+	r.PublishEvents(r.events)
 	return r
 }
 
-// Runner runs Create, ZFSSending and Prune snapshot jobs. Additionally, it can prune filesystems.
+// Runner runs Create, ZFSSending, Pull and Prune snapshot jobs. Additionally, it can prune filesystems.
 type Runner struct {
 	*eventemitter.Emitter
 
@@ -58,6 +59,8 @@ type Runner struct {
 	sends    []*zfsSend
 	sendLock sync.RWMutex
 
+	events *zfshttp.EventStream
+
 	logger *slog.Logger
 	ctx    context.Context
 }
@@ -67,6 +70,12 @@ func (r *Runner) getServerClient(server string) *zfshttp.Client {
 	for hdr := range r.config.HTTPHeaders {
 		client.SetHeader(hdr, r.config.HTTPHeaders[hdr])
 	}
+	if r.config.HTTPBearerToken != "" {
+		client.SetBearerToken(r.config.HTTPBearerToken)
+	}
+	if r.config.HTTPHMACKeyID != "" {
+		client.SetHMACKey(r.config.HTTPHMACKeyID, r.config.HTTPHMACSecret)
+	}
 	return client
 }
 
@@ -92,7 +101,7 @@ func (r *Runner) attachListeners() {
 }
 
 func (r *Runner) onSendStart(snapName string) {
-	dsName := r.fullDatasetName(datasetName(snapName, true))
+	dsName := stripDatasetSnapshot(snapName)
 	ds, err := zfs.GetDataset(r.ctx, dsName)
 	if err != nil {
 		r.logger.Error("zfs.job.runner.onSendStart: Error retrieving dataset",
@@ -111,7 +120,7 @@ func (r *Runner) onSendStart(snapName string) {
 }
 
 func (r *Runner) onSendComplete(snapName string) {
-	dsName := r.fullDatasetName(datasetName(snapName, true))
+	dsName := stripDatasetSnapshot(snapName)
 	ds, err := zfs.GetDataset(r.ctx, dsName)
 	if err != nil {
 		r.logger.Error("zfs.job.runner.onSendComplete: Error retrieving dataset",
@@ -129,11 +138,12 @@ func (r *Runner) onSendComplete(snapName string) {
 	r.logger.Debug("zfs.job.runner.onSendStart: Snapshot sending property removed")
 }
 
-func (r *Runner) fullDatasetName(dataset string) string {
-	if r.config.ParentDataset == "" {
-		return dataset
+// remoteDatasetName returns the name a local dataset or snapshot is known by on the remote server
+func (r *Runner) remoteDatasetName(name string) string {
+	if !r.config.SendNestedDatasetNames {
+		return datasetName(name, true)
 	}
-	return fmt.Sprintf("%s/%s", strings.TrimRight(r.config.ParentDataset, "/"), dataset)
+	return relativeDatasetName(r.config.ParentDataset, name)
 }
 
 func (r *Runner) datasetHasLockProperty(dataset string) bool {
@@ -190,6 +200,14 @@ func (r *Runner) Run() {
 		go r.runPruneRemoteCache()
 	}
 
+	if r.config.EnableSnapshotPull {
+		go r.runPullSnapshots()
+
+		if !r.config.EnableSnapshotSend {
+			go r.runPruneRemoteCache()
+		}
+	}
+
 	if r.config.EnableSnapshotMark {
 		go r.runMarkSnapshots(time.Minute)
 	}
@@ -281,6 +299,32 @@ func (r *Runner) runSendSnapshotRoutine(id int) {
 	}
 }
 
+func (r *Runner) runPullSnapshots() {
+	dur := randomizeDuration(pullSnapshotInterval)
+	ticker := time.NewTicker(dur)
+	defer ticker.Stop()
+
+	r.logger.Info("zfs.job.Runner.runPullSnapshots: Running", "interval", dur)
+	defer r.logger.Info("zfs.job.Runner.runPullSnapshots: Stopped")
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.pullSnapshots()
+			switch {
+			case isContextError(err):
+				r.logger.Info("zfs.job.Runner.runPullSnapshots: Job interrupted", "error", err)
+			case errors.Is(err, zfs.ErrPoolIOSuspended), errors.Is(err, zfs.ErrDatasetNotFound):
+				r.logger.Warn("zfs.job.Runner.runPullSnapshots: Cannot query datasets", "error", err)
+			case err != nil:
+				r.logger.Error("zfs.job.Runner.runPullSnapshots: Error pulling snapshots", "error", err)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
 func (r *Runner) runPruneRemoteCache() {
 	dur := randomizeDuration(pruneRemoteCacheInterval)
 	ticker := time.NewTicker(dur)
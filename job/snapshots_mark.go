@@ -305,7 +305,11 @@ func (r *Runner) markRemoteDatasetSnapshot(localSnap *zfs.Dataset, server, delet
 	defer cancel()
 
 	client := r.getServerClient(server)
-	return client.SetSnapshotProperties(ctx, datasetName(localSnap.Name, true), snapshotName(localSnap.Name), zfshttp.SetProperties{
+	setSnapshotProperties := client.SetSnapshotProperties
+	if r.config.DatasetType == zfs.DatasetVolume {
+		setSnapshotProperties = client.SetVolumeSnapshotProperties
+	}
+	return setSnapshotProperties(ctx, r.remoteDatasetName(localSnap.Name), snapshotName(localSnap.Name), zfshttp.SetProperties{
 		Set: map[string]string{
 			deleteProp: deleteAt.Format(dateTimeFormat),
 		},
@@ -0,0 +1,350 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	zfs "github.com/vansante/go-zfsutils"
+	zfshttp "github.com/vansante/go-zfsutils/http"
+)
+
+// snapshotPull is a remote snapshot that is missing locally
+type snapshotPull struct {
+	// Snapshot is the remote snapshot
+	Snapshot *zfs.Dataset
+	// IncrementalBase is the name of the snapshot to pull an incremental stream from, empty for a full stream
+	IncrementalBase string
+}
+
+func (r *Runner) pullSnapshots() error {
+	pullFromProp := r.config.Properties.snapshotPullFrom()
+
+	datasets, err := zfs.ListWithProperty(r.ctx, pullFromProp, zfs.ListWithPropertyOptions{
+		ParentDataset:   r.config.ParentDataset,
+		DatasetType:     r.config.DatasetType,
+		PropertySources: []zfs.PropertySource{zfs.PropertySourceLocal},
+	})
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error finding pullable datasets: %w", err)
+	}
+
+	for dataset := range datasets {
+		if r.ctx.Err() != nil {
+			return nil // context expired, no problem
+		}
+
+		err := r.pullDatasetSnapshotsByName(dataset)
+		switch {
+		case isContextError(err):
+			return err
+		case err != nil:
+			// Errors are already logged, we do want to continue pulling other dataset snapshots
+			continue
+		}
+	}
+	return nil
+}
+
+func (r *Runner) pullDatasetSnapshotsByName(dataset string) error {
+	pullFromProp := r.config.Properties.snapshotPullFrom()
+
+	ds, err := zfs.GetDataset(r.ctx, dataset, pullFromProp, zfs.PropertyReceiveResumeToken)
+	switch {
+	case errors.Is(err, zfs.ErrDatasetNotFound):
+		return nil // Dataset was removed meanwhile, continue with the next one
+	case err != nil:
+		return fmt.Errorf("error retrieving pullable dataset %s: %w", dataset, err)
+	}
+
+	if ds.Type == zfs.DatasetSnapshot {
+		// We dont pull into individual snapshots
+		return nil
+	}
+
+	if !propertyIsSet(ds.ExtraProps[pullFromProp]) {
+		r.logger.Debug("zfs.job.Runner.pullDatasetSnapshotsByName: No server specified", "dataset", dataset)
+		return nil
+	}
+
+	err = r.pullDatasetSnapshots(ds)
+	switch {
+	case isContextError(err):
+		r.logger.Info("zfs.job.Runner.pullDatasetSnapshotsByName: Pull snapshot job interrupted",
+			"error", err,
+			"dataset", dataset,
+		)
+		return err
+	case err != nil:
+		r.logger.Error("zfs.job.Runner.pullDatasetSnapshotsByName: Error pulling snapshot",
+			"error", err,
+			"dataset", dataset,
+		)
+		return err
+	}
+	return nil
+}
+
+func (r *Runner) pullDatasetSnapshots(ds *zfs.Dataset) error {
+	locked, unlock := r.lockDataset(ds.Name)
+	if !locked {
+		return nil // Some other goroutine is doing something with this dataset already, continue to next.
+	}
+	defer func() {
+		// Unlock this dataset again
+		unlock()
+	}()
+
+	pullFromProp := r.config.Properties.snapshotPullFrom()
+	server := ds.ExtraProps[pullFromProp]
+	if server == "" {
+		return fmt.Errorf("%s property is empty on %s", pullFromProp, ds.Name)
+	}
+
+	client := r.getServerClient(server)
+	remoteDataset := r.remoteDatasetName(ds.Name)
+
+	// A receive resume token means an earlier pull was interrupted, try to finish that one first
+	if propertyIsSet(ds.ExtraProps[zfs.PropertyReceiveResumeToken]) {
+		err := r.resumePullSnapshot(client, ds, ds.ExtraProps[zfs.PropertyReceiveResumeToken])
+		switch {
+		case isContextError(err):
+			return err
+		case errors.Is(err, zfshttp.ErrTooManyRequests), errors.Is(err, zfshttp.ErrShuttingDown):
+			r.logger.Info("zfs.job.Runner.pullDatasetSnapshots: Server not accepting requests, delaying resume",
+				"error", err,
+				"dataset", ds.Name,
+				"server", client.Server(),
+			)
+			return nil
+		case resumeTokenError(err):
+			r.logger.Warn("zfs.job.Runner.pullDatasetSnapshots: Resume not possible, aborting local resumable receive",
+				"error", err,
+				"dataset", ds.Name,
+				"server", client.Server(),
+			)
+			// The partial data cannot be resumed, throw it away so the pull below starts over
+			abortErr := zfs.AbortResumableReceive(r.ctx, ds.Name)
+			if abortErr != nil {
+				return fmt.Errorf("%w, aborting the resumable receive failed: %w", err, abortErr)
+			}
+		case err != nil:
+			// Keep the partial data for transient errors, the next run resumes again
+			return err
+		}
+	}
+
+	remoteSnaps, err := r.remoteDatasetSnapshots(client, remoteDataset)
+	if err != nil {
+		return err
+	}
+	if len(remoteSnaps) == 0 {
+		// Nothing to do
+		return nil
+	}
+
+	localSnaps, err := zfs.ListSnapshots(r.ctx, zfs.ListOptions{
+		ParentDataset: ds.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("error listing local %s snapshots: %w", ds.Name, err)
+	}
+
+	toPull, err := reconcilePullSnapshots(localSnaps, remoteSnaps, ds.Name, remoteDataset)
+	if err != nil {
+		return fmt.Errorf("error reconciling %s snapshots: %w", ds.Name, err)
+	}
+
+	for _, pull := range toPull {
+		if r.ctx.Err() != nil {
+			return nil // context expired, no problem
+		}
+
+		pulled, err := r.pullSnapshot(client, ds, remoteDataset, pull)
+		if err != nil {
+			return err
+		}
+		if !pulled {
+			// The next snapshots are incremental upon this one, so they have to wait as well
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *Runner) fetchOptions() zfshttp.FetchOptions {
+	return zfshttp.FetchOptions{
+		DatasetType: r.config.DatasetType,
+		Raw:         r.config.SendRaw,
+		Codec:       r.config.SendCodec,
+		Framed:      r.config.SendFramed,
+		Encrypted:   len(r.config.PullDecryptionKeys) > 0,
+	}
+}
+
+func (r *Runner) resumePullSnapshot(client *zfshttp.Client, ds *zfs.Dataset, resumeToken string) error {
+	r.logger.Debug("zfs.job.Runner.resumePullSnapshot: Resuming pulling snapshot",
+		"dataset", ds.Name,
+		"server", client.Server(),
+	)
+
+	r.EmitEvent(ResumePullingSnapshotEvent, ds.Name, client.Server())
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.maximumSendTime())
+	result, err := client.Receive(ctx, zfshttp.SnapshotReceiveOptions{
+		FetchOptions: r.fetchOptions(),
+		ResumeToken:  resumeToken,
+		LocalName:    ds.Name,
+		ReceiveOptions: zfs.ReceiveOptions{
+			Resumable:         true,
+			DecryptionKeys:    r.config.PullDecryptionKeys,
+			BandwidthSchedule: r.config.sendBandwidthSchedule(),
+		},
+		ProgressEvery: r.config.sendProgressInterval(),
+		ProgressFn: func(bytes int64) {
+			r.EmitEvent(SnapshotPullingProgressEvent, ds.Name, client.Server(), bytes)
+		},
+	})
+	cancel()
+	if err != nil {
+		if !errors.Is(err, zfshttp.ErrTooManyRequests) && !errors.Is(err, zfshttp.ErrShuttingDown) {
+			// A busy or draining server only delays the resume, the caller keeps the resume state
+			r.EmitEvent(PullSnapshotErrorEvent, ds.Name, client.Server(), err)
+		}
+
+		return fmt.Errorf("error resuming pull of %s (received %d bytes in %s): %w",
+			ds.Name, result.BytesReceived, result.TimeTaken, err,
+		)
+	}
+
+	r.logger.Debug("zfs.job.Runner.resumePullSnapshot: Pulled snapshot",
+		"dataset", ds.Name,
+		"server", client.Server(),
+		"bytesReceived", result.BytesReceived,
+		"timeTaken", result.TimeTaken.String(),
+	)
+
+	r.EmitEvent(PulledSnapshotEvent, ds.Name, client.Server(), result.BytesReceived, result.TimeTaken)
+	return nil
+}
+
+func (r *Runner) pullSnapshot(client *zfshttp.Client, ds *zfs.Dataset, remoteDataset string, pull snapshotPull) (bool, error) {
+	snapName := snapshotName(pull.Snapshot.Name)
+	localName := fmt.Sprintf("%s@%s", ds.Name, snapName)
+
+	r.logger.Debug("zfs.job.Runner.pullSnapshot: Pulling snapshot",
+		"snapshot", localName,
+		"server", client.Server(),
+		"incrementalBase", pull.IncrementalBase,
+	)
+
+	r.EmitEvent(StartPullingSnapshotEvent, localName, client.Server())
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.maximumSendTime())
+	result, err := client.Receive(ctx, zfshttp.SnapshotReceiveOptions{
+		FetchOptions:    r.fetchOptions(),
+		DatasetName:     remoteDataset,
+		SnapshotName:    snapName,
+		IncrementalBase: pull.IncrementalBase,
+		LocalName:       localName,
+		ReceiveOptions: zfs.ReceiveOptions{
+			Resumable:         true,
+			Properties:        r.config.PullReceiveProperties,
+			DecryptionKeys:    r.config.PullDecryptionKeys,
+			BandwidthSchedule: r.config.sendBandwidthSchedule(),
+			// A full stream can only be received over the existing, empty, dataset with a forced rollback
+			ForceRollback: r.config.PullReceiveForceRollback || pull.IncrementalBase == "",
+		},
+		ProgressEvery: r.config.sendProgressInterval(),
+		ProgressFn: func(bytes int64) {
+			r.EmitEvent(SnapshotPullingProgressEvent, localName, client.Server(), bytes)
+		},
+	})
+	cancel()
+	switch {
+	case errors.Is(err, zfshttp.ErrTooManyRequests), errors.Is(err, zfshttp.ErrShuttingDown):
+		// A partial receive keeps its resume token, the next run resumes it
+		r.logger.Info("zfs.job.Runner.pullSnapshot: Server not accepting requests, delaying",
+			"error", err,
+			"snapshot", localName,
+			"server", client.Server(),
+		)
+		return false, nil
+	case err != nil:
+		r.EmitEvent(PullSnapshotErrorEvent, localName, client.Server(), err)
+
+		return false, fmt.Errorf("error pulling %s@%s (received %d bytes in %s): %w",
+			remoteDataset, snapName, result.BytesReceived, result.TimeTaken, err,
+		)
+	}
+
+	// Keep the creation time of the remote snapshot, so pruning by age works the same on both ends
+	createdProp := r.config.Properties.snapshotCreatedAt()
+	if propertyIsSet(pull.Snapshot.ExtraProps[createdProp]) && result.Dataset != nil {
+		err = result.Dataset.SetProperty(r.ctx, createdProp, pull.Snapshot.ExtraProps[createdProp])
+		if err != nil {
+			r.logger.Error("zfs.job.Runner.pullSnapshot: Error setting snapshot property",
+				"error", err, "snapshot", localName, "property", createdProp,
+			)
+		}
+	}
+
+	r.logger.Debug("zfs.job.Runner.pullSnapshot: Snapshot pulled",
+		"snapshot", localName,
+		"server", client.Server(),
+		"bytesReceived", result.BytesReceived,
+		"timeTaken", result.TimeTaken.String(),
+	)
+
+	r.EmitEvent(PulledSnapshotEvent, localName, client.Server(), result.BytesReceived, result.TimeTaken)
+	return true, nil
+}
+
+// reconcilePullSnapshots returns the remote snapshots of the remote dataset that come after the most recent
+// snapshot both datasets have, in order, each incremental upon the one before it.
+func reconcilePullSnapshots(local, remote []zfs.Dataset, localDataset, remoteDataset string) ([]snapshotPull, error) {
+	hasLocal := false
+	for _, snap := range local {
+		if stripDatasetSnapshot(snap.Name) == localDataset {
+			hasLocal = true
+			break
+		}
+	}
+
+	remoteDataset = listedDatasetName(remote, remoteDataset)
+	toPull := make([]snapshotPull, 0, 8)
+	prevSnap := ""
+	for i := range remote {
+		snap := &remote[i]
+		if stripDatasetSnapshot(snap.Name) != remoteDataset {
+			continue // A snapshot of a child dataset
+		}
+
+		name := snapshotName(snap.Name)
+		if snapshotsContain(local, localDataset, name) {
+			prevSnap = name
+			continue // No more to do
+		}
+
+		if hasLocal && prevSnap == "" {
+			// If we have snapshots, but we haven't found the common snapshot yet, continue
+			continue
+		}
+
+		toPull = append(toPull, snapshotPull{
+			Snapshot:        snap,
+			IncrementalBase: prevSnap,
+		})
+
+		// Once we have pulled this snapshot, the next one can be incremental upon it
+		prevSnap = name
+	}
+
+	if hasLocal && prevSnap == "" {
+		return toPull, fmt.Errorf("%w: %s", ErrNoCommonSnapshots, localDataset)
+	}
+	return toPull, nil
+}
@@ -0,0 +1,127 @@
+package job
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	zfs "github.com/vansante/go-zfsutils"
+	zfshttp "github.com/vansante/go-zfsutils/http"
+)
+
+func TestRunner_pullSnapshots(t *testing.T) {
+	runnerTest(t, func(url string, runner *Runner) {
+		createdProp := runner.config.Properties.snapshotCreatedAt()
+		remoteName := testHTTPZPool + "/" + datasetName(testFilesystem, true)
+
+		remote, err := zfs.CreateFilesystem(t.Context(), remoteName, zfs.CreateFilesystemOptions{
+			Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+		})
+		require.NoError(t, err)
+
+		createdTm := time.Now().Add(-time.Minute).Format(dateTimeFormat)
+		for _, snap := range sendSnaps[:3] {
+			snapshot, err := remote.Snapshot(t.Context(), snap, zfs.SnapshotOptions{})
+			require.NoError(t, err)
+			require.NoError(t, snapshot.SetProperty(t.Context(), createdProp, createdTm))
+		}
+
+		ds, err := zfs.GetDataset(t.Context(), testFilesystem)
+		require.NoError(t, err)
+		require.NoError(t, ds.SetProperty(t.Context(), runner.config.Properties.snapshotPullFrom(), url))
+		runner.config.PullReceiveProperties = map[string]string{zfs.PropertyCanMount: zfs.ValueOff}
+
+		pulledCount := 0
+		runner.AddListener(PulledSnapshotEvent, func(arguments ...interface{}) {
+			require.Equal(t, testFilesystem+"@"+sendSnaps[pulledCount], arguments[0])
+			require.Equal(t, url, arguments[1])
+			require.NotZero(t, arguments[2], "bytes received should not be zero")
+			pulledCount++
+		})
+
+		require.NoError(t, runner.pullSnapshots())
+		require.Equal(t, 3, pulledCount)
+
+		// Pull the newer snapshots incrementally
+		for _, snap := range sendSnaps[3:] {
+			_, err := remote.Snapshot(t.Context(), snap, zfs.SnapshotOptions{})
+			require.NoError(t, err)
+		}
+		runner.clearRemoteDatasetCache(url, datasetName(testFilesystem, true))
+
+		require.NoError(t, runner.pullSnapshots())
+		require.Equal(t, 5, pulledCount)
+
+		snaps, err := zfs.ListSnapshots(t.Context(), zfs.ListOptions{
+			ParentDataset:   testFilesystem,
+			ExtraProperties: []string{createdProp},
+		})
+		require.NoError(t, err)
+		require.Len(t, snaps, 5)
+		for i, snap := range sendSnaps {
+			require.Equal(t, testFilesystem+"@"+snap, snaps[i].Name)
+		}
+		require.Equal(t, createdTm, snaps[0].ExtraProps[createdProp])
+	})
+}
+
+func TestRunner_pullSnapshotShuttingDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	conf := Config{}
+	conf.ApplyDefaults()
+	runner := NewRunner(t.Context(), conf, slog.Default())
+	runner.AddListener(PullSnapshotErrorEvent, func(arguments ...interface{}) {
+		t.Errorf("unexpected pull error event: %v", arguments)
+	})
+
+	client := zfshttp.NewClient(server.URL, slog.Default())
+	pulled, err := runner.pullSnapshot(client, &zfs.Dataset{Name: "tank/fs"}, "fs", snapshotPull{
+		Snapshot: &zfs.Dataset{Name: "remote/fs@snap1"},
+	})
+	require.NoError(t, err, "a draining server delays the pull")
+	require.False(t, pulled)
+
+	err = runner.resumePullSnapshot(client, &zfs.Dataset{Name: "tank/fs"}, "token")
+	require.ErrorIs(t, err, zfshttp.ErrShuttingDown)
+}
+
+func Test_reconcilePullSnapshots(t *testing.T) {
+	remote := []zfs.Dataset{
+		{Name: "remote/test@snap1"},
+		{Name: "remote/test/child@snap1"},
+		{Name: "remote/test@snap2"},
+		{Name: "remote/test@snap3"},
+	}
+
+	toPull, err := reconcilePullSnapshots(nil, remote, "local/test", "test")
+	require.NoError(t, err)
+	require.Len(t, toPull, 3)
+	require.Equal(t, "remote/test@snap1", toPull[0].Snapshot.Name)
+	require.Empty(t, toPull[0].IncrementalBase)
+	require.Equal(t, "snap1", toPull[1].IncrementalBase)
+	require.Equal(t, "snap2", toPull[2].IncrementalBase)
+
+	toPull, err = reconcilePullSnapshots([]zfs.Dataset{
+		{Name: "local/test@snap1"},
+		{Name: "local/test@snap2"},
+	}, remote, "local/test", "test")
+	require.NoError(t, err)
+	require.Len(t, toPull, 1)
+	require.Equal(t, "remote/test@snap3", toPull[0].Snapshot.Name)
+	require.Equal(t, "snap2", toPull[0].IncrementalBase)
+
+	toPull, err = reconcilePullSnapshots(remote[2:], remote, "remote/test", "remote/test")
+	require.NoError(t, err)
+	require.Empty(t, toPull)
+
+	_, err = reconcilePullSnapshots([]zfs.Dataset{{Name: "local/test@other"}}, remote, "local/test", "test")
+	require.ErrorIs(t, err, ErrNoCommonSnapshots)
+}
@@ -138,14 +138,27 @@ func (r *Runner) sendDatasetSnapshots(ds *zfs.Dataset) error {
 	}
 
 	client := r.getServerClient(server)
-	remoteDataset := datasetName(ds.Name, true)
+	remoteDataset := r.remoteDatasetName(ds.Name)
 
 	// If we have a sending property, its worth checking whether we can resume a transfer
 	if propertyIsSet(ds.ExtraProps[sendingProp]) {
 		resumable, err := r.resumeSendSnapshot(client, ds, remoteDataset, ds.ExtraProps[sendingProp])
 		if err != nil {
-			// TODO:FIXME We should probably force a full re-send after throwing away the partial data on the remote server here
-			return err
+			if !r.config.SendAbortFailedResume || !resumeTokenError(err) {
+				// Keep the partial data for transient errors, the next run resumes again
+				return err
+			}
+			// The partial data on the remote server cannot be resumed, throw it away so the send below starts over
+			abortErr := r.abortResumableReceive(client, remoteDataset)
+			if abortErr != nil {
+				return fmt.Errorf("%w, aborting the resumable receive failed: %w", err, abortErr)
+			}
+			r.logger.Warn("zfs.job.Runner.sendDatasetSnapshots: Resume failed, aborted remote resumable receive",
+				"error", err,
+				"dataset", ds.Name,
+				"server", client.Server(),
+			)
+			resumable = false
 		}
 		if resumable {
 			// Clear remote cache, because we have resumed snapshots, its no longer correct
@@ -200,9 +213,28 @@ func (r *Runner) sendDatasetSnapshots(ds *zfs.Dataset) error {
 	return nil
 }
 
+func (r *Runner) abortResumableReceive(client *zfshttp.Client, remoteDataset string) error {
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+
+	abort := client.AbortResumableReceive
+	if r.config.DatasetType == zfs.DatasetVolume {
+		abort = client.VolumeAbortResumableReceive
+	}
+	err := abort(ctx, remoteDataset)
+	if errors.Is(err, zfshttp.ErrResumeNotPossible) {
+		return nil // Nothing left to abort
+	}
+	return err
+}
+
 func (r *Runner) resumeSendSnapshot(client *zfshttp.Client, ds *zfs.Dataset, remoteDataset, sendingSnapName string) (bool, error) {
 	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
-	resumeToken, curBytes, err := client.ResumableSendToken(ctx, remoteDataset)
+	resumableSendToken := client.ResumableSendToken
+	if r.config.DatasetType == zfs.DatasetVolume {
+		resumableSendToken = client.VolumeResumableSendToken
+	}
+	resumeToken, curBytes, err := resumableSendToken(ctx, remoteDataset)
 	cancel()
 	switch {
 	case isContextError(err):
@@ -244,11 +276,16 @@ func (r *Runner) resumeSendSnapshot(client *zfshttp.Client, ds *zfs.Dataset, rem
 
 	r.EmitEvent(ResumeSendingSnapshotEvent, fullSnapName, client.Server(), curBytes)
 
-	result, err := client.ResumeSend(ctx, datasetName(ds.Name, true), resumeToken, zfshttp.ResumeSendOptions{
+	result, err := client.ResumeSend(ctx, remoteDataset, resumeToken, zfshttp.ResumeSendOptions{
 		ResumeSendOptions: zfs.ResumeSendOptions{
-			BytesPerSecond:   r.config.SendSpeedBytesPerSecond,
-			CompressionLevel: r.config.SendCompressionLevel,
+			BandwidthSchedule: r.config.sendBandwidthSchedule(),
+			CompressionLevel:  r.config.SendCompressionLevel,
+			Compression:       zfs.CompressionOptions{Codec: r.config.SendCodec},
+			Framed:            r.config.SendFramed,
+			EncryptionKey:     r.config.SendEncryptionKey,
 		},
+		DatasetType:   r.config.DatasetType,
+		EstimateSize:  r.config.SendEstimateSize,
 		ProgressEvery: r.config.sendProgressInterval(),
 		ProgressFn: func(bytes int64) {
 			r.EmitEvent(SnapshotSendingProgressEvent, fullSnapName, client.Server(), int64(curBytes)+bytes)
@@ -257,8 +294,8 @@ func (r *Runner) resumeSendSnapshot(client *zfshttp.Client, ds *zfs.Dataset, rem
 	cancel()
 	result.BytesSent += int64(curBytes)
 	switch {
-	case errors.Is(err, zfshttp.ErrTooManyRequests):
-		r.logger.Info("zfs.job.Runner.resumeSendSnapshot: Too many receives, delaying",
+	case errors.Is(err, zfshttp.ErrTooManyRequests), errors.Is(err, zfshttp.ErrShuttingDown):
+		r.logger.Info("zfs.job.Runner.resumeSendSnapshot: Server not accepting receives, delaying",
 			"error", err,
 			"snapshot", ds.Name,
 			"server", client.Server(),
@@ -326,10 +363,10 @@ func (r *Runner) sendSnapshot(client *zfshttp.Client, send zfshttp.SnapshotSendO
 			"server", client.Server(),
 			"sendSnapshotName", send.SnapshotName,
 		)
-		r.clearRemoteDatasetCache(client.Server(), datasetName(send.Snapshot.Name, true))
+		r.clearRemoteDatasetCache(client.Server(), send.DatasetName)
 		return nil
-	case errors.Is(err, zfshttp.ErrTooManyRequests):
-		r.logger.Info("zfs.job.Runner.sendDatasetSnapshots: Too many receives, delaying",
+	case errors.Is(err, zfshttp.ErrTooManyRequests), errors.Is(err, zfshttp.ErrShuttingDown):
+		r.logger.Info("zfs.job.Runner.sendDatasetSnapshots: Server not accepting receives, delaying",
 			"error", err,
 			"snapshot", send.Snapshot.Name,
 			"server", client.Server(),
@@ -370,7 +407,11 @@ func (r *Runner) setSendSnapshotProperties(client *zfshttp.Client, snapName stri
 		Set: snapProps,
 	}
 
-	err = client.SetSnapshotProperties(r.ctx, datasetName(snapName, true), snapshotName(snapName), setProps)
+	setSnapshotProperties := client.SetSnapshotProperties
+	if r.config.DatasetType == zfs.DatasetVolume {
+		setSnapshotProperties = client.SetVolumeSnapshotProperties
+	}
+	err = setSnapshotProperties(r.ctx, r.remoteDatasetName(snapName), snapshotName(snapName), setProps)
 	if err != nil {
 		return fmt.Errorf("error setting snapshot properties for snapshot %s: %w", snapName, err)
 	}
@@ -382,7 +423,8 @@ func (r *Runner) reconcileSnapshots(local, remote []zfs.Dataset, server string)
 	var prevRemoteSnap *zfs.Dataset
 	for i := range local {
 		snap := &local[i]
-		remoteExists := snapshotsContain(remote, datasetName(snap.Name, true), snapshotName(snap.Name))
+		remoteDataset := listedDatasetName(remote, r.remoteDatasetName(snap.Name))
+		remoteExists := snapshotsContain(remote, remoteDataset, snapshotName(snap.Name))
 		if remoteExists {
 			prevRemoteSnap = snap
 			continue // No more to do
@@ -399,18 +441,23 @@ func (r *Runner) reconcileSnapshots(local, remote []zfs.Dataset, server string)
 		}
 
 		toSend = append(toSend, zfshttp.SnapshotSendOptions{
-			DatasetName:  datasetName(snap.Name, true),
+			DatasetName:  r.remoteDatasetName(snap.Name),
+			DatasetType:  r.config.DatasetType,
 			SnapshotName: snapshotName(snap.Name),
 			Snapshot:     snap,
 			SendOptions: zfs.SendOptions{
 				CompressionLevel:  r.config.SendCompressionLevel,
-				BytesPerSecond:    r.config.SendSpeedBytesPerSecond,
+				Compression:       zfs.CompressionOptions{Codec: r.config.SendCodec},
+				BandwidthSchedule: r.config.sendBandwidthSchedule(),
 				Raw:               r.config.SendRaw,
 				IncludeProperties: r.config.SendIncludeProperties,
 				IncrementalBase:   prevRemoteSnap,
+				Framed:            r.config.SendFramed,
+				EncryptionKey:     r.config.SendEncryptionKey,
 			},
 			Resumable:            r.config.SendResumable,
 			ReceiveForceRollback: r.config.SendReceiveForceRollback,
+			EstimateSize:         r.config.SendEstimateSize,
 			Properties:           dsProps,
 			ProgressEvery:        r.config.sendProgressInterval(),
 			ProgressFn: func(bytes int64) {
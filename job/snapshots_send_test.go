@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"sync"
 	"testing"
 	"time"
@@ -346,6 +350,66 @@ func TestRunner_sendResumeSnapshot(t *testing.T) {
 	})
 }
 
+func TestRunner_sendResumeSnapshotKeepsStateOnTransientError(t *testing.T) {
+	sendTest(t, func(serverURL string, runner *Runner) {
+		snap, err := zfs.GetDataset(t.Context(), testFilesystem+"@"+sendSnaps[0])
+		require.NoError(t, err)
+
+		pipeRdr, pipeWrtr := io.Pipe()
+		go func() {
+			err := snap.SendSnapshot(t.Context(), pipeWrtr, zfs.SendOptions{})
+			require.NoError(t, err)
+			require.NoError(t, pipeWrtr.Close())
+		}()
+
+		remoteName := testHTTPZPool + "/" + datasetName(snap.Name, true)
+		_, err = zfs.ReceiveSnapshot(
+			t.Context(),
+			io.LimitReader(pipeRdr, 10*1024),
+			testHTTPZPool+"/"+datasetName(snap.Name, false),
+			zfs.ReceiveOptions{
+				Resumable:  true,
+				Properties: map[string]string{zfs.PropertyCanMount: zfs.ValueOff},
+			},
+		)
+		var zfsErr *zfs.ResumableStreamError
+		require.True(t, errors.As(err, &zfsErr))
+		require.NotEmpty(t, zfsErr.ResumeToken(), zfsErr)
+
+		// Pass everything through to the server, except the resume itself which loses its connection
+		upstream, err := url.Parse(serverURL)
+		require.NoError(t, err)
+		upstream.Path = ""
+		proxy := httputil.NewSingleHostReverseProxy(upstream)
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPut {
+				conn, _, err := http.NewResponseController(w).Hijack()
+				require.NoError(t, err)
+				_ = conn.Close()
+				return
+			}
+			proxy.ServeHTTP(w, req)
+		}))
+		defer flaky.Close()
+
+		ds, err := zfs.GetDataset(t.Context(), testFilesystem)
+		require.NoError(t, err)
+		require.NoError(t, ds.SetProperty(t.Context(), runner.config.Properties.snapshotSendTo(), flaky.URL+testPrefix))
+		require.NoError(t, ds.SetProperty(t.Context(), runner.config.Properties.snapshotSending(), sendSnaps[0]))
+
+		runner.config.SendAbortFailedResume = true
+		err = runner.sendDatasetSnapshotsByName(1, testFilesystem)
+		require.Error(t, err)
+		require.False(t, resumeTokenError(err))
+
+		remote, err := zfs.GetDataset(t.Context(), remoteName, zfs.PropertyReceiveResumeToken)
+		require.NoError(t, err)
+		require.Equal(t, zfsErr.ResumeToken(), remote.ExtraProps[zfs.PropertyReceiveResumeToken],
+			"a transient error does not abort the resumable receive",
+		)
+	})
+}
+
 func TestRunner_sendWithMissingSnapshots(t *testing.T) {
 	sendTest(t, func(url string, runner *Runner) {
 		ds, err := zfs.GetDataset(t.Context(), testFilesystem+"@"+sendSnaps[2])
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	zfs "github.com/vansante/go-zfsutils"
+	zfshttp "github.com/vansante/go-zfsutils/http"
 )
 
 // propertyIsSet returns whether a property is set
@@ -29,6 +30,12 @@ func isContextError(err error) bool {
 	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
 }
 
+// resumeTokenError returns whether the error means the resume token is stale or does not match the partial state,
+// so resuming can never succeed
+func resumeTokenError(err error) bool {
+	return errors.Is(err, zfshttp.ErrResumeNotPossible) || errors.Is(err, zfshttp.ErrInvalidResumeToken)
+}
+
 func parseDatasetTimeProperty(ds *zfs.Dataset, prop string) (time.Time, error) {
 	return time.Parse(dateTimeFormat, ds.ExtraProps[prop])
 }
@@ -80,9 +87,43 @@ func filterSnapshotsWithProp(list []zfs.Dataset, prop string) []zfs.Dataset {
 	return nwList
 }
 
+// relativeDatasetName returns the dataset path of name relative to the parent, without snapshot.
+// Names outside the parent are reduced to their last component.
+func relativeDatasetName(parent, name string) string {
+	name = stripDatasetSnapshot(name)
+	parent = strings.TrimRight(parent, "/")
+	if parent == "" {
+		return name
+	}
+	relative, ok := strings.CutPrefix(name, parent+"/")
+	if !ok {
+		return datasetName(name, true)
+	}
+	return relative
+}
+
+// listedDatasetName returns the full name of the dataset in a list of its snapshots. A remote server lists the
+// dataset under its own parent dataset, which is the listed dataset that equals the dataset or ends in its path.
+// Snapshots of child datasets follow the name of the dataset, so the shortest match is the dataset itself.
+func listedDatasetName(list []zfs.Dataset, dataset string) string {
+	name := ""
+	for _, ds := range list {
+		listed := stripDatasetSnapshot(ds.Name)
+		if listed != dataset && !strings.HasSuffix(listed, "/"+dataset) {
+			continue
+		}
+		if name == "" || len(listed) < len(name) {
+			name = listed
+		}
+	}
+	return name
+}
+
+// snapshotsContain returns whether the list contains the snapshot of the dataset with exactly this name
 func snapshotsContain(list []zfs.Dataset, dataset, snapshot string) bool {
+	name := fmt.Sprintf("%s@%s", dataset, snapshot)
 	for _, ds := range list {
-		if datasetName(ds.Name, false) == fmt.Sprintf("%s@%s", dataset, snapshot) {
+		if ds.Name == name {
 			return true
 		}
 	}
@@ -1,8 +1,15 @@
 package job
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
 	"time"
+
+	zfs "github.com/vansante/go-zfsutils"
+	zfshttp "github.com/vansante/go-zfsutils/http"
 )
 
 func Test_datasetName(t *testing.T) {
@@ -70,6 +77,100 @@ func Test_snapshotName(t *testing.T) {
 	}
 }
 
+func Test_relativeDatasetName(t *testing.T) {
+	tests := []struct {
+		parent string
+		name   string
+		want   string
+	}{
+		{"tank", "tank/customers/acme/db@snap", "customers/acme/db"},
+		{"tank/", "tank/customers/acme/db", "customers/acme/db"},
+		{"", "tank/db", "tank/db"},
+		{"tank", "other/db@snap", "db"},
+		{"tank", "tankers/db", "db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relativeDatasetName(tt.parent, tt.name); got != tt.want {
+				t.Errorf("relativeDatasetName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listedDatasetName(t *testing.T) {
+	list := []zfs.Dataset{
+		{Name: "backup/customers/acme/db@snap1"},
+		{Name: "backup/customers/acme/db/db@snap1"},
+		{Name: "backup/db@snap2"},
+	}
+	tests := []struct {
+		dataset string
+		want    string
+	}{
+		{"customers/acme/db", "backup/customers/acme/db"},
+		{"acme/db", "backup/customers/acme/db"},
+		{"db", "backup/db"},
+		{"b", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dataset, func(t *testing.T) {
+			if got := listedDatasetName(list, tt.dataset); got != tt.want {
+				t.Errorf("listedDatasetName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_snapshotsContain(t *testing.T) {
+	list := []zfs.Dataset{
+		{Name: "backup/customers/acme/db@snap1"},
+		{Name: "backup/db@snap2"},
+	}
+	tests := []struct {
+		dataset  string
+		snapshot string
+		want     bool
+	}{
+		{"backup/customers/acme/db", "snap1", true},
+		{"backup/db", "snap2", true},
+		{"backup/db", "snap1", false},
+		{"customers/acme/db", "snap1", false},
+		{"db", "snap2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dataset+"@"+tt.snapshot, func(t *testing.T) {
+			if got := snapshotsContain(list, tt.dataset, tt.snapshot); got != tt.want {
+				t.Errorf("snapshotsContain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resumeTokenError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("error resuming send: %w", zfshttp.ErrResumeNotPossible), true},
+		{fmt.Errorf("error resuming send: %w", zfshttp.ErrInvalidResumeToken), true},
+		{io.ErrUnexpectedEOF, false},
+		{context.DeadlineExceeded, false},
+		{zfshttp.ErrUnauthorized, false},
+		{zfshttp.ErrForbidden, false},
+		{zfshttp.ErrQuotaExceeded, false},
+		{zfshttp.ErrInsufficientSpace, false},
+		{errors.New("connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := resumeTokenError(tt.err); got != tt.want {
+				t.Errorf("resumeTokenError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_randomizeDuration(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		dur := randomizeDuration(5 * time.Minute)
@@ -0,0 +1,82 @@
+package zfs
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Pacer limits the rate of a transfer to a rate that may change while it runs. The rate is asked for after every
+// read or write, so a change applies right away.
+type Pacer struct {
+	ctx  context.Context
+	rate func() float64
+	next time.Time
+}
+
+// NewPacer creates a pacer that follows the rate function, in bytes per second. A rate of zero or less is
+// unlimited. Waiting ends with the error of the context once it is done.
+func NewPacer(ctx context.Context, rate func() float64) *Pacer {
+	return &Pacer{ctx: ctx, rate: rate}
+}
+
+// Wait blocks until the transfer may continue after transferring n bytes
+func (p *Pacer) Wait(n int) error {
+	rate := p.rate()
+	now := time.Now()
+	if rate <= 0 || n <= 0 {
+		p.next = now
+		return nil
+	}
+	if p.next.Before(now) {
+		// Time spent idle does not build up credit
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+
+	timer := time.NewTimer(p.next.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Writer returns a writer that waits after every write to w
+func (p *Pacer) Writer(w io.Writer) io.Writer {
+	return &pacedWriter{w: w, pacer: p}
+}
+
+// Reader returns a reader that waits after every read from r
+func (p *Pacer) Reader(r io.Reader) io.Reader {
+	return &pacedReader{r: r, pacer: p}
+}
+
+type pacedWriter struct {
+	w     io.Writer
+	pacer *Pacer
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.pacer.Wait(n)
+}
+
+type pacedReader struct {
+	r     io.Reader
+	pacer *Pacer
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	waitErr := r.pacer.Wait(n)
+	if err == nil {
+		err = waitErr
+	}
+	return n, err
+}
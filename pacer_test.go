@@ -0,0 +1,39 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacer(t *testing.T) {
+	var rate atomic.Int64
+	rate.Store(100 * 1024)
+	pacer := NewPacer(context.Background(), func() float64 { return float64(rate.Load()) })
+
+	start := time.Now()
+	var buf bytes.Buffer
+	_, err := io.Copy(pacer.Writer(&buf), strings.NewReader(strings.Repeat("a", 50*1024)))
+	require.NoError(t, err)
+	require.Equal(t, 50*1024, buf.Len())
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	// A change of the rate applies right away
+	rate.Store(0)
+	start = time.Now()
+	n, err := io.Copy(io.Discard, pacer.Reader(strings.NewReader(strings.Repeat("a", 10*1024*1024))))
+	require.NoError(t, err)
+	require.EqualValues(t, 10*1024*1024, n)
+	require.Less(t, time.Since(start), 450*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewPacer(ctx, func() float64 { return 1 }).Writer(io.Discard).Write([]byte("hello"))
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -27,6 +27,7 @@ const (
 	PropertyEncryption         = "encryption"
 	PropertyEncryptionRoot     = "encryptionroot"
 	PropertyFilesystemCount    = "filesystem_count"
+	PropertyGUID               = "guid"
 	PropertyKeyFormat          = "keyformat"
 	PropertyKeyStatus          = "keystatus"
 	PropertyKeyLocation        = "keylocation"
@@ -44,6 +45,7 @@ const (
 	PropertyUsed               = "used"
 	PropertyUsedByDataset      = "usedbydataset"
 	PropertyVolSize            = "volsize"
+	PropertyVolBlockSize       = "volblocksize"
 	PropertyWritten            = "written"
 )
 
@@ -0,0 +1,279 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidBandwidthSchedule = errors.New("invalid bandwidth schedule")
+
+const minutesPerDay = 24 * 60
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var scheduleUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"gb", 1024 * 1024 * 1024},
+	{"mb", 1024 * 1024},
+	{"kb", 1024},
+	{"b", 1},
+}
+
+// BandwidthWindow is a time of day window of a bandwidth schedule
+type BandwidthWindow struct {
+	// Start and End are the minutes since midnight the window starts and ends, a window with its end before its
+	// start runs past midnight
+	Start, End int
+	// Weekdays are the days the window starts on, all days when empty
+	Weekdays []time.Weekday
+	// BytesPerSecond is the rate during the window, zero is unlimited
+	BytesPerSecond int64
+}
+
+// BandwidthSchedule limits the bandwidth by the time of day, like "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited".
+// A schedule is written as comma separated windows of a time range, optional weekdays and a rate. The first window
+// that contains the time applies, the rate after "otherwise" applies outside all windows. Rates are unlimited or
+// a size in B, KB, MB or GB per second. Times are in the local time zone.
+type BandwidthSchedule struct {
+	Windows []BandwidthWindow
+	// Default is the rate outside the windows, zero is unlimited
+	Default int64
+}
+
+// IsZero returns whether the schedule is empty, which never limits the bandwidth
+func (s BandwidthSchedule) IsZero() bool {
+	return len(s.Windows) == 0 && s.Default == 0
+}
+
+// BytesPerSecond returns the rate of the schedule at the time, zero is unlimited
+func (s BandwidthSchedule) BytesPerSecond(t time.Time) int64 {
+	for _, window := range s.Windows {
+		if window.contains(t) {
+			return window.BytesPerSecond
+		}
+	}
+	return s.Default
+}
+
+func (w BandwidthWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case w.Start <= w.End:
+		if minute < w.Start || minute >= w.End {
+			return false
+		}
+	case minute >= w.Start:
+		// Before midnight of a window that runs past midnight
+	case minute < w.End:
+		// After midnight, the window started the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, weekday := range w.Weekdays {
+		if weekday == day {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseBandwidthSchedule parses a schedule like "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited"
+func ParseBandwidthSchedule(str string) (BandwidthSchedule, error) {
+	var schedule BandwidthSchedule
+	for _, entry := range strings.Split(str, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "otherwise") {
+			if len(fields) != 2 {
+				return BandwidthSchedule{}, fmt.Errorf("%w: %q", ErrInvalidBandwidthSchedule, entry)
+			}
+			rate, err := parseScheduleRate(fields[1])
+			if err != nil {
+				return BandwidthSchedule{}, err
+			}
+			schedule.Default = rate
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			return BandwidthSchedule{}, fmt.Errorf("%w: %q", ErrInvalidBandwidthSchedule, entry)
+		}
+		var window BandwidthWindow
+		var err error
+		window.Start, window.End, err = parseScheduleTimes(fields[0])
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+		if len(fields) == 3 {
+			window.Weekdays, err = parseScheduleWeekdays(fields[1])
+			if err != nil {
+				return BandwidthSchedule{}, err
+			}
+		}
+		window.BytesPerSecond, err = parseScheduleRate(fields[len(fields)-1])
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	return schedule, nil
+}
+
+func parseScheduleTimes(str string) (start, end int, err error) {
+	startStr, endStr, ok := strings.Cut(str, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: time range %q", ErrInvalidBandwidthSchedule, str)
+	}
+	start, err = parseScheduleTime(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = parseScheduleTime(endStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("%w: empty time range %q", ErrInvalidBandwidthSchedule, str)
+	}
+	return start, end, nil
+}
+
+func parseScheduleTime(str string) (int, error) {
+	hourStr, minuteStr, ok := strings.Cut(str, ":")
+	hour, hourErr := strconv.Atoi(hourStr)
+	minute, minuteErr := strconv.Atoi(minuteStr)
+	if !ok || hourErr != nil || minuteErr != nil || hour < 0 || minute < 0 || minute > 59 ||
+		hour*60+minute > minutesPerDay {
+		return 0, fmt.Errorf("%w: time %q", ErrInvalidBandwidthSchedule, str)
+	}
+	return hour*60 + minute, nil
+}
+
+func parseScheduleWeekdays(str string) ([]time.Weekday, error) {
+	firstStr, lastStr, isRange := strings.Cut(str, "-")
+	first, ok := scheduleWeekdays[strings.ToLower(firstStr)]
+	if !ok {
+		return nil, fmt.Errorf("%w: weekday %q", ErrInvalidBandwidthSchedule, firstStr)
+	}
+	if !isRange {
+		return []time.Weekday{first}, nil
+	}
+	last, ok := scheduleWeekdays[strings.ToLower(lastStr)]
+	if !ok {
+		return nil, fmt.Errorf("%w: weekday %q", ErrInvalidBandwidthSchedule, lastStr)
+	}
+
+	weekdays := []time.Weekday{first}
+	for day := first; day != last; {
+		day = (day + 1) % 7
+		weekdays = append(weekdays, day)
+	}
+	return weekdays, nil
+}
+
+func parseScheduleRate(str string) (int64, error) {
+	str = strings.ToLower(str)
+	if str == "unlimited" {
+		return 0, nil
+	}
+	str = strings.TrimSuffix(str, "/s")
+	for _, unit := range scheduleUnits {
+		numStr, ok := strings.CutSuffix(str, unit.suffix)
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseFloat(numStr, 64)
+		if err != nil || num <= 0 {
+			break
+		}
+		return int64(num * float64(unit.size)), nil
+	}
+	return 0, fmt.Errorf("%w: rate %q", ErrInvalidBandwidthSchedule, str)
+}
+
+// String formats the schedule in the format ParseBandwidthSchedule reads
+func (s BandwidthSchedule) String() string {
+	entries := make([]string, 0, len(s.Windows)+1)
+	for _, window := range s.Windows {
+		entry := fmt.Sprintf("%02d:%02d-%02d:%02d", window.Start/60, window.Start%60, window.End/60, window.End%60)
+		if len(window.Weekdays) > 0 {
+			entry += " " + formatScheduleWeekday(window.Weekdays[0])
+			if len(window.Weekdays) > 1 {
+				entry += "-" + formatScheduleWeekday(window.Weekdays[len(window.Weekdays)-1])
+			}
+		}
+		entries = append(entries, entry+" "+formatScheduleRate(window.BytesPerSecond))
+	}
+	if s.Default != 0 || len(s.Windows) > 0 {
+		entries = append(entries, "otherwise "+formatScheduleRate(s.Default))
+	}
+	return strings.Join(entries, ", ")
+}
+
+func formatScheduleWeekday(day time.Weekday) string {
+	return day.String()[:3]
+}
+
+func formatScheduleRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	for _, unit := range scheduleUnits {
+		if bytesPerSecond%unit.size == 0 {
+			return fmt.Sprintf("%d%s/s", bytesPerSecond/unit.size, strings.ToUpper(unit.suffix))
+		}
+	}
+	return fmt.Sprintf("%dB/s", bytesPerSecond)
+}
+
+// MarshalText encodes the schedule in the format ParseBandwidthSchedule reads
+func (s BandwidthSchedule) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a schedule with ParseBandwidthSchedule
+func (s *BandwidthSchedule) UnmarshalText(text []byte) error {
+	schedule, err := ParseBandwidthSchedule(string(text))
+	if err != nil {
+		return err
+	}
+	*s = schedule
+	return nil
+}
+
+// NewScheduleWriter creates a writer limited to the rate of the schedule at the time of each write, so a transfer
+// slows down or speeds up as soon as it crosses a boundary of the schedule
+func NewScheduleWriter(ctx context.Context, w io.Writer, schedule BandwidthSchedule) io.Writer {
+	return NewPacer(ctx, schedule.rate).Writer(w)
+}
+
+// NewScheduleReader creates a reader limited to the rate of the schedule at the time of each read
+func NewScheduleReader(ctx context.Context, r io.Reader, schedule BandwidthSchedule) io.Reader {
+	return NewPacer(ctx, schedule.rate).Reader(r)
+}
+
+func (s BandwidthSchedule) rate() float64 {
+	return float64(s.BytesPerSecond(time.Now()))
+}
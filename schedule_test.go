@@ -0,0 +1,89 @@
+package zfs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("08:00-18:00 Mon-Fri 10MB/s, 22:00-06:00 512KB/s, otherwise unlimited")
+	require.NoError(t, err)
+	require.Equal(t, BandwidthSchedule{
+		Windows: []BandwidthWindow{
+			{
+				Start:          8 * 60,
+				End:            18 * 60,
+				Weekdays:       []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				BytesPerSecond: 10 * 1024 * 1024,
+			},
+			{Start: 22 * 60, End: 6 * 60, BytesPerSecond: 512 * 1024},
+		},
+	}, schedule)
+	require.Equal(t, "08:00-18:00 Mon-Fri 10MB/s, 22:00-06:00 512KB/s, otherwise unlimited", schedule.String())
+
+	schedule, err = ParseBandwidthSchedule("otherwise 1.5mb")
+	require.NoError(t, err)
+	require.Equal(t, BandwidthSchedule{Default: 1536 * 1024}, schedule)
+
+	schedule, err = ParseBandwidthSchedule("")
+	require.NoError(t, err)
+	require.True(t, schedule.IsZero())
+
+	weekend, err := ParseBandwidthSchedule("00:00-24:00 Sat-Sun 1GB/s")
+	require.NoError(t, err)
+	require.Equal(t, []time.Weekday{time.Saturday, time.Sunday}, weekend.Windows[0].Weekdays)
+
+	for _, invalid := range []string{
+		"08:00 10MB/s",
+		"08:00-08:00 10MB/s",
+		"08:00-25:00 10MB/s",
+		"08:00-18:00 Someday 10MB/s",
+		"08:00-18:00 10XB/s",
+		"08:00-18:00 -1MB/s",
+		"otherwise",
+		"08:00-18:00 Mon-Fri 10MB/s extra",
+	} {
+		_, err = ParseBandwidthSchedule(invalid)
+		require.ErrorIs(t, err, ErrInvalidBandwidthSchedule, invalid)
+	}
+}
+
+func TestBandwidthSchedule_BytesPerSecond(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("08:00-18:00 Mon-Fri 10MB/s, 22:00-06:00 Fri 1MB/s, otherwise 100MB/s")
+	require.NoError(t, err)
+
+	at := func(day, clock string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", day+" "+clock, time.Local)
+		require.NoError(t, err)
+		return tm
+	}
+	const monday, friday, saturday = "2024-01-01", "2024-01-05", "2024-01-06"
+
+	require.EqualValues(t, 10*1024*1024, schedule.BytesPerSecond(at(monday, "08:00")))
+	require.EqualValues(t, 10*1024*1024, schedule.BytesPerSecond(at(monday, "17:59")))
+	require.EqualValues(t, 100*1024*1024, schedule.BytesPerSecond(at(monday, "18:00")))
+	require.EqualValues(t, 100*1024*1024, schedule.BytesPerSecond(at(saturday, "12:00")))
+
+	// The night window starts on friday and runs into saturday
+	require.EqualValues(t, 100*1024*1024, schedule.BytesPerSecond(at(monday, "23:00")))
+	require.EqualValues(t, 1024*1024, schedule.BytesPerSecond(at(friday, "23:00")))
+	require.EqualValues(t, 1024*1024, schedule.BytesPerSecond(at(saturday, "05:59")))
+	require.EqualValues(t, 100*1024*1024, schedule.BytesPerSecond(at(saturday, "06:00")))
+}
+
+func TestBandwidthSchedule_Text(t *testing.T) {
+	var conf struct {
+		Schedule BandwidthSchedule `json:"Schedule"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"Schedule": "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited"}`), &conf))
+	require.EqualValues(t, 10*1024*1024, conf.Schedule.Windows[0].BytesPerSecond)
+
+	data, err := json.Marshal(&conf)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Schedule": "08:00-18:00 Mon-Fri 10MB/s, otherwise unlimited"}`, string(data))
+
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"Schedule": "always"}`), &conf), ErrInvalidBandwidthSchedule)
+}
@@ -0,0 +1,324 @@
+// Package sendstream decodes the headers of ZFS send streams without invoking the zfs binary.
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// RecordSize is the size of a single dmu_replay_record in a send stream
+	RecordSize = 312
+
+	// BackupMagic is the magic number found in every DRR_BEGIN record
+	BackupMagic uint64 = 0x2F5bacbac
+
+	// MaximumPayloadSize is the largest DRR_BEGIN payload that will be decoded. The payload is held in memory
+	// until the receive starts, so it is kept small enough for many concurrent receives.
+	MaximumPayloadSize = 4 * 1024 * 1024
+
+	maxNameLength = 256
+)
+
+var (
+	// ErrInvalidStream is returned when the data does not start with a valid send stream header
+	ErrInvalidStream = errors.New("invalid send stream")
+
+	// ErrPayloadTooLarge is returned when a begin record announces a payload larger than MaximumPayloadSize
+	ErrPayloadTooLarge = errors.New("send stream payload too large")
+)
+
+// RecordType is the type of record in a send stream
+type RecordType uint32
+
+// The record types as defined by OpenZFS in zfs_ioctl.h
+const (
+	RecordBegin RecordType = iota
+	RecordObject
+	RecordFreeObjects
+	RecordWrite
+	RecordFree
+	RecordEnd
+	RecordWriteByRef
+	RecordSpill
+	RecordWriteEmbedded
+	RecordObjectRange
+	RecordRedact
+)
+
+// HeaderType tells whether a begin record starts a single substream or a compound (replication) stream
+type HeaderType uint32
+
+const (
+	HeaderTypeSubstream      HeaderType = 1
+	HeaderTypeCompoundStream HeaderType = 2
+)
+
+// Features is the set of backup feature flags stored in the begin record
+type Features uint32
+
+// The backup feature flags as defined by OpenZFS in zfs_ioctl.h
+const (
+	FeatureDedup            Features = 1 << 0
+	FeatureDedupProps       Features = 1 << 1
+	FeatureSASpill          Features = 1 << 2
+	FeatureEmbedData        Features = 1 << 16
+	FeatureLZ4              Features = 1 << 17
+	FeatureLargeBlocks      Features = 1 << 19
+	FeatureResuming         Features = 1 << 20
+	FeatureRedacted         Features = 1 << 21
+	FeatureCompressed       Features = 1 << 22
+	FeatureLargeDnode       Features = 1 << 23
+	FeatureRaw              Features = 1 << 24
+	FeatureZSTD             Features = 1 << 25
+	FeatureHolds            Features = 1 << 26
+	FeatureLargeMicroZAP    Features = 1 << 27
+	FeatureSwitchLargeBlock Features = 1 << 28
+)
+
+// Has returns whether all the given features are set
+func (f Features) Has(features Features) bool {
+	return f&features == features
+}
+
+// Flags are the DRR_FLAG_* flags stored in the begin record
+type Flags uint32
+
+const (
+	FlagClone       Flags = 1 << 0
+	FlagCIData      Flags = 1 << 1
+	FlagFreeRecords Flags = 1 << 2
+	FlagSpillBlock  Flags = 1 << 3
+)
+
+// ObjsetType is the type of objset that is contained in the stream
+type ObjsetType uint32
+
+const (
+	ObjsetNone       ObjsetType = 0
+	ObjsetMeta       ObjsetType = 1
+	ObjsetFilesystem ObjsetType = 2
+	ObjsetVolume     ObjsetType = 3
+)
+
+// Payload keys found in begin records
+const (
+	PayloadResumeObject = "resume_object"
+	PayloadResumeOffset = "resume_offset"
+	PayloadCryptKeyData = "crypt_keydata"
+	PayloadFromSnapshot = "fromsnap"
+	PayloadToSnapshot   = "tosnap"
+	PayloadFilesystems  = "fss"
+)
+
+// Header is a decoded DRR_BEGIN record, including its optional payload
+type Header struct {
+	ByteOrder    binary.ByteOrder `json:"-"`
+	HeaderType   HeaderType       `json:"HeaderType"`
+	Features     Features         `json:"Features"`
+	CreationTime time.Time        `json:"CreationTime"`
+	ObjsetType   ObjsetType       `json:"ObjsetType"`
+	Flags        Flags            `json:"Flags"`
+	ToGUID       uint64           `json:"ToGUID"`
+	FromGUID     uint64           `json:"FromGUID"`
+	ToName       string           `json:"ToName"`
+	Payload      NVList           `json:"Payload,omitempty"`
+
+	// Substream is the begin record of the first substream, only set for compound streams
+	Substream *Header `json:"Substream,omitempty"`
+}
+
+// Compound returns whether this is a replication stream consisting of multiple substreams
+func (h *Header) Compound() bool {
+	return h.HeaderType == HeaderTypeCompoundStream
+}
+
+// Incremental returns whether the stream is incremental on top of another snapshot
+func (h *Header) Incremental() bool {
+	if h.Compound() {
+		_, ok := h.Payload[PayloadFromSnapshot]
+		return ok
+	}
+	return h.FromGUID != 0
+}
+
+// Raw returns whether the stream is a raw send
+func (h *Header) Raw() bool {
+	if h.Compound() && h.Substream != nil {
+		return h.Substream.Raw()
+	}
+	return h.Features.Has(FeatureRaw)
+}
+
+// Encrypted returns whether the stream contains an encrypted dataset
+func (h *Header) Encrypted() bool {
+	if h.Compound() && h.Substream != nil {
+		return h.Substream.Encrypted()
+	}
+	_, ok := h.Payload[PayloadCryptKeyData]
+	return h.Raw() && ok
+}
+
+// Resuming returns whether the stream resumes a previously interrupted stream
+func (h *Header) Resuming() bool {
+	return h.Features.Has(FeatureResuming)
+}
+
+// ResumeObject returns the object the resumed stream starts at
+func (h *Header) ResumeObject() uint64 {
+	v, _ := h.Payload[PayloadResumeObject].(uint64)
+	return v
+}
+
+// ResumeOffset returns the offset within the object the resumed stream starts at
+func (h *Header) ResumeOffset() uint64 {
+	v, _ := h.Payload[PayloadResumeOffset].(uint64)
+	return v
+}
+
+// Inspect decodes the stream header from the reader. The returned reader replays the consumed
+// bytes followed by the remainder of the input, so it can be handed to zfs receive as is.
+func Inspect(r io.Reader) (*Header, io.Reader, error) {
+	rec := &recordingReader{r: r}
+	hdr, err := ReadHeader(rec)
+	return hdr, rec.replay(), err
+}
+
+// recordingReader keeps the bytes read through it to replay them. It keeps the buffers it was read into instead
+// of copying them, the header is read into buffers that are not reused.
+type recordingReader struct {
+	r      io.Reader
+	chunks [][]byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.chunks = append(r.chunks, p[:n])
+	}
+	return n, err
+}
+
+// replay returns a reader of the bytes read so far, followed by the rest of the input
+func (r *recordingReader) replay() io.Reader {
+	readers := make([]io.Reader, 0, len(r.chunks)+1)
+	for _, chunk := range r.chunks {
+		readers = append(readers, bytes.NewReader(chunk))
+	}
+	return io.MultiReader(append(readers, r.r)...)
+}
+
+// ReadHeader reads and decodes the stream header from the reader.
+// For compound streams, it also reads the begin record of the first substream.
+func ReadHeader(r io.Reader) (*Header, error) {
+	hdr, err := readBegin(r)
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, fmt.Errorf("%w: empty stream", ErrInvalidStream)
+	case err != nil:
+		return nil, err
+	}
+	if !hdr.Compound() {
+		return hdr, nil
+	}
+
+	// A compound stream is followed by an end record, after which the substreams begin
+	typ, _, err := readRecord(r, hdr.ByteOrder)
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, fmt.Errorf("%w: missing end record after compound header", ErrInvalidStream)
+	case err != nil:
+		return nil, err
+	case typ != RecordEnd:
+		return nil, fmt.Errorf("%w: expected end record after compound header, got type %d", ErrInvalidStream, typ)
+	}
+
+	hdr.Substream, err = readBegin(r)
+	if errors.Is(err, io.EOF) {
+		return hdr, nil // A replication stream without any substreams
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading substream header: %w", err)
+	}
+	return hdr, nil
+}
+
+func readRecord(r io.Reader, order binary.ByteOrder) (RecordType, []byte, error) {
+	record := make([]byte, RecordSize)
+	n, err := io.ReadFull(r, record)
+	switch {
+	case errors.Is(err, io.EOF):
+		return 0, nil, io.EOF
+	case err != nil:
+		return 0, nil, fmt.Errorf("%w: read %d of %d record bytes: %w", ErrInvalidStream, n, RecordSize, err)
+	}
+	return RecordType(order.Uint32(record[0:4])), record, nil
+}
+
+func readBegin(r io.Reader) (*Header, error) {
+	// The type of a begin record is zero, so its byte order does not matter yet
+	typ, record, err := readRecord(r, binary.LittleEndian)
+	switch {
+	case err != nil:
+		return nil, err
+	case typ != RecordBegin:
+		return nil, fmt.Errorf("%w: expected begin record, got type %d", ErrInvalidStream, typ)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint64(record[8:16]) == BackupMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint64(record[8:16]) == BackupMagic:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: bad magic %x", ErrInvalidStream, record[8:16])
+	}
+
+	versionInfo := order.Uint64(record[16:24])
+	hdr := &Header{
+		ByteOrder:    order,
+		HeaderType:   HeaderType(versionInfo & 0x3),
+		Features:     Features((versionInfo >> 2) & (1<<30 - 1)),
+		CreationTime: time.Unix(int64(order.Uint64(record[24:32])), 0),
+		ObjsetType:   ObjsetType(order.Uint32(record[32:36])),
+		Flags:        Flags(order.Uint32(record[36:40])),
+		ToGUID:       order.Uint64(record[40:48]),
+		FromGUID:     order.Uint64(record[48:56]),
+		ToName:       cString(record[56 : 56+maxNameLength]),
+	}
+	if hdr.HeaderType != HeaderTypeSubstream && hdr.HeaderType != HeaderTypeCompoundStream {
+		return nil, fmt.Errorf("%w: unknown header type %d", ErrInvalidStream, hdr.HeaderType)
+	}
+
+	payloadLen := order.Uint32(record[4:8])
+	if payloadLen == 0 {
+		return hdr, nil
+	}
+	if payloadLen > MaximumPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, payloadLen)
+	}
+
+	payload := make([]byte, payloadLen)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading %d payload bytes: %w", ErrInvalidStream, payloadLen, err)
+	}
+	hdr.Payload, err = UnpackNVList(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %w", ErrInvalidStream, err)
+	}
+	return hdr, nil
+}
+
+func cString(b []byte) string {
+	idx := bytes.IndexByte(b, 0)
+	if idx >= 0 {
+		b = b[:idx]
+	}
+	return string(b)
+}
@@ -0,0 +1,243 @@
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPair struct {
+	name  string
+	value any // uint64, string or []testPair
+}
+
+func beginRecord(order binary.ByteOrder, hdrType HeaderType, features Features, fromGUID, toGUID uint64, toName string, payload []byte) []byte {
+	rec := make([]byte, RecordSize)
+	order.PutUint32(rec[0:4], uint32(RecordBegin))
+	order.PutUint32(rec[4:8], uint32(len(payload)))
+	order.PutUint64(rec[8:16], BackupMagic)
+	order.PutUint64(rec[16:24], uint64(features)<<2|uint64(hdrType))
+	order.PutUint64(rec[24:32], 1700000000)
+	order.PutUint32(rec[32:36], uint32(ObjsetFilesystem))
+	order.PutUint32(rec[36:40], uint32(FlagFreeRecords))
+	order.PutUint64(rec[40:48], toGUID)
+	order.PutUint64(rec[48:56], fromGUID)
+	copy(rec[56:], toName)
+	return append(rec, payload...)
+}
+
+func endRecord(order binary.ByteOrder) []byte {
+	rec := make([]byte, RecordSize)
+	order.PutUint32(rec[0:4], uint32(RecordEnd))
+	return rec
+}
+
+func packXDR(pairs []testPair) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{encodingXDR, 0, 0, 0})
+	writeXDRList(buf, pairs)
+	return buf.Bytes()
+}
+
+func writeXDRList(buf *bytes.Buffer, pairs []testPair) {
+	be := binary.BigEndian
+	buf.Write(be.AppendUint64(nil, 0)) // version & flags
+	for _, p := range pairs {
+		pair := &bytes.Buffer{}
+		writeXDRString(pair, p.name)
+		switch v := p.value.(type) {
+		case uint64:
+			pair.Write(be.AppendUint32(nil, dataTypeUint64))
+			pair.Write(be.AppendUint32(nil, 1))
+			pair.Write(be.AppendUint64(nil, v))
+		case string:
+			pair.Write(be.AppendUint32(nil, dataTypeString))
+			pair.Write(be.AppendUint32(nil, 1))
+			writeXDRString(pair, v)
+		case []testPair:
+			pair.Write(be.AppendUint32(nil, dataTypeNVList))
+			pair.Write(be.AppendUint32(nil, 1))
+			writeXDRList(pair, v)
+		}
+		buf.Write(be.AppendUint32(nil, uint32(pair.Len()+8)))
+		buf.Write(be.AppendUint32(nil, uint32(pair.Len()+8)))
+		buf.Write(pair.Bytes())
+	}
+	buf.Write(be.AppendUint64(nil, 0)) // terminator
+}
+
+func writeXDRString(buf *bytes.Buffer, s string) {
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s))))
+	buf.WriteString(s)
+	buf.Write(make([]byte, align(len(s), 4)-len(s)))
+}
+
+func packNative(pairs []testPair) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{encodingNative, nativeLittleEndian, 0, 0})
+	writeNativeList(buf, pairs)
+	return buf.Bytes()
+}
+
+func writeNativeList(buf *bytes.Buffer, pairs []testPair) {
+	le := binary.LittleEndian
+	buf.Write(le.AppendUint64(nil, 0)) // version & flags
+	for _, p := range pairs {
+		var typ uint32
+		var value []byte
+		switch v := p.value.(type) {
+		case uint64:
+			typ, value = dataTypeUint64, le.AppendUint64(nil, v)
+		case string:
+			typ, value = dataTypeString, append([]byte(v), 0)
+		case []testPair:
+			typ, value = dataTypeNVList, make([]byte, 24)
+		}
+		nameSize := len(p.name) + 1
+		valueStart := align(nvPairHeaderSize+nameSize, 8)
+		size := align(valueStart+len(value), 8)
+
+		pair := make([]byte, size)
+		le.PutUint32(pair[0:4], uint32(size))
+		le.PutUint16(pair[4:6], uint16(nameSize))
+		le.PutUint32(pair[8:12], 1)
+		le.PutUint32(pair[12:16], typ)
+		copy(pair[nvPairHeaderSize:], p.name)
+		copy(pair[valueStart:], value)
+		buf.Write(pair)
+
+		if nested, ok := p.value.([]testPair); ok {
+			writeNativeList(buf, nested)
+		}
+	}
+	buf.Write(le.AppendUint32(nil, 0)) // terminator
+}
+
+func TestReadHeader_Full(t *testing.T) {
+	stream := beginRecord(binary.LittleEndian, HeaderTypeSubstream, FeatureLargeBlocks, 0, 1234, "pool/fs@snap1", nil)
+
+	hdr, err := ReadHeader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.Equal(t, binary.LittleEndian, hdr.ByteOrder)
+	require.Equal(t, HeaderTypeSubstream, hdr.HeaderType)
+	require.Equal(t, "pool/fs@snap1", hdr.ToName)
+	require.EqualValues(t, 1234, hdr.ToGUID)
+	require.Equal(t, ObjsetFilesystem, hdr.ObjsetType)
+	require.Equal(t, FlagFreeRecords, hdr.Flags)
+	require.Equal(t, time.Unix(1700000000, 0), hdr.CreationTime)
+	require.True(t, hdr.Features.Has(FeatureLargeBlocks))
+	require.False(t, hdr.Incremental())
+	require.False(t, hdr.Raw())
+	require.False(t, hdr.Encrypted())
+	require.False(t, hdr.Resuming())
+	require.False(t, hdr.Compound())
+	require.Nil(t, hdr.Payload)
+}
+
+func TestReadHeader_IncrementalBigEndian(t *testing.T) {
+	stream := beginRecord(binary.BigEndian, HeaderTypeSubstream, 0, 42, 43, "pool/fs@snap2", nil)
+
+	hdr, err := ReadHeader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.Equal(t, binary.BigEndian, hdr.ByteOrder)
+	require.True(t, hdr.Incremental())
+	require.EqualValues(t, 42, hdr.FromGUID)
+	require.EqualValues(t, 43, hdr.ToGUID)
+}
+
+func TestReadHeader_RawResuming(t *testing.T) {
+	payload := packNative([]testPair{
+		{PayloadResumeObject, uint64(128)},
+		{PayloadResumeOffset, uint64(4096)},
+		{"toname", "pool/fs@snap3"},
+		{PayloadCryptKeyData, []testPair{{"DSL_CRYPTO_SUITE", uint64(8)}}},
+	})
+	stream := beginRecord(binary.LittleEndian, HeaderTypeSubstream, FeatureRaw|FeatureResuming, 0, 99, "pool/fs@snap3", payload)
+
+	hdr, err := ReadHeader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.True(t, hdr.Raw())
+	require.True(t, hdr.Encrypted())
+	require.True(t, hdr.Resuming())
+	require.EqualValues(t, 128, hdr.ResumeObject())
+	require.EqualValues(t, 4096, hdr.ResumeOffset())
+	require.Equal(t, "pool/fs@snap3", hdr.Payload["toname"])
+	require.Equal(t, NVList{"DSL_CRYPTO_SUITE": uint64(8)}, hdr.Payload[PayloadCryptKeyData])
+}
+
+func TestReadHeader_Compound(t *testing.T) {
+	payload := packXDR([]testPair{
+		{PayloadFromSnapshot, "snap1"},
+		{PayloadToSnapshot, "snap2"},
+		{PayloadFilesystems, []testPair{{"0x1234", []testPair{{"name", "pool/fs"}}}}},
+	})
+
+	stream := beginRecord(binary.LittleEndian, HeaderTypeCompoundStream, 0, 0, 0, "pool/fs@snap2", payload)
+	stream = append(stream, endRecord(binary.LittleEndian)...)
+	stream = append(stream, beginRecord(binary.LittleEndian, HeaderTypeSubstream, FeatureRaw, 5, 6, "pool/fs@snap2", nil)...)
+	stream = append(stream, []byte("rest of the stream")...)
+
+	hdr, err := ReadHeader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.True(t, hdr.Compound())
+	require.True(t, hdr.Incremental())
+	require.True(t, hdr.Raw())
+	require.False(t, hdr.Encrypted())
+	require.Equal(t, "snap2", hdr.Payload[PayloadToSnapshot])
+	require.Equal(t, NVList{"0x1234": NVList{"name": "pool/fs"}}, hdr.Payload[PayloadFilesystems])
+	require.NotNil(t, hdr.Substream)
+	require.EqualValues(t, 5, hdr.Substream.FromGUID)
+	require.EqualValues(t, 6, hdr.Substream.ToGUID)
+}
+
+func TestReadHeader_Invalid(t *testing.T) {
+	valid := beginRecord(binary.LittleEndian, HeaderTypeSubstream, 0, 0, 1, "pool/fs@snap", packXDR([]testPair{{"a", uint64(1)}}))
+	badMagic := bytes.Clone(valid)
+	badMagic[8] = 0xff
+	notBegin := endRecord(binary.LittleEndian)
+	compoundNoEnd := beginRecord(binary.LittleEndian, HeaderTypeCompoundStream, 0, 0, 0, "pool/fs@snap", nil)
+
+	for name, stream := range map[string][]byte{
+		"empty":             {},
+		"garbage":           {0, 0, 7},
+		"bad magic":         badMagic,
+		"not begin":         notBegin,
+		"truncated payload": valid[:len(valid)-3],
+		"compound no end":   compoundNoEnd,
+	} {
+		_, err := ReadHeader(bytes.NewReader(stream))
+		require.ErrorIs(t, err, ErrInvalidStream, name)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	stream := beginRecord(binary.LittleEndian, HeaderTypeSubstream, 0, 0, 1, "pool/fs@snap", packXDR([]testPair{{"a", uint64(1)}}))
+	stream = append(stream, []byte("some more stream data")...)
+
+	hdr, rdr, err := Inspect(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.Equal(t, NVList{"a": uint64(1)}, hdr.Payload)
+
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, stream, data)
+
+	// The consumed bytes are replayed when the header is invalid too, read in small pieces
+	_, rdr, err = Inspect(iotest.OneByteReader(bytes.NewReader(stream[:100])))
+	require.ErrorIs(t, err, ErrInvalidStream)
+	data, err = io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, stream[:100], data)
+}
+
+func TestReadHeader_payloadTooLarge(t *testing.T) {
+	stream := beginRecord(binary.LittleEndian, HeaderTypeSubstream, 0, 0, 1, "pool/fs@snap", nil)
+	binary.LittleEndian.PutUint32(stream[4:8], MaximumPayloadSize+1)
+	_, err := ReadHeader(bytes.NewReader(stream))
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+}
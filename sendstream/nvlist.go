@@ -0,0 +1,337 @@
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// NVList is a decoded packed name-value list, which ZFS uses to store structured data in send streams.
+// Values are decoded as uint64, int64, bool, string, NVList or []NVList.
+// Values of other types (arrays, doubles) are present in the map with a nil value.
+type NVList map[string]any
+
+const (
+	encodingNative = 0
+	encodingXDR    = 1
+
+	nativeLittleEndian = 1
+
+	nvPairHeaderSize = 16
+	maxNVListDepth   = 16
+)
+
+// ErrUnsupportedEncoding is returned when a packed nvlist has an unknown encoding
+var ErrUnsupportedEncoding = errors.New("unsupported nvlist encoding")
+
+// The data types as defined by OpenZFS in nvpair.h
+const (
+	dataTypeUnknown uint32 = iota
+	dataTypeBoolean
+	dataTypeByte
+	dataTypeInt16
+	dataTypeUint16
+	dataTypeInt32
+	dataTypeUint32
+	dataTypeInt64
+	dataTypeUint64
+	dataTypeString
+	dataTypeByteArray
+	dataTypeInt16Array
+	dataTypeUint16Array
+	dataTypeInt32Array
+	dataTypeUint32Array
+	dataTypeInt64Array
+	dataTypeUint64Array
+	dataTypeStringArray
+	dataTypeHrtime
+	dataTypeNVList
+	dataTypeNVListArray
+	dataTypeBooleanValue
+	dataTypeInt8
+	dataTypeUint8
+	dataTypeBooleanArray
+	dataTypeInt8Array
+	dataTypeUint8Array
+	dataTypeDouble
+)
+
+// UnpackNVList decodes a packed nvlist in either the native or the XDR encoding
+func UnpackNVList(data []byte) (NVList, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("nvlist header truncated: %d bytes", len(data))
+	}
+
+	switch data[0] {
+	case encodingXDR:
+		d := &nvDecoder{data: data, pos: 4, order: binary.BigEndian}
+		return d.xdrList(0)
+	case encodingNative:
+		d := &nvDecoder{data: data, pos: 4, order: binary.BigEndian}
+		if data[1] == nativeLittleEndian {
+			d.order = binary.LittleEndian
+		}
+		return d.nativeList(0)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedEncoding, data[0])
+	}
+}
+
+type nvDecoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *nvDecoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("nvlist truncated: need %d bytes at offset %d of %d", n, d.pos, len(d.data))
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *nvDecoder) uint32() (uint32, error) {
+	b, err := d.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *nvDecoder) uint64() (uint64, error) {
+	b, err := d.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint64(b), nil
+}
+
+// seek moves to the given offset, which may never be before the current one
+func (d *nvDecoder) seek(offset int) error {
+	if offset < d.pos || offset > len(d.data) {
+		return fmt.Errorf("nvlist pair size invalid: offset %d, current %d of %d", offset, d.pos, len(d.data))
+	}
+	d.pos = offset
+	return nil
+}
+
+func (d *nvDecoder) xdrString() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.take(align(int(n), 4))
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+func (d *nvDecoder) xdrList(depth int) (NVList, error) {
+	if depth > maxNVListDepth {
+		return nil, fmt.Errorf("nvlist nested too deep")
+	}
+	// Skip the version and flags
+	_, err := d.take(8)
+	if err != nil {
+		return nil, err
+	}
+
+	list := NVList{}
+	for {
+		start := d.pos
+		encodedSize, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		decodedSize, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if encodedSize == 0 && decodedSize == 0 {
+			return list, nil // End of list
+		}
+
+		name, err := d.xdrString()
+		if err != nil {
+			return nil, err
+		}
+		typ, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		nelem, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		list[name], err = d.xdrValue(typ, nelem, depth)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", name, err)
+		}
+		// The encoded size includes any embedded lists, so we can skip past values we do not decode
+		err = d.seek(start + int(encodedSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *nvDecoder) xdrValue(typ, nelem uint32, depth int) (any, error) {
+	switch typ {
+	case dataTypeBoolean:
+		return true, nil
+	case dataTypeBooleanValue:
+		v, err := d.uint32()
+		return v != 0, err
+	case dataTypeByte, dataTypeUint8, dataTypeUint16, dataTypeUint32:
+		v, err := d.uint32()
+		return uint64(v), err
+	case dataTypeInt8, dataTypeInt16, dataTypeInt32:
+		v, err := d.uint32()
+		return int64(int32(v)), err
+	case dataTypeUint64:
+		return d.uint64()
+	case dataTypeInt64, dataTypeHrtime:
+		v, err := d.uint64()
+		return int64(v), err
+	case dataTypeString:
+		return d.xdrString()
+	case dataTypeNVList:
+		return d.xdrList(depth + 1)
+	case dataTypeNVListArray:
+		lists := make([]NVList, 0, min(nelem, 64))
+		for i := uint32(0); i < nelem; i++ {
+			l, err := d.xdrList(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			lists = append(lists, l)
+		}
+		return lists, nil
+	case dataTypeUnknown:
+		return nil, fmt.Errorf("unknown data type")
+	default:
+		return nil, nil // Skipped using the encoded size
+	}
+}
+
+func (d *nvDecoder) nativeList(depth int) (NVList, error) {
+	if depth > maxNVListDepth {
+		return nil, fmt.Errorf("nvlist nested too deep")
+	}
+	// Skip the version and flags
+	_, err := d.take(8)
+	if err != nil {
+		return nil, err
+	}
+
+	list := NVList{}
+	for {
+		start := d.pos
+		size, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return list, nil // End of list
+		}
+
+		hdr, err := d.take(nvPairHeaderSize - 4)
+		if err != nil {
+			return nil, err
+		}
+		nameSize := int(d.order.Uint16(hdr[0:2]))
+		nelem := d.order.Uint32(hdr[4:8])
+		typ := d.order.Uint32(hdr[8:12])
+
+		nameBytes, err := d.take(nameSize)
+		if err != nil {
+			return nil, err
+		}
+		name := cString(nameBytes)
+
+		valueStart := start + align(nvPairHeaderSize+nameSize, 8)
+		end := start + int(size)
+		if valueStart > end || end > len(d.data) {
+			return nil, fmt.Errorf("nvlist pair %s has invalid size %d", name, size)
+		}
+		value := d.data[valueStart:end]
+		d.pos = end
+
+		switch typ {
+		case dataTypeNVList:
+			// Embedded lists directly follow the pair
+			list[name], err = d.nativeList(depth + 1)
+		case dataTypeNVListArray:
+			lists := make([]NVList, 0, min(nelem, 64))
+			for i := uint32(0); i < nelem && err == nil; i++ {
+				var l NVList
+				l, err = d.nativeList(depth + 1)
+				lists = append(lists, l)
+			}
+			list[name] = lists
+		default:
+			list[name], err = d.nativeValue(typ, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", name, err)
+		}
+	}
+}
+
+func (d *nvDecoder) nativeValue(typ uint32, value []byte) (any, error) {
+	need := 0
+	switch typ {
+	case dataTypeByte, dataTypeInt8, dataTypeUint8:
+		need = 1
+	case dataTypeInt16, dataTypeUint16:
+		need = 2
+	case dataTypeInt32, dataTypeUint32, dataTypeBooleanValue:
+		need = 4
+	case dataTypeInt64, dataTypeUint64, dataTypeHrtime:
+		need = 8
+	}
+	if len(value) < need {
+		return nil, fmt.Errorf("value truncated: %d bytes", len(value))
+	}
+
+	switch typ {
+	case dataTypeBoolean:
+		return true, nil
+	case dataTypeBooleanValue:
+		return d.order.Uint32(value) != 0, nil
+	case dataTypeByte, dataTypeUint8:
+		return uint64(value[0]), nil
+	case dataTypeInt8:
+		return int64(int8(value[0])), nil
+	case dataTypeUint16:
+		return uint64(d.order.Uint16(value)), nil
+	case dataTypeInt16:
+		return int64(int16(d.order.Uint16(value))), nil
+	case dataTypeUint32:
+		return uint64(d.order.Uint32(value)), nil
+	case dataTypeInt32:
+		return int64(int32(d.order.Uint32(value))), nil
+	case dataTypeUint64:
+		return d.order.Uint64(value), nil
+	case dataTypeInt64, dataTypeHrtime:
+		return int64(d.order.Uint64(value)), nil
+	case dataTypeString:
+		if bytes.IndexByte(value, 0) < 0 {
+			return nil, fmt.Errorf("string not terminated")
+		}
+		return cString(value), nil
+	case dataTypeUnknown:
+		return nil, fmt.Errorf("unknown data type")
+	default:
+		return nil, nil
+	}
+}
+
+func align(n, to int) int {
+	return (n + to - 1) &^ (to - 1)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // List of HTTPConfig properties to retrieve from zfs list command by default
@@ -20,6 +21,7 @@ var dsPropList = []string{
 	PropertyMountPoint,
 	PropertyCompression,
 	PropertyVolSize,
+	PropertyVolBlockSize,
 	PropertyQuota,
 	PropertyRefQuota,
 	PropertyReferenced,
@@ -30,6 +32,10 @@ var dsPropList = []string{
 
 const (
 	fieldSeparator = "\t"
+
+	// commandWaitDelay is how long a command waits for the copying of its input once it exited or its context
+	// is done. Input that blocks, like a stalled network stream, would otherwise keep the command from returning.
+	commandWaitDelay = 5 * time.Second
 )
 
 // zfs is a helper function to wrap typical calls to zfs that ignores stdout.
@@ -66,6 +72,7 @@ func (c *command) Run(arg ...string) ([][]string, error) {
 	}
 	if c.stdin != nil {
 		cmd.Stdin = c.stdin
+		cmd.WaitDelay = commandWaitDelay
 	}
 
 	err := cmd.Run()
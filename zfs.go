@@ -10,6 +10,8 @@ import (
 	"strings"
 
 	"github.com/klauspost/compress/zstd"
+
+	"github.com/vansante/go-zfsutils/sendstream"
 )
 
 const (
@@ -350,20 +352,74 @@ type ReceiveOptions struct {
 	// EnableCompression enables zstd decompression
 	EnableDecompression bool
 
+	// Decompression configures the codec to decompress the stream with, it takes precedence over EnableDecompression
+	Decompression CompressionOptions
+
+	// Framed enables verification of the framed transport format, see NewFrameReader
+	Framed bool
+
+	// DecryptionKeys enables decryption of the stream encryption format, see NewDecryptReader.
+	// The key the stream was encrypted with is picked from these keys.
+	DecryptionKeys []StreamKey
+
 	// Force a rollback of the file system to the most recent snapshot before performing the receive operation.
 	ForceRollback bool
+
+	// BandwidthSchedule limits the rate the stream is read at by the time of day
+	BandwidthSchedule BandwidthSchedule
+
+	// InspectHeader, when set, is called with the decoded stream header before the receive is started.
+	// Returning an error aborts the receive.
+	InspectHeader func(header *sendstream.Header) error
 }
 
 // ReceiveSnapshot receives a ZFS stream from the input io.Reader.
 // A new snapshot is created with the specified name, and streams the input data into the newly-created snapshot.
 func ReceiveSnapshot(ctx context.Context, input io.Reader, name string, options ReceiveOptions) (*Dataset, error) {
-	if options.EnableDecompression {
-		decoder, err := zstd.NewReader(input)
+	if !options.BandwidthSchedule.IsZero() {
+		input = NewScheduleReader(ctx, input, options.BandwidthSchedule)
+	}
+	var frameReader *FrameReader
+	if options.Framed {
+		frameReader = NewFrameReader(input)
+		input = frameReader
+	}
+	var decryptReader *DecryptReader
+	if len(options.DecryptionKeys) > 0 {
+		decryptReader = NewDecryptReader(input, options.DecryptionKeys...)
+		input = decryptReader
+	}
+	// streamErr prefers the verification and decryption errors of the stream, as they explain why the receive failed
+	streamErr := func(err error) error {
+		if frameReader != nil && frameReader.Err() != nil {
+			return frameReader.Err()
+		}
+		if decryptReader != nil && decryptReader.Err() != nil {
+			return decryptReader.Err()
+		}
+		return err
+	}
+
+	decompression := options.Decompression
+	if decompression.Codec == "" && options.EnableDecompression {
+		decompression.Codec = CodecZstd
+	}
+	input, closer, err := decompressReader(input, decompression)
+	if err != nil {
+		return nil, streamErr(err)
+	}
+	defer closer()
+
+	if options.InspectHeader != nil {
+		header, rdr, err := sendstream.Inspect(input)
 		if err != nil {
-			return nil, fmt.Errorf("error creating zstd reader: %w", err)
+			return nil, streamErr(err)
 		}
-		defer decoder.Close()
-		input = decoder
+		err = options.InspectHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		input = rdr
 	}
 	c := command{
 		cmd:   Binary,
@@ -382,13 +438,36 @@ func ReceiveSnapshot(ctx context.Context, input io.Reader, name string, options
 	args = append(args, propsSlice(options.Properties)...)
 	args = append(args, name)
 
-	_, err := c.Run(args...)
+	_, err = c.Run(args...)
 	if err != nil {
-		return nil, err
+		return nil, streamErr(err)
+	}
+
+	// zfs receive stops at the end record of the stream, read the rest so the trailer of a framed stream and the
+	// last chunk of an encrypted stream are verified as well
+	var verifier io.Reader
+	switch {
+	case decryptReader != nil:
+		verifier = decryptReader
+	case frameReader != nil:
+		verifier = frameReader
+	}
+	if verifier != nil {
+		_, err = io.Copy(io.Discard, verifier)
+		err = streamErr(err)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s received, but the end of the stream failed verification: %w", name, err)
+		}
 	}
 	return GetDataset(ctx, name)
 }
 
+// AbortResumableReceive discards the partially received state of an interrupted resumable receive into the
+// dataset, so a new receive can start over. It runs zfs receive -A.
+func AbortResumableReceive(ctx context.Context, name string) error {
+	return zfs(ctx, "receive", "-A", name)
+}
+
 // SendOptions are options you can specify to customize the send command
 type SendOptions struct {
 	// For encrypted datasets, send data exactly as it exists on disk. This allows backups to
@@ -416,8 +495,16 @@ type SendOptions struct {
 	IncrementalBase *Dataset
 	// When set, uses a rate-limiter to limit the flow to this amount of bytes per second
 	BytesPerSecond int64
+	// BandwidthSchedule limits the flow by the time of day, on top of BytesPerSecond
+	BandwidthSchedule BandwidthSchedule
 	// CompressionLevel is the level of zstd compression, 0 for off
 	CompressionLevel zstd.EncoderLevel
+	// Compression configures the compression codec, it takes precedence over CompressionLevel when its codec is set
+	Compression CompressionOptions
+	// Framed wraps the stream in the checksummed framed transport format, see NewFrameWriter
+	Framed bool
+	// EncryptionKey encrypts the stream with AES-256-GCM, see NewEncryptWriter
+	EncryptionKey StreamKey
 }
 
 // SendSnapshot sends a ZFS stream of a snapshot to the input io.Writer.
@@ -443,12 +530,14 @@ func (d *Dataset) SendSnapshot(ctx context.Context, output io.Writer, options Se
 		args = append(args, "-i", options.IncrementalBase.Name)
 	}
 
-	output = rateLimitWriter(output, options.BytesPerSecond)
-	output, closer, err := zstdWriter(output, options.CompressionLevel)
+	if !options.BandwidthSchedule.IsZero() {
+		output = NewScheduleWriter(ctx, output, options.BandwidthSchedule)
+	}
+	output, finish, err := sendWriter(ctx, output, options.BytesPerSecond, options.Framed, options.EncryptionKey,
+		legacyCompression(options.CompressionLevel, options.Compression))
 	if err != nil {
 		return err
 	}
-	defer closer()
 
 	c := command{
 		cmd:    Binary,
@@ -457,26 +546,36 @@ func (d *Dataset) SendSnapshot(ctx context.Context, output io.Writer, options Se
 	}
 	args = append(args, d.Name)
 	_, err = c.Run(args...)
-	return err
+	return finish(err)
 }
 
 // ResumeSendOptions are options you can specify to customize the send resume command
 type ResumeSendOptions struct {
 	// When set, uses a rate-limiter to limit the flow to this amount of bytes per second
 	BytesPerSecond int64
+	// BandwidthSchedule limits the flow by the time of day, on top of BytesPerSecond
+	BandwidthSchedule BandwidthSchedule
 	// CompressionLevel is the level of zstd compression, zero for off
 	CompressionLevel zstd.EncoderLevel
+	// Compression configures the compression codec, it takes precedence over CompressionLevel when its codec is set
+	Compression CompressionOptions
+	// Framed wraps the stream in the checksummed framed transport format, see NewFrameWriter
+	Framed bool
+	// EncryptionKey encrypts the stream with AES-256-GCM, see NewEncryptWriter
+	EncryptionKey StreamKey
 }
 
 // ResumeSend resumes an interrupted ZFS stream of a snapshot to the input io.Writer using the receive_resume_token.
 // An error will be returned if the input dataset is not of snapshot type.
 func ResumeSend(ctx context.Context, output io.Writer, resumeToken string, options ResumeSendOptions) error {
-	output = rateLimitWriter(output, options.BytesPerSecond)
-	output, closer, err := zstdWriter(output, options.CompressionLevel)
+	if !options.BandwidthSchedule.IsZero() {
+		output = NewScheduleWriter(ctx, output, options.BandwidthSchedule)
+	}
+	output, finish, err := sendWriter(ctx, output, options.BytesPerSecond, options.Framed, options.EncryptionKey,
+		legacyCompression(options.CompressionLevel, options.Compression))
 	if err != nil {
 		return err
 	}
-	defer closer()
 
 	c := command{
 		cmd:    Binary,
@@ -485,7 +584,57 @@ func ResumeSend(ctx context.Context, output io.Writer, resumeToken string, optio
 	}
 	args := append([]string{"send"}, "-t", resumeToken)
 	_, err = c.Run(args...)
-	return err
+	return finish(err)
+}
+
+// SendSize estimates the size of the stream SendSnapshot sends with the options, with a dry run of zfs send.
+// The estimate is of the stream before compression, framing and encryption.
+func (d *Dataset) SendSize(ctx context.Context, options SendOptions) (uint64, error) {
+	if d.Type != DatasetSnapshot {
+		return 0, ErrOnlySnapshotsSupported
+	}
+
+	args := make([]string, 2, 6)
+	args[0] = "send"
+	args[1] = "-nvP"
+	if options.Raw {
+		args = append(args, "-w")
+	}
+	if options.IncludeProperties {
+		args = append(args, "-p")
+	}
+	if options.IncrementalBase != nil {
+		if options.IncrementalBase.Type != DatasetSnapshot {
+			return 0, fmt.Errorf("send base %s: %w", options.IncrementalBase.Name, ErrOnlySnapshotsSupported)
+		}
+		args = append(args, "-i", options.IncrementalBase.Name)
+	}
+	args = append(args, d.Name)
+
+	out, err := zfsOutput(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return parseSendSize(out)
+}
+
+// ResumeSendSize estimates the size of the rest of the stream ResumeSend sends, with a dry run of zfs send
+func ResumeSendSize(ctx context.Context, resumeToken string) (uint64, error) {
+	out, err := zfsOutput(ctx, "send", "-nvP", "-t", resumeToken)
+	if err != nil {
+		return 0, err
+	}
+	return parseSendSize(out)
+}
+
+// parseSendSize parses the size line of the parsable output of a zfs send dry run
+func parseSendSize(output [][]string) (uint64, error) {
+	for _, line := range output {
+		if len(line) == 2 && line[0] == "size" {
+			return strconv.ParseUint(line[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no size in zfs send output: %v", output)
 }
 
 // CreateVolumeOptions are options you can specify to customize the create volume command
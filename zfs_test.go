@@ -475,6 +475,80 @@ func TestSendSnapshotCompressed(t *testing.T) {
 	})
 }
 
+func TestReceiveSnapshotFramedTrailer(t *testing.T) {
+	TestZPool(testZPool, func() {
+		f, err := CreateFilesystem(context.Background(), testZPool+"/snapshot-test", CreateFilesystemOptions{
+			Properties: noMountProps,
+		})
+		require.NoError(t, err)
+
+		s, err := f.Snapshot(context.Background(), "test", SnapshotOptions{})
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, s.SendSnapshot(context.Background(), &buf, SendOptions{Framed: true}))
+
+		// The zfs stream itself is intact, only the byte count in the trailer after it is wrong
+		stream := buf.Bytes()
+		stream[len(stream)-1]++
+		_, err = ReceiveSnapshot(context.Background(), bytes.NewReader(stream), testZPool+"/recv-test", ReceiveOptions{
+			Framed:     true,
+			Properties: noMountProps,
+		})
+		var frameErr *FrameError
+		require.ErrorAs(t, err, &frameErr)
+		require.ErrorIs(t, err, ErrStreamCorrupted)
+	})
+}
+
+func TestSendSnapshotSize(t *testing.T) {
+	TestZPool(testZPool, func() {
+		f, err := CreateFilesystem(context.Background(), testZPool+"/snapshot-test", CreateFilesystemOptions{
+			Properties: noMountProps,
+		})
+		require.NoError(t, err)
+
+		s, err := f.Snapshot(context.Background(), "test", SnapshotOptions{})
+		require.NoError(t, err)
+
+		size, err := s.SendSize(context.Background(), SendOptions{})
+		require.NoError(t, err)
+
+		pipeRdr, pipeWrtr := io.Pipe()
+		go func() {
+			err := s.SendSnapshot(context.Background(), pipeWrtr, SendOptions{})
+			require.NoError(t, err)
+			require.NoError(t, pipeWrtr.Close())
+		}()
+		count := NewCountReader(pipeRdr)
+		_, err = io.Copy(io.Discard, count)
+		require.NoError(t, err)
+		require.InDelta(t, count.Count(), size, float64(count.Count())/2)
+
+		_, err = f.SendSize(context.Background(), SendOptions{})
+		require.ErrorIs(t, err, ErrOnlySnapshotsSupported)
+	})
+}
+
+func Test_parseSendSize(t *testing.T) {
+	size, err := parseSendSize([][]string{
+		{"incremental", "snap1", "tank/fs@snap2", "1089"},
+		{"size", "1089"},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 1089, size)
+
+	size, err = parseSendSize([][]string{
+		{"full", "tank/fs@snap1", "49152"},
+		{"size", "49152"},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 49152, size)
+
+	_, err = parseSendSize([][]string{{"full", "tank/fs@snap1", "49152"}})
+	require.Error(t, err)
+}
+
 func TestChildren(t *testing.T) {
 	TestZPool(testZPool, func() {
 		f, err := CreateFilesystem(context.Background(), testZPool+"/snapshot-test", CreateFilesystemOptions{
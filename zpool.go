@@ -0,0 +1,50 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	PoolBinary = "zpool"
+)
+
+// PoolHealth is the health of a pool, as reported by its health property
+type PoolHealth string
+
+const (
+	PoolHealthOnline    PoolHealth = "ONLINE"
+	PoolHealthDegraded  PoolHealth = "DEGRADED"
+	PoolHealthFaulted   PoolHealth = "FAULTED"
+	PoolHealthOffline   PoolHealth = "OFFLINE"
+	PoolHealthRemoved   PoolHealth = "REMOVED"
+	PoolHealthUnavail   PoolHealth = "UNAVAIL"
+	PoolHealthSuspended PoolHealth = "SUSPENDED"
+)
+
+// GetPoolHealth returns the health of the pool. It asks zpool, so unlike zfs properties it reflects degraded
+// and faulted devices as well.
+func GetPoolHealth(ctx context.Context, pool string) (PoolHealth, error) {
+	c := command{
+		cmd: PoolBinary,
+		ctx: ctx,
+	}
+	out, err := c.Run("get", "-H", "-o", "value", "health", pool)
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 || len(out[0]) == 0 {
+		return "", fmt.Errorf("no health in zpool output: %v", out)
+	}
+	return PoolHealth(out[0][0]), nil
+}
+
+// PoolName returns the name of the pool the dataset is in
+func PoolName(dataset string) string {
+	idx := strings.IndexAny(dataset, "/@")
+	if idx < 0 {
+		return dataset
+	}
+	return dataset[:idx]
+}
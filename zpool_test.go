@@ -0,0 +1,25 @@
+package zfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPoolHealth(t *testing.T) {
+	TestZPool(testZPool, func() {
+		health, err := GetPoolHealth(context.Background(), testZPool)
+		require.NoError(t, err)
+		require.Equal(t, PoolHealthOnline, health)
+
+		_, err = GetPoolHealth(context.Background(), testZPool+"-missing")
+		require.Error(t, err)
+	})
+}
+
+func TestPoolName(t *testing.T) {
+	require.Equal(t, "tank", PoolName("tank"))
+	require.Equal(t, "tank", PoolName("tank/customers/acme"))
+	require.Equal(t, "tank", PoolName("tank@snap"))
+}